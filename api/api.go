@@ -0,0 +1,421 @@
+// Package api serves an HTTP JSON API for managing hubs, their files and their members. Requests
+// are made through the hub.Connector, so they go through the same authorization checks as websocket
+// clients, and changes are seen by everyone connected to the hub.
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "collabserver/cloudlog"
+	"collabserver/collabauth"
+	"collabserver/collections"
+	"collabserver/hub"
+	wscodes "collabserver/websocketcodes"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	hubVar     = "hub"
+	fileVar    = "file"
+	emailVar   = "email"
+	accountVar = "account"
+	roleVar    = "role"
+	inviteVar  = "invite"
+
+	// Guests send public link tokens with this prefix in the Authorization header.
+	publicLinkPrefix = "PublicLink "
+)
+
+var (
+	errUnauthenticated = wscodes.NewError(wscodes.StatusEndpointUnauthorized, "missing or invalid credentials")
+	errBadRequest      = wscodes.NewError(wscodes.StatusInvalidRequest, "request body is not valid")
+)
+
+// Authenticate gives the ID of the user making the request, or "" if the request doesn't have
+// valid credentials.
+type Authenticate func(r *http.Request) string
+
+type server struct {
+	connector    *hub.Connector
+	authenticate Authenticate
+}
+
+// Register adds the API's routes to the router.
+func Register(router *mux.Router, connector *hub.Connector, authenticate Authenticate) {
+	s := &server{
+		connector:    connector,
+		authenticate: authenticate,
+	}
+	router.HandleFunc("/hubs", s.handle(s.listHubs)).Methods(http.MethodGet)
+	router.HandleFunc("/hubs", s.handle(s.createHub)).Methods(http.MethodPost)
+	router.HandleFunc("/hubs/join", s.handle(s.joinHub)).Methods(http.MethodPost)
+	router.HandleFunc("/hubs/{hub}/files", s.handle(s.listFiles)).Methods(http.MethodGet)
+	router.HandleFunc("/hubs/{hub}/files", s.handle(s.createFile)).Methods(http.MethodPost)
+	router.HandleFunc("/hubs/{hub}/files/{file}", s.handle(s.downloadFile)).Methods(http.MethodGet)
+	router.HandleFunc("/hubs/{hub}/files/{file}", s.handle(s.renameFile)).Methods(http.MethodPatch)
+	router.HandleFunc("/hubs/{hub}/files/{file}", s.handle(s.deleteFile)).Methods(http.MethodDelete)
+	router.HandleFunc("/hubs/{hub}/files/{file}/acl", s.handle(s.setFileACL)).Methods(http.MethodPut)
+	router.HandleFunc("/hubs/{hub}/users", s.handle(s.listUsers)).Methods(http.MethodGet)
+	router.HandleFunc("/hubs/{hub}/users/{email}", s.handle(s.setUserRole)).Methods(http.MethodPut)
+	router.HandleFunc("/hubs/{hub}/users/{email}", s.handle(s.removeUser)).Methods(http.MethodDelete)
+	router.HandleFunc("/hubs/{hub}/service-accounts", s.handle(s.listServiceAccounts)).Methods(http.MethodGet)
+	router.HandleFunc("/hubs/{hub}/service-accounts", s.handle(s.createServiceAccount)).Methods(http.MethodPost)
+	router.HandleFunc("/hubs/{hub}/service-accounts/{account}/rotate", s.handle(s.rotateServiceAccountKey)).Methods(http.MethodPost)
+	router.HandleFunc("/hubs/{hub}/service-accounts/{account}", s.handle(s.revokeServiceAccount)).Methods(http.MethodDelete)
+	router.HandleFunc("/hubs/{hub}/ownership-transfer", s.handle(s.transferOwnership)).Methods(http.MethodPost)
+	router.HandleFunc("/hubs/{hub}/ownership-transfer", s.handle(s.cancelOwnershipTransfer)).Methods(http.MethodDelete)
+	router.HandleFunc("/hubs/{hub}/ownership-transfer/accept", s.handle(s.acceptOwnership)).Methods(http.MethodPost)
+	router.HandleFunc("/hubs/{hub}/audit", s.handle(s.listAudit)).Methods(http.MethodGet)
+	router.HandleFunc("/hubs/{hub}/invites", s.handle(s.listInvites)).Methods(http.MethodGet)
+	router.HandleFunc("/hubs/{hub}/invites", s.handle(s.createInvite)).Methods(http.MethodPost)
+	router.HandleFunc("/hubs/{hub}/invites/{invite}", s.handle(s.revokeInvite)).Methods(http.MethodDelete)
+	router.HandleFunc("/hubs/{hub}/roles", s.handle(s.listRoles)).Methods(http.MethodGet)
+	router.HandleFunc("/hubs/{hub}/roles/{role}", s.handle(s.setRole)).Methods(http.MethodPut)
+	router.HandleFunc("/hubs/{hub}/roles/{role}", s.handle(s.deleteRole)).Methods(http.MethodDelete)
+	router.HandleFunc("/public/files", s.handlePublic(s.listPublicFiles)).Methods(http.MethodGet)
+	router.HandleFunc("/public/files/{file}", s.handlePublic(s.downloadPublicFile)).Methods(http.MethodGet)
+}
+
+// handlerFunc handles an authenticated request, giving the value to respond with as JSON.
+type handlerFunc func(userID string, r *http.Request) (interface{}, error)
+
+// handle authenticates the request before passing it on to fn, and writes fn's result or error.
+func (s *server) handle(fn handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := s.authenticate(r)
+		if userID == "" {
+			writeError(w, http.StatusUnauthorized, errUnauthenticated)
+			return
+		}
+		result, err := fn(userID, r)
+		writeResult(w, r, userID, result, err)
+	}
+}
+
+// publicHandlerFunc handles a request made with a public link, giving the value to respond with
+// as JSON.
+type publicHandlerFunc func(token string, r *http.Request) (interface{}, error)
+
+// handlePublic passes requests that have a public link token on to fn, and writes fn's result or
+// error. Public link tokens are sent as "Authorization: PublicLink <token>".
+func (s *server) handlePublic(fn publicHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, publicLinkPrefix) {
+			writeError(w, http.StatusUnauthorized, errUnauthenticated)
+			return
+		}
+		result, err := fn(strings.TrimPrefix(header, publicLinkPrefix), r)
+		writeResult(w, r, "a guest", result, err)
+	}
+}
+
+// writeResult responds with the result of the request made by caller, or with its error.
+func writeResult(w http.ResponseWriter, r *http.Request, caller string, result interface{}, err error) {
+	if err != nil {
+		e := wscodes.AsError(err)
+		log.Printf("API request %s %s by %s failed: %v", r.Method, r.URL.Path, caller, e)
+		writeError(w, httpStatus(e.Code), e)
+		return
+	}
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+type hubResponse struct {
+	Name string `json:"name"`
+}
+
+type fileRequest struct {
+	Name string `json:"name"`
+}
+
+type aclRequest struct {
+	Entries []collections.FileACLEntry `json:"entries"`
+}
+
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+type roleDefinitionRequest struct {
+	Permissions []string `json:"permissions"`
+}
+
+type serviceAccountRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type ownershipRequest struct {
+	Email string `json:"email"`
+}
+
+type joinRequest struct {
+	Token string `json:"token"`
+}
+
+func (s *server) listHubs(userID string, r *http.Request) (interface{}, error) {
+	hubs := []hubResponse{}
+	for _, name := range s.connector.RetrieveHubList(userID) {
+		hubs = append(hubs, hubResponse{Name: name})
+	}
+	return hubs, nil
+}
+
+func (s *server) createHub(userID string, r *http.Request) (interface{}, error) {
+	name, err := s.connector.CreateHub(userID)
+	if err != nil {
+		return nil, err
+	}
+	return hubResponse{Name: name}, nil
+}
+
+func (s *server) joinHub(userID string, r *http.Request) (interface{}, error) {
+	body := joinRequest{}
+	if err := decodeBody(r, &body); err != nil || body.Token == "" {
+		return nil, errBadRequest
+	}
+	name, err := s.connector.JoinHubWithInvite(userID, body.Token)
+	if err != nil {
+		return nil, err
+	}
+	return hubResponse{Name: name}, nil
+}
+
+func (s *server) listFiles(userID string, r *http.Request) (interface{}, error) {
+	return s.connector.ListFiles(userID, mux.Vars(r)[hubVar])
+}
+
+func (s *server) createFile(userID string, r *http.Request) (interface{}, error) {
+	body := fileRequest{}
+	if err := decodeBody(r, &body); err != nil || body.Name == "" {
+		return nil, errBadRequest
+	}
+	err := s.connector.CreateFile(userID, mux.Vars(r)[hubVar], body.Name)
+	if err != nil {
+		return nil, err
+	}
+	return fileRequest{Name: body.Name}, nil
+}
+
+func (s *server) downloadFile(userID string, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	return s.connector.RetrieveFile(userID, vars[hubVar], vars[fileVar])
+}
+
+func (s *server) listPublicFiles(token string, r *http.Request) (interface{}, error) {
+	return s.connector.ListPublicFiles(token)
+}
+
+func (s *server) downloadPublicFile(token string, r *http.Request) (interface{}, error) {
+	return s.connector.RetrievePublicFile(token, mux.Vars(r)[fileVar])
+}
+
+func (s *server) renameFile(userID string, r *http.Request) (interface{}, error) {
+	body := fileRequest{}
+	if err := decodeBody(r, &body); err != nil || body.Name == "" {
+		return nil, errBadRequest
+	}
+	vars := mux.Vars(r)
+	err := s.connector.RenameFile(userID, vars[hubVar], vars[fileVar], body.Name)
+	if err != nil {
+		return nil, err
+	}
+	return fileRequest{Name: body.Name}, nil
+}
+
+func (s *server) deleteFile(userID string, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	return nil, s.connector.DeleteFile(userID, vars[hubVar], vars[fileVar])
+}
+
+func (s *server) setFileACL(userID string, r *http.Request) (interface{}, error) {
+	body := aclRequest{}
+	if err := decodeBody(r, &body); err != nil {
+		return nil, errBadRequest
+	}
+	vars := mux.Vars(r)
+	entries, err := s.connector.SetFileACL(userID, vars[hubVar], vars[fileVar], body.Entries)
+	if err != nil {
+		return nil, err
+	}
+	return aclRequest{Entries: entries}, nil
+}
+
+func (s *server) listUsers(userID string, r *http.Request) (interface{}, error) {
+	return s.connector.ListUsers(userID, mux.Vars(r)[hubVar])
+}
+
+func (s *server) setUserRole(userID string, r *http.Request) (interface{}, error) {
+	body := roleRequest{}
+	if err := decodeBody(r, &body); err != nil || body.Role == "" {
+		return nil, errBadRequest
+	}
+	vars := mux.Vars(r)
+	return nil, s.connector.SetUserRole(userID, vars[hubVar], vars[emailVar], body.Role)
+}
+
+func (s *server) removeUser(userID string, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	return nil, s.connector.SetUserRole(userID, vars[hubVar], vars[emailVar], collabauth.NoRole)
+}
+
+func (s *server) listServiceAccounts(userID string, r *http.Request) (interface{}, error) {
+	return s.connector.ListServiceAccounts(userID, mux.Vars(r)[hubVar])
+}
+
+func (s *server) createServiceAccount(userID string, r *http.Request) (interface{}, error) {
+	body := serviceAccountRequest{}
+	if err := decodeBody(r, &body); err != nil || body.Name == "" || body.Role == "" {
+		return nil, errBadRequest
+	}
+	return s.connector.CreateServiceAccount(userID, mux.Vars(r)[hubVar], body.Name, body.Role)
+}
+
+func (s *server) rotateServiceAccountKey(userID string, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	return s.connector.RotateServiceAccountKey(userID, vars[hubVar], vars[accountVar])
+}
+
+func (s *server) revokeServiceAccount(userID string, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	return nil, s.connector.RevokeServiceAccount(userID, vars[hubVar], vars[accountVar])
+}
+
+func (s *server) transferOwnership(userID string, r *http.Request) (interface{}, error) {
+	body := ownershipRequest{}
+	if err := decodeBody(r, &body); err != nil || body.Email == "" {
+		return nil, errBadRequest
+	}
+	return s.connector.TransferOwnership(userID, mux.Vars(r)[hubVar], body.Email)
+}
+
+func (s *server) acceptOwnership(userID string, r *http.Request) (interface{}, error) {
+	return s.connector.AcceptOwnership(userID, mux.Vars(r)[hubVar])
+}
+
+func (s *server) cancelOwnershipTransfer(userID string, r *http.Request) (interface{}, error) {
+	return nil, s.connector.CancelOwnershipTransfer(userID, mux.Vars(r)[hubVar])
+}
+
+// listAudit takes the audit query from the query parameters actor, action, target, since and until,
+// which are RFC 3339 times, limit and pageToken.
+func (s *server) listAudit(userID string, r *http.Request) (interface{}, error) {
+	params := r.URL.Query()
+	query := collections.AuditQuery{
+		Actor:     params.Get("actor"),
+		Action:    params.Get("action"),
+		Target:    params.Get("target"),
+		PageToken: params.Get("pageToken"),
+	}
+	var err error
+	for param, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+		if value := params.Get(param); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				return nil, errBadRequest
+			}
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return nil, errBadRequest
+		}
+	}
+	return s.connector.ListAudit(userID, mux.Vars(r)[hubVar], query)
+}
+
+func (s *server) listInvites(userID string, r *http.Request) (interface{}, error) {
+	return s.connector.ListInvites(userID, mux.Vars(r)[hubVar])
+}
+
+func (s *server) createInvite(userID string, r *http.Request) (interface{}, error) {
+	body := collections.Invite{}
+	if err := decodeBody(r, &body); err != nil || body.Role == "" {
+		return nil, errBadRequest
+	}
+	return s.connector.CreateInvite(userID, mux.Vars(r)[hubVar], body)
+}
+
+func (s *server) revokeInvite(userID string, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	return nil, s.connector.RevokeInvite(userID, vars[hubVar], vars[inviteVar])
+}
+
+func (s *server) listRoles(userID string, r *http.Request) (interface{}, error) {
+	return s.connector.ListRoles(userID, mux.Vars(r)[hubVar])
+}
+
+func (s *server) setRole(userID string, r *http.Request) (interface{}, error) {
+	body := roleDefinitionRequest{}
+	if err := decodeBody(r, &body); err != nil {
+		return nil, errBadRequest
+	}
+	vars := mux.Vars(r)
+	return s.connector.SetRole(userID, vars[hubVar], vars[roleVar], body.Permissions)
+}
+
+func (s *server) deleteRole(userID string, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	return nil, s.connector.DeleteRole(userID, vars[hubVar], vars[roleVar])
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// httpStatus gives the HTTP status code that best matches the error code.
+func httpStatus(code string) int {
+	switch code {
+	case wscodes.StatusInvalidRequest, wscodes.StatusEndpointNotValid:
+		return http.StatusBadRequest
+	case wscodes.StatusEndpointUnauthorized, wscodes.StatusInviteInvalid, wscodes.StatusPublicLinkInvalid:
+		return http.StatusForbidden
+	case wscodes.StatusFileDoesntExist, wscodes.StatusHubDoesntExist, wscodes.StatusUserNotFound,
+		wscodes.StatusCheckpointDoesntExist, wscodes.StatusServiceAccountDoesntExist, wscodes.StatusRoleDoesntExist,
+		wscodes.StatusInviteDoesntExist, wscodes.StatusNoOwnershipTransfer, wscodes.StatusPublicLinkDoesntExist:
+		return http.StatusNotFound
+	case wscodes.StatusFileExists, wscodes.StatusRoleInUse, wscodes.StatusLastOwner, wscodes.StatusFileReplaced:
+		return http.StatusConflict
+	case wscodes.StatusMessageTooLarge, wscodes.StatusFileStateTooLarge,
+		wscodes.StatusOperationTooLarge, wscodes.StatusTooManyOperations:
+		return http.StatusRequestEntityTooLarge
+	case wscodes.StatusRateLimited:
+		return http.StatusTooManyRequests
+	case wscodes.StatusDatastoreError, wscodes.StatusTimeout, wscodes.StatusSnapshotBehind:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type errorResponse struct {
+	Error *wscodes.Error `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, e *wscodes.Error) {
+	if retryAfter, ok := e.Details["retryAfter"]; ok {
+		// Retry-After is in seconds, while the detail is in milliseconds.
+		if millis, err := strconv.ParseInt(retryAfter, 10, 64); err == nil {
+			w.Header().Set("Retry-After", strconv.FormatInt((millis+999)/1000, 10))
+		}
+	}
+	writeJSON(w, status, errorResponse{Error: e})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing API response: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	wscodes "collabserver/websocketcodes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestUnauthenticatedRequestsAreRejected(t *testing.T) {
+	router := mux.NewRouter()
+	Register(router, nil, func(r *http.Request) string { return "" })
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/hubs", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request gave status %d but want %d", recorder.Code, http.StatusUnauthorized)
+	}
+	body := errorResponse{}
+	if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil || body.Error == nil {
+		t.Fatalf("unauthenticated request gave body that isn't an error: %v", err)
+	}
+	if body.Error.Code != wscodes.StatusEndpointUnauthorized {
+		t.Errorf("unauthenticated request gave error code %s but want %s", body.Error.Code, wscodes.StatusEndpointUnauthorized)
+	}
+}
+
+func TestRateLimitedErrorsSetRetryAfter(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	e := wscodes.NewError(wscodes.StatusRateLimited, "too many requests").WithDetail("retryAfter", "1500")
+	writeError(recorder, httpStatus(e.Code), e)
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("rate limited error gave status %d but want %d", recorder.Code, http.StatusTooManyRequests)
+	}
+	if got := recorder.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("rate limited error gave Retry-After %q but want %q", got, "2")
+	}
+}
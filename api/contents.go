@@ -0,0 +1,480 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "collabserver/cloudlog"
+	"collabserver/collabauth"
+	"collabserver/collections"
+	"collabserver/hub"
+	wscodes "collabserver/websocketcodes"
+
+	"github.com/gorilla/mux"
+)
+
+// The contents API follows the Jupyter Server Contents API, so that Jupyter tooling can read and
+// write a hub's files. A hub is a single directory with no subdirectories, and each file's contents
+// are its latest snapshot, once brought up to date with its operations. See https://jupyter-server.readthedocs.io/en/latest/developers/rest-api.html.
+
+const (
+	pathVar       = "path"
+	checkpointVar = "checkpoint"
+
+	typeNotebook  = "notebook"
+	typeFile      = "file"
+	typeDirectory = "directory"
+
+	formatJSON   = "json"
+	formatText   = "text"
+	formatBase64 = "base64"
+
+	notebookExt = ".ipynb"
+
+	// Files have at most one checkpoint, which always has this ID like in Jupyter's own file checkpoints.
+	checkpointID = "checkpoint"
+)
+
+var (
+	// emptyNotebook is the contents of a notebook that has never been saved.
+	emptyNotebook = json.RawMessage(`{"cells":[],"metadata":{},"nbformat":4,"nbformat_minor":5}`)
+
+	errNoDirectories = wscodes.NewError(wscodes.StatusInvalidRequest, "hubs don't have directories")
+	errNotNotebook   = wscodes.NewError(wscodes.StatusInvalidRequest, "notebook content must be a JSON object")
+	errCheckpointID  = wscodes.NewError(wscodes.StatusCheckpointDoesntExist, "checkpoint doesn't exist")
+)
+
+// RegisterContents adds the contents API's routes to the router, which must have a {hub} variable
+// in its path prefix. Jupyter clients are then pointed at that prefix as their server's base URL.
+func RegisterContents(router *mux.Router, connector *hub.Connector, authenticate Authenticate) {
+	s := &server{
+		connector:    connector,
+		authenticate: authenticate,
+	}
+	// Checkpoint routes go first, so that they aren't taken for file paths.
+	checkpoints := "/api/contents/{path:[^/]+}/checkpoints"
+	router.HandleFunc(checkpoints, s.handleContents(s.listCheckpoints)).Methods(http.MethodGet)
+	router.HandleFunc(checkpoints, s.handleContents(s.createCheckpoint)).Methods(http.MethodPost)
+	router.HandleFunc(checkpoints+"/{checkpoint}", s.handleContents(s.restoreCheckpoint)).Methods(http.MethodPost)
+	router.HandleFunc(checkpoints+"/{checkpoint}", s.handleContents(s.deleteCheckpoint)).Methods(http.MethodDelete)
+	for _, contents := range []string{"/api/contents", "/api/contents/", "/api/contents/{path:.+}"} {
+		router.HandleFunc(contents, s.handleContents(s.getContents)).Methods(http.MethodGet)
+		router.HandleFunc(contents, s.handleContents(s.newUntitled)).Methods(http.MethodPost)
+		router.HandleFunc(contents, s.handleContents(s.saveContents)).Methods(http.MethodPut)
+		router.HandleFunc(contents, s.handleContents(s.renameContents)).Methods(http.MethodPatch)
+		router.HandleFunc(contents, s.handleContents(s.deleteContents)).Methods(http.MethodDelete)
+	}
+}
+
+// contentsHandlerFunc handles an authenticated contents request, giving the HTTP status and the
+// value to respond with as JSON.
+type contentsHandlerFunc func(userID string, r *http.Request) (int, interface{}, error)
+
+// handleContents is like handle, but for contents handlers, which pick their own status and report
+// errors the way Jupyter does.
+func (s *server) handleContents(fn contentsHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := s.authenticate(r)
+		if userID == "" {
+			writeContentsError(w, http.StatusUnauthorized, errUnauthenticated)
+			return
+		}
+		status, result, err := fn(userID, r)
+		if err != nil {
+			e := wscodes.AsError(err)
+			log.Printf("Contents request %s %s by %s failed: %v", r.Method, r.URL.Path, userID, e)
+			writeContentsError(w, httpStatus(e.Code), e)
+			return
+		}
+		if result == nil {
+			w.WriteHeader(status)
+			return
+		}
+		writeJSON(w, status, result)
+	}
+}
+
+// contentsModel is a file or directory as described by the Jupyter Contents API. Content, Format
+// and Mimetype are null unless the content was asked for.
+type contentsModel struct {
+	Name         string      `json:"name"`
+	Path         string      `json:"path"`
+	Type         string      `json:"type"`
+	Writable     bool        `json:"writable"`
+	Created      time.Time   `json:"created"`
+	LastModified time.Time   `json:"last_modified"`
+	Mimetype     interface{} `json:"mimetype"`
+	Content      interface{} `json:"content"`
+	Format       interface{} `json:"format"`
+}
+
+// contentsRequest is the body of PUT, POST and PATCH requests; each uses a subset of the fields.
+type contentsRequest struct {
+	Path     string          `json:"path"`
+	Type     string          `json:"type"`
+	Format   string          `json:"format"`
+	Content  json.RawMessage `json:"content"`
+	Ext      string          `json:"ext"`
+	CopyFrom string          `json:"copy_from"`
+}
+
+type checkpointModel struct {
+	ID           string    `json:"id"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+func (s *server) getContents(userID string, r *http.Request) (int, interface{}, error) {
+	hubName, filePath := contentsVars(r)
+	withContent := r.URL.Query().Get("content") != "0"
+	files, permissions, err := s.connector.ListFilesWithPermissions(userID, hubName)
+	if err != nil {
+		return 0, nil, err
+	}
+	if filePath == "" {
+		return http.StatusOK, directoryModel(files, permissions, withContent), nil
+	}
+	if strings.Contains(filePath, "/") {
+		return 0, nil, fileNotFound(filePath)
+	}
+	info := findFile(files, filePath)
+	if info == nil {
+		return 0, nil, fileNotFound(filePath)
+	}
+	if withContent {
+		// The listed snapshot can be behind the file's operations.
+		info.Snapshot.File, err = s.connector.RetrieveCurrentFile(userID, hubName, info.Name)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	model, err := fileModel(info, withContent)
+	if err != nil {
+		return 0, nil, err
+	}
+	if requested := r.URL.Query().Get("type"); requested != "" && requested != model.Type {
+		return 0, nil, wscodes.Errorf(wscodes.StatusInvalidRequest, "%s is not a %s", filePath, requested)
+	}
+	return http.StatusOK, model, nil
+}
+
+// newUntitled makes a new file with an unused "Untitled" name in the hub, or copies a file if
+// copy_from is given.
+func (s *server) newUntitled(userID string, r *http.Request) (int, interface{}, error) {
+	hubName, dir := contentsVars(r)
+	if dir != "" {
+		return 0, nil, errNoDirectories
+	}
+	body := contentsRequest{}
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &body); err != nil {
+			return 0, nil, errBadRequest
+		}
+	}
+	files, err := s.connector.ListFiles(userID, hubName)
+	if err != nil {
+		return 0, nil, err
+	}
+	state := ""
+	var name string
+	if body.CopyFrom != "" {
+		source := findFile(files, path.Base(body.CopyFrom))
+		if source == nil {
+			return 0, nil, fileNotFound(body.CopyFrom)
+		}
+		state, err = s.connector.RetrieveCurrentFile(userID, hubName, source.Name)
+		if err != nil {
+			return 0, nil, err
+		}
+		ext := path.Ext(source.Name)
+		name = unusedName(files, strings.TrimSuffix(source.Name, ext)+"-Copy", ext, true)
+	} else {
+		switch body.Type {
+		case "", typeNotebook:
+			name = unusedName(files, "Untitled", notebookExt, false)
+		case typeFile:
+			name = unusedName(files, "untitled", body.Ext, false)
+		default:
+			return 0, nil, errNoDirectories
+		}
+	}
+	err = s.connector.CreateFile(userID, hubName, name)
+	if err != nil {
+		return 0, nil, err
+	}
+	if state != "" {
+		err = s.connector.SaveFile(userID, hubName, name, state)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	return s.savedModel(userID, hubName, name, http.StatusCreated)
+}
+
+// saveContents replaces a file's contents, creating the file if it doesn't exist.
+func (s *server) saveContents(userID string, r *http.Request) (int, interface{}, error) {
+	hubName, filePath := contentsVars(r)
+	if filePath == "" || strings.Contains(filePath, "/") {
+		return 0, nil, errNoDirectories
+	}
+	body := contentsRequest{}
+	if err := decodeBody(r, &body); err != nil {
+		return 0, nil, errBadRequest
+	}
+	state, err := stateFromContent(body)
+	if err != nil {
+		return 0, nil, err
+	}
+	files, err := s.connector.ListFiles(userID, hubName)
+	if err != nil {
+		return 0, nil, err
+	}
+	status := http.StatusOK
+	if findFile(files, filePath) == nil {
+		err = s.connector.CreateFile(userID, hubName, filePath)
+		if err != nil {
+			return 0, nil, err
+		}
+		status = http.StatusCreated
+	}
+	err = s.connector.SaveFile(userID, hubName, filePath, state)
+	if err != nil {
+		return 0, nil, err
+	}
+	return s.savedModel(userID, hubName, filePath, status)
+}
+
+func (s *server) renameContents(userID string, r *http.Request) (int, interface{}, error) {
+	hubName, filePath := contentsVars(r)
+	body := contentsRequest{}
+	if err := decodeBody(r, &body); err != nil || body.Path == "" {
+		return 0, nil, errBadRequest
+	}
+	newPath := strings.TrimPrefix(body.Path, "/")
+	if filePath == "" || strings.Contains(newPath, "/") {
+		return 0, nil, errNoDirectories
+	}
+	err := s.connector.RenameFile(userID, hubName, filePath, newPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	return s.savedModel(userID, hubName, newPath, http.StatusOK)
+}
+
+func (s *server) deleteContents(userID string, r *http.Request) (int, interface{}, error) {
+	hubName, filePath := contentsVars(r)
+	if filePath == "" {
+		return 0, nil, errNoDirectories
+	}
+	return http.StatusNoContent, nil, s.connector.DeleteFile(userID, hubName, filePath)
+}
+
+func (s *server) listCheckpoints(userID string, r *http.Request) (int, interface{}, error) {
+	hubName, filePath := contentsVars(r)
+	info, err := s.fileInfo(userID, hubName, filePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, checkpointModels(info), nil
+}
+
+func (s *server) createCheckpoint(userID string, r *http.Request) (int, interface{}, error) {
+	hubName, filePath := contentsVars(r)
+	err := s.connector.CreateCheckpoint(userID, hubName, filePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	info, err := s.fileInfo(userID, hubName, filePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	checkpoints := checkpointModels(info)
+	if len(checkpoints) == 0 {
+		// Someone deleted it in between.
+		return 0, nil, errCheckpointID
+	}
+	return http.StatusCreated, checkpoints[0], nil
+}
+
+func (s *server) restoreCheckpoint(userID string, r *http.Request) (int, interface{}, error) {
+	hubName, filePath := contentsVars(r)
+	if mux.Vars(r)[checkpointVar] != checkpointID {
+		return 0, nil, errCheckpointID
+	}
+	return http.StatusNoContent, nil, s.connector.RestoreCheckpoint(userID, hubName, filePath)
+}
+
+func (s *server) deleteCheckpoint(userID string, r *http.Request) (int, interface{}, error) {
+	hubName, filePath := contentsVars(r)
+	if mux.Vars(r)[checkpointVar] != checkpointID {
+		return 0, nil, errCheckpointID
+	}
+	return http.StatusNoContent, nil, s.connector.DeleteCheckpoint(userID, hubName, filePath)
+}
+
+// savedModel gives the model of a file that was just written, without its content like Jupyter does.
+func (s *server) savedModel(userID, hubName, fileName string, status int) (int, interface{}, error) {
+	info, err := s.fileInfo(userID, hubName, fileName)
+	if err != nil {
+		return 0, nil, err
+	}
+	model, err := fileModel(info, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	return status, model, nil
+}
+
+func (s *server) fileInfo(userID, hubName, fileName string) (*collections.FileInfo, error) {
+	files, err := s.connector.ListFiles(userID, hubName)
+	if err != nil {
+		return nil, err
+	}
+	info := findFile(files, fileName)
+	if info == nil {
+		return nil, fileNotFound(fileName)
+	}
+	return info, nil
+}
+
+// contentsVars gives the hub and the file path of the request, without leading or trailing slashes.
+func contentsVars(r *http.Request) (string, string) {
+	vars := mux.Vars(r)
+	return vars[hubVar], strings.Trim(vars[pathVar], "/")
+}
+
+func findFile(files []collections.FileInfo, name string) *collections.FileInfo {
+	for i := range files {
+		if files[i].Name == name {
+			return &files[i]
+		}
+	}
+	return nil
+}
+
+func fileNotFound(fileName string) *wscodes.Error {
+	return wscodes.NewError(wscodes.StatusFileDoesntExist, "file doesn't exist").WithDetail("file", fileName)
+}
+
+// unusedName gives the first of base+ext, base+"1"+ext, base+"2"+ext... that isn't a file's name,
+// skipping base+ext if numberFirst is set.
+func unusedName(files []collections.FileInfo, base, ext string, numberFirst bool) string {
+	for i := 0; ; i++ {
+		if i == 0 && numberFirst {
+			continue
+		}
+		name := base + ext
+		if i > 0 {
+			name = base + strconv.Itoa(i) + ext
+		}
+		if findFile(files, name) == nil {
+			return name
+		}
+	}
+}
+
+// directoryModel gives the model of the hub's only directory, listing its files without content.
+// It's writable if the user's permissions in the hub let them create files.
+func directoryModel(files []collections.FileInfo, permissions []string, withContent bool) *contentsModel {
+	model := &contentsModel{
+		Type:     typeDirectory,
+		Writable: collabauth.HasPermission(permissions, collabauth.FileCreate),
+	}
+	for _, info := range files {
+		if info.LastModified.After(model.LastModified) {
+			model.LastModified = info.LastModified
+		}
+	}
+	model.Created = model.LastModified
+	if withContent {
+		content := []*contentsModel{}
+		for i := range files {
+			// Without content a file model can't fail to build.
+			fm, _ := fileModel(&files[i], false)
+			content = append(content, fm)
+		}
+		model.Content = content
+		model.Format = formatJSON
+	}
+	return model
+}
+
+// fileModel gives the model of a file, with its latest snapshot as the content if withContent is
+// set. Files ending in .ipynb are notebooks and the rest are text files, and they're writable if
+// the user they were listed for can edit them.
+func fileModel(info *collections.FileInfo, withContent bool) (*contentsModel, error) {
+	model := &contentsModel{
+		Name:         info.Name,
+		Path:         info.Name,
+		Type:         typeFile,
+		Writable:     info.Editable,
+		Created:      info.LastModified,
+		LastModified: info.LastModified,
+	}
+	if path.Ext(info.Name) == notebookExt {
+		model.Type = typeNotebook
+	}
+	if !withContent {
+		return model, nil
+	}
+	if model.Type == typeNotebook {
+		content := emptyNotebook
+		if info.Snapshot.File != "" {
+			content = json.RawMessage(info.Snapshot.File)
+			if !json.Valid(content) {
+				return nil, wscodes.NewError(wscodes.StatusFailure, "notebook snapshot isn't valid JSON").
+					WithDetail("file", info.Name)
+			}
+		}
+		model.Content = content
+		model.Format = formatJSON
+		return model, nil
+	}
+	model.Content = info.Snapshot.File
+	model.Format = formatText
+	model.Mimetype = "text/plain"
+	return model, nil
+}
+
+// stateFromContent gives the snapshot to save for the content of a PUT request.
+func stateFromContent(body contentsRequest) (string, error) {
+	switch body.Type {
+	case typeNotebook:
+		trimmed := strings.TrimSpace(string(body.Content))
+		if !strings.HasPrefix(trimmed, "{") || !json.Valid(body.Content) {
+			return "", errNotNotebook
+		}
+		return trimmed, nil
+	case typeFile:
+		if body.Format == formatBase64 {
+			return "", wscodes.NewError(wscodes.StatusInvalidRequest, "binary files aren't supported")
+		}
+		var text string
+		if err := json.Unmarshal(body.Content, &text); err != nil {
+			return "", errBadRequest
+		}
+		return text, nil
+	default:
+		return "", errNoDirectories
+	}
+}
+
+func checkpointModels(info *collections.FileInfo) []checkpointModel {
+	if info.Checkpoint == nil {
+		return []checkpointModel{}
+	}
+	return []checkpointModel{{ID: checkpointID, LastModified: info.Checkpoint.Created}}
+}
+
+// contentsError is an error as Jupyter servers report them.
+type contentsError struct {
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+}
+
+func writeContentsError(w http.ResponseWriter, status int, e *wscodes.Error) {
+	writeJSON(w, status, contentsError{Message: e.Message, Reason: e.Code})
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"collabserver/collabauth"
+	"collabserver/collections"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestFileModel(t *testing.T) {
+	notebook := `{"cells":[{"cell_type":"code"}],"metadata":{},"nbformat":4,"nbformat_minor":5}`
+	tests := []struct {
+		info        collections.FileInfo
+		wantType    string
+		wantContent string
+	}{
+		{collections.FileInfo{Name: "a.ipynb", Snapshot: collections.FileSnapshot{File: notebook}}, typeNotebook, notebook},
+		{collections.FileInfo{Name: "new.ipynb"}, typeNotebook, string(emptyNotebook)},
+		{collections.FileInfo{Name: "notes.txt", Snapshot: collections.FileSnapshot{File: "hi"}}, typeFile, `"hi"`},
+	}
+	for _, test := range tests {
+		model, err := fileModel(&test.info, true)
+		if err != nil {
+			t.Fatalf("fileModel(%s) gave error %v", test.info.Name, err)
+		}
+		if model.Type != test.wantType {
+			t.Errorf("fileModel(%s) gave type %s but want %s", test.info.Name, model.Type, test.wantType)
+		}
+		content, _ := json.Marshal(model.Content)
+		if string(content) != test.wantContent {
+			t.Errorf("fileModel(%s) gave content %s but want %s", test.info.Name, content, test.wantContent)
+		}
+	}
+
+	bad := collections.FileInfo{Name: "bad.ipynb", Snapshot: collections.FileSnapshot{File: "{"}}
+	if _, err := fileModel(&bad, true); err == nil {
+		t.Errorf("fileModel gave no error for a notebook that isn't JSON")
+	}
+	if model, _ := fileModel(&bad, false); model.Content != nil || model.Format != nil {
+		t.Errorf("fileModel without content gave content %v and format %v", model.Content, model.Format)
+	}
+}
+
+func TestModelsWritable(t *testing.T) {
+	files := []collections.FileInfo{{Name: "a.ipynb", Editable: true}, {Name: "b.ipynb"}}
+	dir := directoryModel(files, []string{collabauth.FileRead, collabauth.FileEdit}, true)
+	if dir.Writable {
+		t.Errorf("directory is writable for a user who can't create files")
+	}
+	content := dir.Content.([]*contentsModel)
+	if !content[0].Writable || content[1].Writable {
+		t.Errorf("files are writable %v and %v but want true and false", content[0].Writable, content[1].Writable)
+	}
+	if dir := directoryModel(files, []string{collabauth.FileCreate}, false); !dir.Writable {
+		t.Errorf("directory isn't writable for a user who can create files")
+	}
+}
+
+func TestStateFromContent(t *testing.T) {
+	state, err := stateFromContent(contentsRequest{Type: typeNotebook, Content: json.RawMessage(` {"cells":[]} `)})
+	if err != nil || state != `{"cells":[]}` {
+		t.Errorf("stateFromContent for a notebook gave %q, %v", state, err)
+	}
+	state, err = stateFromContent(contentsRequest{Type: typeFile, Format: formatText, Content: json.RawMessage(`"text"`)})
+	if err != nil || state != "text" {
+		t.Errorf("stateFromContent for a text file gave %q, %v", state, err)
+	}
+	invalid := []contentsRequest{
+		{Type: typeNotebook, Content: json.RawMessage(`"not a notebook"`)},
+		{Type: typeFile, Format: formatBase64, Content: json.RawMessage(`"aGk="`)},
+		{Type: typeDirectory},
+	}
+	for _, body := range invalid {
+		if _, err := stateFromContent(body); err == nil {
+			t.Errorf("stateFromContent(%+v) gave no error", body)
+		}
+	}
+}
+
+func TestUnusedName(t *testing.T) {
+	files := []collections.FileInfo{{Name: "Untitled.ipynb"}, {Name: "Untitled1.ipynb"}, {Name: "a-Copy1.ipynb"}}
+	if got := unusedName(files, "Untitled", notebookExt, false); got != "Untitled2.ipynb" {
+		t.Errorf("unusedName gave %s but want Untitled2.ipynb", got)
+	}
+	if got := unusedName(files, "untitled", ".txt", false); got != "untitled.txt" {
+		t.Errorf("unusedName gave %s but want untitled.txt", got)
+	}
+	if got := unusedName(files, "a-Copy", notebookExt, true); got != "a-Copy2.ipynb" {
+		t.Errorf("unusedName gave %s but want a-Copy2.ipynb", got)
+	}
+}
+
+func TestUnknownCheckpointIsNotFound(t *testing.T) {
+	router := mux.NewRouter()
+	RegisterContents(router.PathPrefix("/jupyter/{hub}").Subrouter(), nil, func(r *http.Request) string { return "user" })
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/jupyter/ABC/api/contents/a.ipynb/checkpoints/other", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("restoring an unknown checkpoint gave status %d but want %d", recorder.Code, http.StatusNotFound)
+	}
+	body := contentsError{}
+	if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil || body.Message == "" {
+		t.Errorf("restoring an unknown checkpoint gave a body that isn't a Jupyter error: %v", err)
+	}
+}
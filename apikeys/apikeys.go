@@ -0,0 +1,136 @@
+// Package apikeys issues and checks the API keys of service accounts, which are non-human members
+// of a single hub. A key names its hub and account, so it can be looked up without a scan, and only
+// a hash of its secret is stored.
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"collabserver/collections"
+	"collabserver/tokens"
+)
+
+const (
+	// Every key starts with this, which tells keys apart from ID tokens.
+	keyPrefix = "collab_"
+	// Service account user IDs start with this, so they can't collide with those of real users.
+	userIDPrefix = "sa:"
+
+	accountIDBytes = 8
+	secretBytes    = 32
+)
+
+var (
+	errMalformed = errors.New("API key is not well-formed")
+	errInvalid   = errors.New("API key is invalid or revoked")
+)
+
+// Lookup gives the service account with the ID in the hub.
+type Lookup func(hubName, accountID string) (*collections.ServiceAccount, error)
+
+// Verifier is a tokens.Verifier that checks API keys, passing anything that isn't one on to
+// another verifier.
+type Verifier struct {
+	lookup Lookup
+	next   tokens.Verifier
+}
+
+// NewVerifier gives a Verifier that looks accounts up with lookup and verifies other tokens with next.
+func NewVerifier(lookup Lookup, next tokens.Verifier) *Verifier {
+	return &Verifier{lookup: lookup, next: next}
+}
+
+// VerifyIDToken gives the user ID of the service account the key belongs to, or of the user the
+// ID token belongs to if it isn't a key.
+func (v *Verifier) VerifyIDToken(token string) (string, error) {
+	if !IsKey(token) {
+		return v.next.VerifyIDToken(token)
+	}
+	hubName, accountID, secret, err := Parse(token)
+	if err != nil {
+		return "", err
+	}
+	account, err := v.lookup(hubName, accountID)
+	if err != nil || account == nil {
+		return "", errInvalid
+	}
+	if account.Revoked || !Matches(secret, account.KeyHash) {
+		return "", errInvalid
+	}
+	return UserID(hubName, accountID), nil
+}
+
+// IsKey reports whether the token looks like an API key rather than an ID token.
+func IsKey(token string) bool {
+	return strings.HasPrefix(token, keyPrefix)
+}
+
+// NewAccountID gives a random ID for a new service account.
+func NewAccountID() (string, error) {
+	return RandomHex(accountIDBytes)
+}
+
+// New gives a new key for the service account, along with the hash of its secret to store.
+func New(hubName, accountID string) (key, hash string, err error) {
+	secret, err := RandomHex(secretBytes)
+	if err != nil {
+		return "", "", err
+	}
+	return keyPrefix + hubName + "_" + accountID + "_" + secret, Hash(secret), nil
+}
+
+// Parse splits the key into the hub and account it belongs to and its secret. Account IDs and
+// secrets never have underscores, while hub names might.
+func Parse(key string) (hubName, accountID, secret string, err error) {
+	rest := strings.TrimPrefix(key, keyPrefix)
+	i := strings.LastIndex(rest, "_")
+	if i < 0 {
+		return "", "", "", errMalformed
+	}
+	rest, secret = rest[:i], rest[i+1:]
+	i = strings.LastIndex(rest, "_")
+	if i < 0 {
+		return "", "", "", errMalformed
+	}
+	hubName, accountID = rest[:i], rest[i+1:]
+	if hubName == "" || accountID == "" || secret == "" {
+		return "", "", "", errMalformed
+	}
+	return hubName, accountID, secret, nil
+}
+
+// Hash gives the hash of the secret that's stored in place of it.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Matches reports whether the secret has the hash, taking the same time wherever they differ.
+func Matches(secret, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(Hash(secret)), []byte(hash)) == 1
+}
+
+// UserID gives the user ID that the service account acts as; it's what its operations are
+// attributed to and what its role is stored under.
+func UserID(hubName, accountID string) string {
+	return userIDPrefix + hubName + ":" + accountID
+}
+
+// IsServiceAccount reports whether the user ID is that of a service account.
+func IsServiceAccount(userID string) bool {
+	return strings.HasPrefix(userID, userIDPrefix)
+}
+
+// RandomHex gives n random bytes in hex, for the IDs and secrets of credentials.
+func RandomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,72 @@
+package apikeys
+
+import (
+	"errors"
+	"testing"
+
+	"collabserver/collections"
+)
+
+type fakeVerifier struct{}
+
+func (fakeVerifier) VerifyIDToken(idToken string) (string, error) {
+	if idToken == "id-token" {
+		return "user1", nil
+	}
+	return "", errors.New("bad token")
+}
+
+func TestParse(t *testing.T) {
+	key, hash, err := New("my_hub", "abc123")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if !IsKey(key) {
+		t.Errorf("IsKey(%q) is false", key)
+	}
+	hubName, accountID, secret, err := Parse(key)
+	if err != nil {
+		t.Fatalf("Parse(%q) failed: %v", key, err)
+	}
+	if hubName != "my_hub" || accountID != "abc123" {
+		t.Errorf("Parse(%q) gave hub %q and account %q", key, hubName, accountID)
+	}
+	if !Matches(secret, hash) {
+		t.Errorf("secret of a new key doesn't match its hash")
+	}
+	for _, bad := range []string{"collab_", "collab_hub_secret", "collab__id_secret", "collab_hub_id_"} {
+		if _, _, _, err := Parse(bad); err != errMalformed {
+			t.Errorf("Parse(%q) gave error %v but want %v", bad, err, errMalformed)
+		}
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	key, hash, err := New("hub", "acct")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	account := &collections.ServiceAccount{KeyHash: hash}
+	lookup := func(hubName, accountID string) (*collections.ServiceAccount, error) {
+		if hubName != "hub" || accountID != "acct" {
+			return nil, errors.New("not found")
+		}
+		return account, nil
+	}
+	v := NewVerifier(lookup, fakeVerifier{})
+
+	if userID, err := v.VerifyIDToken(key); err != nil || userID != UserID("hub", "acct") {
+		t.Errorf("VerifyIDToken of a valid key gave %q, %v", userID, err)
+	}
+	if userID, err := v.VerifyIDToken("id-token"); err != nil || userID != "user1" {
+		t.Errorf("VerifyIDToken of an ID token gave %q, %v", userID, err)
+	}
+	other, _, _ := New("hub", "acct")
+	if _, err := v.VerifyIDToken(other); err != errInvalid {
+		t.Errorf("VerifyIDToken of a rotated out key gave %v but want %v", err, errInvalid)
+	}
+	account.Revoked = true
+	if _, err := v.VerifyIDToken(key); err != errInvalid {
+		t.Errorf("VerifyIDToken of a revoked key gave %v but want %v", err, errInvalid)
+	}
+}
@@ -0,0 +1,269 @@
+// Package client is a Go client for the collaboration server, for bots and tools that work with
+// hubs without a browser. It speaks the same websocket protocol as the web client, so everything it
+// does is seen live by the hub's other users.
+//
+// A Client makes one request at a time per call, and calls can be made from many goroutines.
+// Broadcasts from the hub, such as other users' file updates, arrive on Broadcasts.
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// The server reads the token from the websocket protocol header, after this prefix.
+	tokenPrefix = "Bearer|"
+
+	// Bounds of the delay between reconnect attempts, which doubles after each failed attempt.
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+
+	// How many broadcasts are kept for the reader of Broadcasts before new ones are dropped.
+	broadcastBuffer = 256
+)
+
+var (
+	// ErrDisconnected is given for requests that were cut off by the connection dropping. The client
+	// reconnects on its own, so they can be tried again.
+	ErrDisconnected = errors.New("client: disconnected from the server")
+	// ErrClosed is given for requests made after Close.
+	ErrClosed = errors.New("client: closed")
+)
+
+// Client is a connection to the server on behalf of a user.
+type Client struct {
+	url    string
+	header http.Header
+
+	// Broadcasts receives the messages from the hub that aren't replies to this client's requests.
+	// If it isn't read from fast enough, broadcasts are dropped once it's full.
+	Broadcasts chan *Message
+
+	// Only one goroutine can write to a websocket connection at a time.
+	writeMu sync.Mutex
+
+	// Guards the fields below it.
+	mu sync.Mutex
+	// The current connection, or nil while reconnecting.
+	conn *websocket.Conn
+	// Requests waiting on their replies, by UID.
+	pending map[string]chan *Message
+	// The hub the client is in, which it joins again after reconnecting.
+	hub              string
+	closed           bool
+	broadcastsClosed bool
+
+	// Used for generating request UIDs.
+	requestCount int64
+}
+
+// Dial connects to the server's websocket at url as the user the ID token belongs to.
+func Dial(ctx context.Context, url, idToken string) (*Client, error) {
+	c := &Client{
+		url:        url,
+		header:     http.Header{"Sec-WebSocket-Protocol": []string{tokenPrefix + idToken}},
+		Broadcasts: make(chan *Message, broadcastBuffer),
+		pending:    map[string]chan *Message{},
+	}
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close disconnects from the server for good; the client stops reconnecting and Broadcasts is closed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	conn := c.conn
+	if conn == nil {
+		// Reconnecting; it stops on its next attempt.
+		c.closeBroadcasts()
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+	c.writeMu.Lock()
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.writeMu.Unlock()
+	return conn.Close()
+}
+
+// connect dials the server, agrees on the protocol and joins the hub the client was in, if any.
+func (c *Client) connect(ctx context.Context) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, c.url, c.header)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	c.conn = conn
+	hub := c.hub
+	c.mu.Unlock()
+	go c.readLoop(conn)
+
+	_, err = c.call(ctx, &Message{Endpoint: EndpointHello, ProtocolVersion: protocolVersion})
+	if err == nil && hub != "" {
+		_, err = c.call(ctx, &Message{Endpoint: EndpointConnectToHub, HubName: hub})
+	}
+	if err != nil {
+		// Take the connection back first so that its readLoop doesn't start reconnecting.
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// readLoop hands the messages read from conn to the requests waiting on them, or to Broadcasts,
+// until the connection drops.
+func (c *Client) readLoop(conn *websocket.Conn) {
+	for {
+		message := &Message{}
+		if err := conn.ReadJSON(message); err != nil {
+			c.disconnected(conn)
+			return
+		}
+		c.mu.Lock()
+		waiting, ok := c.pending[message.ReplyTo]
+		if ok {
+			delete(c.pending, message.ReplyTo)
+		}
+		c.mu.Unlock()
+		if ok {
+			waiting <- message
+			continue
+		}
+		c.broadcast(message)
+	}
+}
+
+// broadcast puts the message on Broadcasts, dropping it if Broadcasts is full or closed.
+func (c *Client) broadcast(message *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broadcastsClosed {
+		return
+	}
+	select {
+	case c.Broadcasts <- message:
+	default:
+	}
+}
+
+// closeBroadcasts closes Broadcasts; c.mu must be held.
+func (c *Client) closeBroadcasts() {
+	if !c.broadcastsClosed {
+		c.broadcastsClosed = true
+		close(c.Broadcasts)
+	}
+}
+
+// disconnected fails the requests waiting on the dropped connection and starts reconnecting,
+// unless the client was closed.
+func (c *Client) disconnected(conn *websocket.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != conn {
+		// A failed connect attempt; reconnect is already retrying.
+		return
+	}
+	c.conn = nil
+	for uid, waiting := range c.pending {
+		close(waiting)
+		delete(c.pending, uid)
+	}
+	if c.closed {
+		c.closeBroadcasts()
+		return
+	}
+	go c.reconnect()
+}
+
+// reconnect tries to connect again until it succeeds or the client is closed.
+func (c *Client) reconnect() {
+	delay := minReconnectDelay
+	for {
+		time.Sleep(delay)
+		err := c.connect(context.Background())
+		if err == nil {
+			c.broadcast(&Message{Endpoint: EndpointReconnected})
+			return
+		}
+		c.mu.Lock()
+		if c.closed {
+			c.closeBroadcasts()
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// call sends the request and waits for the reply to it, giving the failure the reply reports as
+// an error.
+func (c *Client) call(ctx context.Context, request *Message) (*Message, error) {
+	request.UID = "go-" + strconv.FormatInt(atomic.AddInt64(&c.requestCount, 1), 10)
+	waiting := make(chan *Message, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	conn := c.conn
+	if conn == nil {
+		c.mu.Unlock()
+		return nil, ErrDisconnected
+	}
+	c.pending[request.UID] = waiting
+	c.mu.Unlock()
+
+	if err := c.send(conn, request); err != nil {
+		c.forget(request.UID)
+		return nil, err
+	}
+	select {
+	case reply, ok := <-waiting:
+		if !ok {
+			return nil, ErrDisconnected
+		}
+		return reply, reply.err()
+	case <-ctx.Done():
+		c.forget(request.UID)
+		return nil, ctx.Err()
+	}
+}
+
+// send writes a message that has no reply, or whose reply is waited on by call.
+func (c *Client) send(conn *websocket.Conn, message *Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return conn.WriteJSON(message)
+}
+
+func (c *Client) forget(uid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, uid)
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	wscodes "collabserver/websocketcodes"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeServer answers requests with handle, recording the endpoints it was sent.
+type fakeServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	endpoints []string
+	conns     []*websocket.Conn
+}
+
+func newFakeServer(t *testing.T, handle func(conn *websocket.Conn, request *Message)) *fakeServer {
+	fs := &fakeServer{}
+	upgrader := websocket.Upgrader{}
+	fs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Sec-WebSocket-Protocol"); got != "Bearer|token" {
+			t.Errorf("client sent protocol header %q", got)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		fs.mu.Lock()
+		fs.conns = append(fs.conns, conn)
+		fs.mu.Unlock()
+		for {
+			request := &Message{}
+			if err := conn.ReadJSON(request); err != nil {
+				return
+			}
+			fs.mu.Lock()
+			fs.endpoints = append(fs.endpoints, request.Endpoint)
+			fs.mu.Unlock()
+			if request.Endpoint == EndpointHello {
+				conn.WriteJSON(&Message{ReplyTo: request.UID, Status: wscodes.StatusSuccess})
+				continue
+			}
+			handle(conn, request)
+		}
+	}))
+	return fs
+}
+
+func (fs *fakeServer) wsURL() string {
+	return "ws" + strings.TrimPrefix(fs.URL, "http")
+}
+
+func TestSubmitOpsRebases(t *testing.T) {
+	fs := newFakeServer(t, func(conn *websocket.Conn, request *Message) {
+		if request.Index < 5 {
+			// Someone else committed ops 3 and 4 first.
+			conn.WriteJSON(&Message{ReplyTo: request.UID, Status: wscodes.StatusOperationTooOld,
+				Index: 3, Operations: []string{"a", "b"}})
+			return
+		}
+		// A broadcast of someone else's update comes in between.
+		conn.WriteJSON(&Message{Endpoint: EndpointFileUpdate, Status: wscodes.StatusOperationCommitted})
+		conn.WriteJSON(&Message{ReplyTo: request.UID, Status: wscodes.StatusOperationCommitted,
+			Index: request.Index, Operations: request.Operations})
+	})
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, fs.wsURL(), "token")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	var rebasedOnto []string
+	idx, err := c.SubmitOps(ctx, "a.ipynb", 3, []string{"mine"}, func(committed, pending []string) ([]string, error) {
+		rebasedOnto = committed
+		return []string{"mine'"}, nil
+	})
+	if err != nil {
+		t.Fatalf("SubmitOps failed: %v", err)
+	}
+	if idx != 5 {
+		t.Errorf("SubmitOps committed at %d but want 5", idx)
+	}
+	if len(rebasedOnto) != 2 {
+		t.Errorf("SubmitOps rebased onto %v but want [a b]", rebasedOnto)
+	}
+	select {
+	case broadcast := <-c.Broadcasts:
+		if broadcast.Endpoint != EndpointFileUpdate {
+			t.Errorf("got broadcast for endpoint %s", broadcast.Endpoint)
+		}
+	case <-ctx.Done():
+		t.Errorf("broadcast wasn't delivered")
+	}
+}
+
+func TestFailuresAreErrors(t *testing.T) {
+	fs := newFakeServer(t, func(conn *websocket.Conn, request *Message) {
+		conn.WriteJSON(&Message{ReplyTo: request.UID, Status: wscodes.StatusFileDoesntExist,
+			Error: wscodes.NewError(wscodes.StatusFileDoesntExist, "file doesn't exist")})
+	})
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, fs.wsURL(), "token")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+
+	_, err = c.Retrieve(ctx, "missing.ipynb")
+	if e := wscodes.AsError(err); e.Code != wscodes.StatusFileDoesntExist {
+		t.Errorf("Retrieve of a missing file gave error %v", err)
+	}
+}
+
+func TestReconnectRejoinsHub(t *testing.T) {
+	fs := newFakeServer(t, func(conn *websocket.Conn, request *Message) {
+		conn.WriteJSON(&Message{ReplyTo: request.UID, Status: wscodes.StatusSuccess})
+	})
+	defer fs.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, fs.wsURL(), "token")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer c.Close()
+	if err := c.ConnectHub(ctx, "ABCDEF"); err != nil {
+		t.Fatalf("ConnectHub failed: %v", err)
+	}
+
+	fs.mu.Lock()
+	fs.conns[0].Close()
+	fs.mu.Unlock()
+
+	select {
+	case broadcast := <-c.Broadcasts:
+		if broadcast.Endpoint != EndpointReconnected {
+			t.Fatalf("got broadcast for endpoint %s but want %s", broadcast.Endpoint, EndpointReconnected)
+		}
+	case <-ctx.Done():
+		t.Fatalf("client didn't reconnect")
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	want := []string{EndpointHello, EndpointConnectToHub, EndpointHello, EndpointConnectToHub}
+	if strings.Join(fs.endpoints, ",") != strings.Join(want, ",") {
+		t.Errorf("server got requests %v but want %v", fs.endpoints, want)
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"collabserver/collections"
+	wscodes "collabserver/websocketcodes"
+)
+
+// Endpoints of the server that the client makes requests to. Broadcasts have the endpoint of the
+// request that caused them.
+const (
+	EndpointFileUpdate        = "FILE_UPDATE"
+	EndpointFileCreate        = "FILE_CREATE"
+	EndpointFileRename        = "FILE_RENAME"
+	EndpointFileDelete        = "FILE_DELETE"
+	EndpointFileRetrieve      = "FILE_RETRIEVE"
+	EndpointFileSave          = "FILE_SAVE"
+	EndpointModifyUser        = "MODIFY_USER"
+	EndpointListUsers         = "LIST_USERS"
+	EndpointListFiles         = "LIST_FILES"
+	EndpointListHub           = "LIST_HUB"
+	EndpointConnectToHub      = "CONNECT_HUB"
+	EndpointDisconnectFromHub = "DISCONNECT_HUB"
+	EndpointHubCreate         = "HUB_CREATE"
+	EndpointHello             = "HELLO"
+
+	// EndpointReconnected isn't a server endpoint. A message with it is put on Broadcasts after the
+	// client reconnects, since broadcasts sent while it was disconnected are lost.
+	EndpointReconnected = "RECONNECTED"
+)
+
+// Roles that users can have in a hub.
+const (
+	RoleNone   = "NONE"
+	RoleViewer = "VIEWER"
+	// RoleCommenter can read and comment on files.
+	RoleCommenter = "COMMENTER"
+	RoleWriter    = "WRITER"
+	RoleOwner     = "OWNER"
+)
+
+const (
+	userModify = "MODIFY"
+	userRemove = "REMOVE"
+
+	// The protocol version the client speaks; see HELLO in the server.
+	protocolVersion = 2
+)
+
+// Message is a message to or from the server, with the same JSON encoding as the server's.
+type Message struct {
+	UID        string         `json:"uid"`
+	Seq        int64          `json:"seq,omitempty"`
+	ReplyTo    string         `json:"replyTo,omitempty"`
+	Endpoint   string         `json:"endpoint"`
+	Route      []string       `json:"route"`
+	Status     string         `json:"status"`
+	Text       string         `json:"text"`
+	Error      *wscodes.Error `json:"error,omitempty"`
+	RetryAfter int64          `json:"retryAfter,omitempty"`
+	File       string         `json:"file"`
+	Index      int64          `json:"index"`
+	Operations []string       `json:"operations"`
+
+	ModifyUserType string `json:"modifyUserType"`
+	ModifyUserRole string `json:"modifyUserRole"`
+	ModifyUserID   string `json:"modifyUserID"`
+
+	NewFileName string `json:"newFileName"`
+	FileState   string `json:"fileState"`
+
+	UserList []collections.UserInfo `json:"userList"`
+	FileList []collections.FileInfo `json:"fileList"`
+	HubList  []string               `json:"hubList"`
+
+	HubName string `json:"hubName"`
+
+	ProtocolVersion int      `json:"protocolVersion,omitempty"`
+	Features        []string `json:"features,omitempty"`
+}
+
+// err gives the failure the reply reports, or nil if it reports success.
+func (m *Message) err() error {
+	if m.Error != nil {
+		return m.Error
+	}
+	switch m.Status {
+	case wscodes.StatusSuccess, wscodes.StatusOperationCommitted, wscodes.StatusOperationTooOld:
+		return nil
+	}
+	return wscodes.NewError(m.Status, m.Text)
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"context"
+
+	"collabserver/collections"
+	wscodes "collabserver/websocketcodes"
+)
+
+// File is a file's latest snapshot along with the operations committed after it.
+type File struct {
+	Name string
+	// State is the file's snapshot as a JSON parsable string.
+	State string
+	// Index is the index of the latest operation applied to State.
+	Index int64
+	// Operations are the operations committed after the snapshot, in order.
+	Operations []string
+}
+
+// Head gives the index that the next operation committed to the file will take.
+func (f *File) Head() int64 {
+	return f.Index + 1 + int64(len(f.Operations))
+}
+
+// Rebase transforms pending operations, which were made against an older version of a file, so
+// that they apply after the committed operations that other users made in the meantime. How to do
+// this depends on the kind of operations, so callers of SubmitOps provide it.
+type Rebase func(committed, pending []string) ([]string, error)
+
+// ListHubs gives the hubs the user can access. It only works while the client isn't in a hub.
+func (c *Client) ListHubs(ctx context.Context) ([]string, error) {
+	reply, err := c.call(ctx, &Message{Endpoint: EndpointListHub})
+	if err != nil {
+		return nil, err
+	}
+	return reply.HubList, nil
+}
+
+// CreateHub makes a new hub owned by the user and joins it, giving its name.
+func (c *Client) CreateHub(ctx context.Context) (string, error) {
+	reply, err := c.call(ctx, &Message{Endpoint: EndpointHubCreate})
+	if err != nil {
+		return "", err
+	}
+	c.setHub(reply.HubName)
+	return reply.HubName, nil
+}
+
+// ConnectHub joins the hub, which the client then rejoins whenever it reconnects.
+func (c *Client) ConnectHub(ctx context.Context, hubName string) error {
+	_, err := c.call(ctx, &Message{Endpoint: EndpointConnectToHub, HubName: hubName})
+	if err != nil {
+		return err
+	}
+	c.setHub(hubName)
+	return nil
+}
+
+// DisconnectHub leaves the hub the client is in. The server doesn't reply to this.
+func (c *Client) DisconnectHub() error {
+	c.mu.Lock()
+	conn := c.conn
+	c.hub = ""
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrDisconnected
+	}
+	return c.send(conn, &Message{Endpoint: EndpointDisconnectFromHub})
+}
+
+func (c *Client) setHub(hubName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hub = hubName
+}
+
+// ListFiles gives the files of the hub.
+func (c *Client) ListFiles(ctx context.Context) ([]collections.FileInfo, error) {
+	reply, err := c.call(ctx, &Message{Endpoint: EndpointListFiles})
+	if err != nil {
+		return nil, err
+	}
+	return reply.FileList, nil
+}
+
+// CreateFile adds an empty file to the hub.
+func (c *Client) CreateFile(ctx context.Context, fileName string) error {
+	_, err := c.call(ctx, &Message{Endpoint: EndpointFileCreate, File: fileName})
+	return err
+}
+
+// RenameFile renames a file of the hub.
+func (c *Client) RenameFile(ctx context.Context, fileName, newFileName string) error {
+	_, err := c.call(ctx, &Message{Endpoint: EndpointFileRename, File: fileName, NewFileName: newFileName})
+	return err
+}
+
+// DeleteFile deletes a file of the hub.
+func (c *Client) DeleteFile(ctx context.Context, fileName string) error {
+	_, err := c.call(ctx, &Message{Endpoint: EndpointFileDelete, File: fileName})
+	return err
+}
+
+// Retrieve gives the contents of a file of the hub.
+func (c *Client) Retrieve(ctx context.Context, fileName string) (*File, error) {
+	reply, err := c.call(ctx, &Message{Endpoint: EndpointFileRetrieve, File: fileName})
+	if err != nil {
+		return nil, err
+	}
+	return &File{
+		Name:       fileName,
+		State:      reply.FileState,
+		Index:      reply.Index,
+		Operations: reply.Operations,
+	}, nil
+}
+
+// SubmitOps commits the operations to the file, starting at index. If other operations were
+// committed first, rebase transforms ops to apply after them and they're submitted again at the
+// new head. It gives the index the first of the operations was committed at.
+func (c *Client) SubmitOps(ctx context.Context, fileName string, index int64, ops []string, rebase Rebase) (int64, error) {
+	for {
+		reply, err := c.call(ctx, &Message{
+			Endpoint:   EndpointFileUpdate,
+			File:       fileName,
+			Index:      index,
+			Operations: ops,
+		})
+		if err != nil {
+			return 0, err
+		}
+		if reply.Status != wscodes.StatusOperationTooOld {
+			return reply.Index, nil
+		}
+		ops, err = rebase(reply.Operations, ops)
+		if err != nil {
+			return 0, err
+		}
+		index = reply.Index + int64(len(reply.Operations))
+	}
+}
+
+// ListUsers gives the members of the hub.
+func (c *Client) ListUsers(ctx context.Context) ([]collections.UserInfo, error) {
+	reply, err := c.call(ctx, &Message{Endpoint: EndpointListUsers})
+	if err != nil {
+		return nil, err
+	}
+	return reply.UserList, nil
+}
+
+// ModifyUser gives the user with the email the role in the hub, adding them if they aren't a
+// member. A role of RoleNone removes them.
+func (c *Client) ModifyUser(ctx context.Context, email, role string) error {
+	request := &Message{
+		Endpoint:       EndpointModifyUser,
+		ModifyUserType: userModify,
+		ModifyUserID:   email,
+		ModifyUserRole: role,
+	}
+	if role == RoleNone {
+		request.ModifyUserType = userRemove
+	}
+	_, err := c.call(ctx, request)
+	return err
+}
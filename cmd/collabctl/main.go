@@ -0,0 +1,625 @@
+// Command collabctl is an administration tool that works on the datastore directly, for inspecting
+// and repairing hubs without going through the Firestore console. It skips the hubs' authorization
+// checks, so it should only be run by operators.
+//
+// Usage:
+//
+//	collabctl hubs                      list every hub
+//	collabctl members HUB               list a hub's members and their roles
+//	collabctl set-role HUB EMAIL ROLE   give a user a role in a hub (NONE removes them)
+//	collabctl recover-owner HUB EMAIL   make a user the owner of a hub that has no owner left
+//	collabctl files HUB                 list a hub's files with their snapshot and op counts
+//	collabctl oplog HUB FILE            print a file's operations
+//	collabctl snapshot HUB FILE         ask for a file's snapshot to be brought up to date
+//	collabctl restore HUB FILE          undelete a file
+//	collabctl export HUB                write a hub, with its roles and credentials, as JSON to stdout
+//	collabctl import FILE [HUB]         create a hub from an export, under its old name or HUB
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"collabserver/collabauth"
+	"collabserver/collections"
+	"collabserver/hubcodes"
+	"collabserver/remotejob"
+	"collabserver/storage"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// The collections hubs are kept in; these match the hub package's.
+const (
+	hubsID  = "hubs"
+	authID  = "authorization"
+	filesID = "files"
+	opsID   = "operations"
+	rolesID = "roles"
+	auditID = "audit"
+
+	serviceAccountsID = "serviceAccounts"
+	invitesID         = "invites"
+	publicLinksID     = "publicLinks"
+
+	// The actor of the audit entries for changes made with collabctl.
+	auditActor = "collabctl"
+
+	// Firestore rejects batched writes with more than this many operations.
+	maxBatchWrites = 500
+
+	// How long to wait for a snapshot request to be published.
+	publishTimeout = 30 * time.Second
+)
+
+type command struct {
+	args string
+	// The number of arguments taken, not counting optional ones.
+	nargs    int
+	optional int
+	run      func(args []string) error
+}
+
+var commands = map[string]command{
+	"hubs":          {"", 0, 0, listHubs},
+	"members":       {"HUB", 1, 0, listMembers},
+	"set-role":      {"HUB EMAIL ROLE", 3, 0, setRole},
+	"recover-owner": {"HUB EMAIL", 2, 0, recoverOwner},
+	"files":         {"HUB", 1, 0, listFiles},
+	"oplog":         {"HUB FILE", 2, 0, printOpLog},
+	"snapshot":      {"HUB FILE", 2, 0, requestSnapshot},
+	"restore":       {"HUB FILE", 2, 0, restoreFile},
+	"export":        {"HUB", 1, 0, exportHub},
+	"import":        {"FILE [HUB]", 1, 1, importHub},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	args = args[1:]
+	if !ok || len(args) < cmd.nargs || len(args) > cmd.nargs+cmd.optional {
+		usage()
+		os.Exit(2)
+	}
+	err := cmd.run(args)
+	storage.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "collabctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: collabctl COMMAND [ARGS]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, name := range []string{"hubs", "members", "set-role", "recover-owner", "files", "oplog", "snapshot", "restore", "export", "import"} {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].args)
+	}
+}
+
+func listHubs(args []string) error {
+	names, err := storage.DB.HubNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func listMembers(args []string) error {
+	hubRef, err := existingHub(args[0])
+	if err != nil {
+		return err
+	}
+	users, err := storage.DB.AllUsers(hubRef.Collection(authID))
+	if err != nil {
+		return err
+	}
+	w := table(os.Stdout, "EMAIL", "ROLE", "STATUS")
+	for _, user := range users {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", user.Email, user.Role, user.Status)
+	}
+	return w.Flush()
+}
+
+func setRole(args []string) error {
+	hubName, email, role := args[0], args[1], args[2]
+	hubRef, err := existingHub(hubName)
+	if err != nil {
+		return err
+	}
+	if role != collabauth.NoRole && !collabauth.IsBuiltinRole(role) {
+		// Otherwise it has to be one of the hub's custom roles.
+		definition := collections.RoleDefinition{}
+		if err := storage.DB.EntryForRef(hubRef.Collection(rolesID).Doc(role), &definition); err != nil || definition.Deleted {
+			return fmt.Errorf("%s is not a role of hub %s", role, hubName)
+		}
+	}
+	return assignRole(hubRef, hubName, email, role)
+}
+
+// recoverOwner is set-role for owners, but only works on hubs that are left without one, so that it
+// can't be used to take over a hub by mistake.
+func recoverOwner(args []string) error {
+	hubName, email := args[0], args[1]
+	hubRef, err := existingHub(hubName)
+	if err != nil {
+		return err
+	}
+	owners, err := countOwners(hubRef)
+	if err != nil {
+		return err
+	}
+	if owners > 0 {
+		return fmt.Errorf("hub %s still has an owner; they can transfer ownership instead", hubName)
+	}
+	return assignRole(hubRef, hubName, email, collabauth.Owner)
+}
+
+// countOwners gives the number of members of the hub that are owners.
+func countOwners(hubRef *firestore.DocumentRef) (int, error) {
+	users, err := storage.DB.AllAuthEntries(hubRef.Collection(authID))
+	if err != nil {
+		return 0, err
+	}
+	owners := 0
+	for _, user := range users {
+		if user.Role == collabauth.Owner {
+			owners++
+		}
+	}
+	return owners, nil
+}
+
+// assignRole gives the user with the email the role in the hub, adding them to it if they aren't a member.
+func assignRole(hubRef *firestore.DocumentRef, hubName, email, role string) error {
+	userIDs, err := storage.DB.UserIDsForEmails([]string{email})
+	if err != nil {
+		return err
+	}
+	userID, ok := userIDs[email]
+	if !ok {
+		return fmt.Errorf("no user has the email %s", email)
+	}
+	users := hubRef.Collection(authID)
+	current := collections.AuthEntry{Role: collabauth.NoRole}
+	docRef, err := storage.DB.EntryForFieldValue(users, hubcodes.UserIDKey, userID, &current)
+	if err == nil && current.Role == collabauth.Owner && role != collabauth.Owner {
+		// Like in the hub, owners can't be demoted or removed once there are no others.
+		owners, err := countOwners(hubRef)
+		if err != nil {
+			return err
+		}
+		if owners <= 1 {
+			return fmt.Errorf("%s is the last owner of hub %s; make someone else an owner first", email, hubName)
+		}
+	}
+	switch {
+	case err == iterator.Done:
+		_, err = storage.DB.AddEntry(users, "", collections.AuthEntry{
+			UserID: userID,
+			Role:   role,
+			Status: hubcodes.UserOffline,
+		})
+	case err == nil:
+		err = storage.DB.UpdateEntry(docRef, collabauth.Role, role)
+	}
+	if err != nil {
+		return err
+	}
+	action := hubcodes.AuditMemberRoleChanged
+	if current.Role == collabauth.NoRole {
+		action = hubcodes.AuditMemberAdded
+	} else if role == collabauth.NoRole {
+		action = hubcodes.AuditMemberRemoved
+	}
+	audit(hubRef, action, userID, current.Role, role)
+	return storage.DB.UpdateUsersHubList(userID, hubName, role)
+}
+
+// audit records a change made with collabctl in the hub's audit log.
+func audit(hubRef *firestore.DocumentRef, action, target, before, after string) {
+	_, err := storage.DB.AddEntry(hubRef.Collection(auditID), "", collections.AuditEntry{
+		Time:   time.Now(),
+		Actor:  auditActor,
+		Action: action,
+		Target: target,
+		Before: before,
+		After:  after,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "collabctl: recording the change in the audit log failed: %v\n", err)
+	}
+}
+
+func listFiles(args []string) error {
+	hubRef, err := existingHub(args[0])
+	if err != nil {
+		return err
+	}
+	files, err := storage.DB.AllFileEntries(hubRef.Collection(filesID))
+	if err != nil {
+		return err
+	}
+	w := table(os.Stdout, "NAME", "SNAPSHOT", "OPS", "BEHIND", "DELETED")
+	for _, file := range files {
+		ops, err := storage.DB.AllOps(file.Ref.Collection(opsID))
+		if err != nil {
+			return err
+		}
+		// The number of ops not yet applied to the snapshot.
+		behind := len(ops) - (file.Info.Snapshot.Index + 1)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%t\n", file.Info.Name, file.Info.Snapshot.Index, len(ops), behind, file.Info.Deleted)
+	}
+	return w.Flush()
+}
+
+func printOpLog(args []string) error {
+	fileRef, err := existingFile(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	ops, err := storage.DB.AllOps(fileRef.Collection(opsID))
+	if err != nil {
+		return err
+	}
+	w := table(os.Stdout, "INDEX", "USER", "OP")
+	for _, op := range ops {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", op.Index, op.UserID, op.Op)
+	}
+	return w.Flush()
+}
+
+func requestSnapshot(args []string) error {
+	hubName, fileName := args[0], args[1]
+	fileRef, err := existingFile(hubName, fileName)
+	if err != nil {
+		return err
+	}
+	err = storage.DB.UpdateEntry(fileRef, hubcodes.FileUpdateKey, true)
+	if err != nil {
+		return err
+	}
+	remotejob.FileUpdateRequest(hubName, fileName)
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	return remotejob.Wait(ctx)
+}
+
+func restoreFile(args []string) error {
+	hubName, fileName := args[0], args[1]
+	hubRef, err := existingHub(hubName)
+	if err != nil {
+		return err
+	}
+	files, err := storage.DB.AllFileEntries(hubRef.Collection(filesID))
+	if err != nil {
+		return err
+	}
+	var deleted *firestore.DocumentRef
+	for _, file := range files {
+		if file.Info.Name != fileName {
+			continue
+		}
+		if !file.Info.Deleted {
+			return fmt.Errorf("hub %s already has a file named %s", hubName, fileName)
+		}
+		deleted = file.Ref
+	}
+	if deleted == nil {
+		return fmt.Errorf("hub %s has no deleted file named %s", hubName, fileName)
+	}
+	if err := storage.DB.RestoreDocument(deleted); err != nil {
+		return err
+	}
+	audit(hubRef, hubcodes.AuditFileRestored, fileName, "", "")
+	return nil
+}
+
+// hubExport is everything in a hub, in the form written by export and read by import.
+type hubExport struct {
+	Hub             string                       `json:"hub"`
+	Users           []userExport                 `json:"users"`
+	Roles           []collections.RoleDefinition `json:"roles"`
+	ServiceAccounts []serviceAccountExport       `json:"serviceAccounts"`
+	Invites         []inviteExport               `json:"invites"`
+	PublicLinks     []publicLinkExport           `json:"publicLinks"`
+	Files           []fileExport                 `json:"files"`
+}
+
+// The credentials of service accounts, invites and public links are exported with the hashes of
+// their secrets, which they're otherwise never given out with, so that they keep working.
+type serviceAccountExport struct {
+	collections.ServiceAccount
+	KeyHash string `json:"keyHash"`
+}
+
+type inviteExport struct {
+	collections.Invite
+	TokenHash string `json:"tokenHash"`
+}
+
+type publicLinkExport struct {
+	collections.PublicLink
+	TokenHash string `json:"tokenHash"`
+}
+
+// hasCredentials reports whether the export has service accounts, invites or public links, whose
+// keys and tokens name the hub and so only work in a hub of the same name.
+func (export *hubExport) hasCredentials() bool {
+	return len(export.ServiceAccounts) > 0 || len(export.Invites) > 0 || len(export.PublicLinks) > 0
+}
+
+type userExport struct {
+	UserID string `json:"userID"`
+	Role   string `json:"role"`
+}
+
+type fileExport struct {
+	Name     string                     `json:"name"`
+	Deleted  bool                       `json:"deleted"`
+	Snapshot collections.FileSnapshot   `json:"snapshot"`
+	ACL      []collections.FileACLEntry `json:"acl,omitempty"`
+	// ReplacedBefore is kept so that ops on contents replaced before the export stay turned away.
+	ReplacedBefore int64      `json:"replacedBefore,omitempty"`
+	Operations     []opExport `json:"operations"`
+}
+
+type opExport struct {
+	Index  int64  `json:"index"`
+	Op     string `json:"op"`
+	UserID string `json:"userID"`
+}
+
+func exportHub(args []string) error {
+	hubName := args[0]
+	hubRef, err := existingHub(hubName)
+	if err != nil {
+		return err
+	}
+	export := hubExport{
+		Hub:             hubName,
+		Users:           []userExport{},
+		ServiceAccounts: []serviceAccountExport{},
+		Invites:         []inviteExport{},
+		PublicLinks:     []publicLinkExport{},
+		Files:           []fileExport{},
+	}
+	users, err := storage.DB.AllAuthEntries(hubRef.Collection(authID))
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		export.Users = append(export.Users, userExport{UserID: user.UserID, Role: user.Role})
+	}
+	if export.Roles, err = storage.DB.AllRoleDefinitions(hubRef.Collection(rolesID)); err != nil {
+		return err
+	}
+	accounts, err := storage.DB.AllServiceAccounts(hubRef.Collection(serviceAccountsID))
+	if err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		export.ServiceAccounts = append(export.ServiceAccounts, serviceAccountExport{account, account.KeyHash})
+	}
+	invites, err := storage.DB.AllInvites(hubRef.Collection(invitesID))
+	if err != nil {
+		return err
+	}
+	for _, invite := range invites {
+		export.Invites = append(export.Invites, inviteExport{invite, invite.TokenHash})
+	}
+	links, err := storage.DB.AllPublicLinks(hubRef.Collection(publicLinksID))
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		export.PublicLinks = append(export.PublicLinks, publicLinkExport{link, link.TokenHash})
+	}
+	files, err := storage.DB.AllFileEntries(hubRef.Collection(filesID))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		ops, err := storage.DB.AllOps(file.Ref.Collection(opsID))
+		if err != nil {
+			return err
+		}
+		fe := fileExport{
+			Name:           file.Info.Name,
+			Deleted:        file.Info.Deleted,
+			Snapshot:       file.Info.Snapshot,
+			ACL:            file.Info.ACL,
+			ReplacedBefore: file.Info.ReplacedBefore,
+			Operations:     []opExport{},
+		}
+		for _, op := range ops {
+			fe.Operations = append(fe.Operations, opExport{Index: op.Index, Op: op.Op, UserID: op.UserID})
+		}
+		export.Files = append(export.Files, fe)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+func importHub(args []string) error {
+	in, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	export := hubExport{}
+	if err := json.NewDecoder(in).Decode(&export); err != nil {
+		return err
+	}
+	hubName := export.Hub
+	if len(args) > 1 {
+		hubName = args[1]
+	}
+	if hubName != export.Hub && export.hasCredentials() {
+		return fmt.Errorf("hub %s has service accounts, invites or public links, whose keys and tokens name it, "+
+			"so it can only be imported as %s", export.Hub, export.Hub)
+	}
+	hubs := storage.DB.CollectionForID(hubsID, nil)
+	exists, _, err := storage.DB.DocExists(hubName, hubs)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("hub %s already exists", hubName)
+	}
+	// Everything is written under the hub before the hub itself, which it can't be opened without,
+	// so a failed import is never seen and can be cleaned up.
+	hubRef := hubs.Doc(hubName)
+	if err := importContents(hubRef, &export); err != nil {
+		return cleanUpImport(hubRef, hubName, nil, err)
+	}
+	if _, err := storage.DB.AddEntry(hubs, hubName, map[string]interface{}{}); err != nil {
+		return cleanUpImport(hubRef, hubName, nil, err)
+	}
+	for i, user := range export.Users {
+		if err := storage.DB.UpdateUsersHubList(user.UserID, hubName, user.Role); err != nil {
+			return cleanUpImport(hubRef, hubName, export.Users[:i], err)
+		}
+	}
+	fmt.Printf("imported hub %s\n", hubName)
+	return nil
+}
+
+// importContents writes the members, roles, credentials and files of the export under the hub.
+func importContents(hubRef *firestore.DocumentRef, export *hubExport) error {
+	for _, user := range export.Users {
+		_, err := storage.DB.AddEntry(hubRef.Collection(authID), "", collections.AuthEntry{
+			UserID: user.UserID,
+			Role:   user.Role,
+			Status: hubcodes.UserOffline,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, role := range export.Roles {
+		if _, err := storage.DB.AddEntry(hubRef.Collection(rolesID), role.Name, role); err != nil {
+			return err
+		}
+	}
+	for _, account := range export.ServiceAccounts {
+		account.ServiceAccount.KeyHash = account.KeyHash
+		if _, err := storage.DB.AddEntry(hubRef.Collection(serviceAccountsID), account.ID, account.ServiceAccount); err != nil {
+			return err
+		}
+	}
+	for _, invite := range export.Invites {
+		invite.Invite.TokenHash = invite.TokenHash
+		if _, err := storage.DB.AddEntry(hubRef.Collection(invitesID), invite.ID, invite.Invite); err != nil {
+			return err
+		}
+	}
+	for _, link := range export.PublicLinks {
+		link.PublicLink.TokenHash = link.TokenHash
+		if _, err := storage.DB.AddEntry(hubRef.Collection(publicLinksID), link.ID, link.PublicLink); err != nil {
+			return err
+		}
+	}
+	for _, file := range export.Files {
+		fileRef, err := storage.DB.AddEntry(hubRef.Collection(filesID), "", collections.FileInfo{
+			Name:           file.Name,
+			Deleted:        file.Deleted,
+			Snapshot:       file.Snapshot,
+			ACL:            file.ACL,
+			ReplacedBefore: file.ReplacedBefore,
+		})
+		if err != nil {
+			return err
+		}
+		if err := importOps(fileRef.Collection(opsID), file.Operations); err != nil {
+			return fmt.Errorf("importing operations of %s: %v", file.Name, err)
+		}
+	}
+	return nil
+}
+
+// cleanUpImport removes what a failed import wrote, including the hub from the hub lists of the
+// users it was added to, and gives the error the import failed with.
+func cleanUpImport(hubRef *firestore.DocumentRef, hubName string, listed []userExport, importErr error) error {
+	for _, user := range listed {
+		if err := storage.DB.UpdateUsersHubList(user.UserID, hubName, collabauth.NoRole); err != nil {
+			fmt.Fprintf(os.Stderr, "collabctl: removing hub %s from the hubs of user %s failed: %v\n", hubName, user.UserID, err)
+		}
+	}
+	if err := storage.DB.DeleteRecursively(hubRef); err != nil {
+		fmt.Fprintf(os.Stderr, "collabctl: cleaning up the import of hub %s failed: %v\n", hubName, err)
+	}
+	return importErr
+}
+
+// importOps writes the operations in batches, each made of consecutive ops by the same user.
+func importOps(opsCollection *firestore.CollectionRef, ops []opExport) error {
+	for start := 0; start < len(ops); {
+		end := start + 1
+		for end < len(ops) && end-start < maxBatchWrites && ops[end].UserID == ops[start].UserID {
+			end++
+		}
+		batch := []string{}
+		for _, op := range ops[start:end] {
+			batch = append(batch, op.Op)
+		}
+		if err := storage.DB.AppendOps(opsCollection, ops[start].Index, batch, ops[start].UserID); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+func existingHub(hubName string) (*firestore.DocumentRef, error) {
+	exists, hubRef, err := storage.DB.DocExists(hubName, storage.DB.CollectionForID(hubsID, nil))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("hub %s doesn't exist", hubName)
+	}
+	return hubRef, nil
+}
+
+func existingFile(hubName, fileName string) (*firestore.DocumentRef, error) {
+	hubRef, err := existingHub(hubName)
+	if err != nil {
+		return nil, err
+	}
+	fileRef, err := storage.DB.EntryForFieldValue(hubRef.Collection(filesID), hubcodes.FileNameKey, fileName, &collections.FileInfo{})
+	if err == iterator.Done {
+		return nil, fmt.Errorf("hub %s has no file named %s", hubName, fileName)
+	}
+	return fileRef, err
+}
+
+// table gives a writer for printing a table with the column headings.
+func table(out io.Writer, headings ...string) *tabwriter.Writer {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for i, heading := range headings {
+		if i > 0 {
+			fmt.Fprint(w, "\t")
+		}
+		fmt.Fprint(w, heading)
+	}
+	fmt.Fprintln(w)
+	return w
+}
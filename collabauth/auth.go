@@ -1,19 +1,21 @@
 // Package collabauth deals with checking the authorization of actions against the user's role.
+// Roles are sets of permissions; every hub has the built-in roles, and can define its own.
 // Currently depends on a Firestore backend.
 // TODO: remove the dependency on Firebase and instead assume some generic datastore/user collection.
 package collabauth
 
 import (
+	"collabserver/apikeys"
 	log "collabserver/cloudlog"
 	"collabserver/collections"
 	"collabserver/hubcodes"
 	"collabserver/storage"
+	wscodes "collabserver/websocketcodes"
 	"context"
 	"errors"
-	"fmt"
+	"regexp"
 
 	"cloud.google.com/go/firestore"
-	firebase "firebase.google.com/go"
 )
 
 const (
@@ -21,36 +23,47 @@ const (
 	NoRole = "NONE"
 	// Viewer means the user has read access to the hub.
 	Viewer = "VIEWER"
+	// Commenter means the user can read and comment on files.
+	Commenter = "COMMENTER"
 	// Writer means the user has write access to the hub.
 	Writer = "WRITER"
-	// Owner means the user has write access to the hub and can add and remove users.
+	// Owner means the user has every permission in the hub.
 	Owner = "OWNER"
 
-	opRead        = "READ"
-	opWrite       = "WRITE"
-	opChangeUsers = "CHANGEUSERS"
-
 	// Role refers to the key for user role under our Firestore collection.
 	Role = "role"
+	// Permissions refers to the key for the permissions of a custom role.
+	Permissions = "permissions"
+	// Deleted refers to the key marking a custom role as deleted.
+	Deleted = "deleted"
 )
 
 var (
 	errHubNotNew = errors.New("Hub isn't new")
+
+	// Custom role names are used as document IDs, so they're kept to a safe set of characters.
+	roleNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
 )
 
 // Authenticator defines methods for verifying user access levels with an arbitrary backend.
 type Authenticator interface {
-	CanCommit(userID string) (bool, *firestore.DocumentRef)
-	CanCreateDoc(userID string) (bool, *firestore.DocumentRef)
-	CanDeleteDoc(userID string) (bool, *firestore.DocumentRef)
-	CanRead(userID string) (bool, *firestore.DocumentRef)
-	CanChangeUsers(userID string) (bool, *firestore.DocumentRef)
+	// Can reports whether the user has the permission, giving the user's entry if so.
+	Can(userID, permission string) (bool, *firestore.DocumentRef)
+	UserRole(userID string) (string, error)
+	// UserPermissions gives the permissions of the user's role.
+	UserPermissions(userID string) ([]string, error)
+	// RolePermissions gives the permissions of the role, which is built in or defined by the hub.
+	RolePermissions(role string) ([]string, error)
+	// Forget drops anything remembered about the user's role, or about every user and custom role
+	// if userID is empty, for when it's known to have changed.
+	Forget(userID string)
 }
 
 // datastore declares the functions that are used for interacting with Firestore
 type datastore interface {
 	DocExists(docID string, collection *firestore.CollectionRef) (bool, *firestore.DocumentRef, error)
 	EntryForFieldValue(collection *firestore.CollectionRef, fieldPath string, value, dataTo interface{}) (*firestore.DocumentRef, error)
+	EntryForRef(docRef *firestore.DocumentRef, dataTo interface{}) error
 	CollectionIsEmpty(collection *firestore.CollectionRef) bool
 }
 
@@ -58,67 +71,156 @@ type datastore interface {
 // as the authentication reference.
 type firestoreAuthenticator struct {
 	authTable *firestore.CollectionRef
-	db        datastore
+	// The hub's custom roles, keyed by name.
+	rolesTable *firestore.CollectionRef
+	db         datastore
+	// Remembers lookups so that checking every message doesn't read Firestore. Nil remembers nothing.
+	cache *roleCache
 }
 
-func (fa *firestoreAuthenticator) verifyAccess(userID string, op string) (bool, *firestore.DocumentRef) {
+func (fa *firestoreAuthenticator) Can(userID, permission string) (bool, *firestore.DocumentRef) {
 	role, docRef, err := fa.roleForUserID(userID)
 	if err != nil {
 		// TODO(itsazhuhere@): Consider also returning an error.
-		return false, docRef
+		return false, nil
 	}
-	var ok bool
-	switch op {
-	case opRead:
-		ok = role == Viewer || role == Writer || role == Owner
-	case opWrite:
-		ok = role == Writer || role == Owner
-	case opChangeUsers:
-		ok = role == Owner
-	default:
-		fmt.Printf("Unsupported operation: %s", op)
+	permissions, err := fa.permissionsFor(userID, role)
+	if err != nil {
+		log.Printf("Error getting permissions of role %s: %v", role, err)
+		return false, nil
 	}
-	if !ok {
-		docRef = nil
+	if !HasPermission(permissions, permission) {
+		return false, nil
 	}
-	return ok, docRef
+	return true, docRef
 }
 
 func (fa *firestoreAuthenticator) roleForUserID(userID string) (string, *firestore.DocumentRef, error) {
-	docRef, err := fa.db.EntryForFieldValue(fa.authTable, hubcodes.UserIDKey, userID, nil)
+	if cached, ok := fa.cache.user(userID); ok {
+		return cached.role, cached.docRef, cached.err
+	}
+	generation := fa.cache.currentGeneration()
+	role, docRef, err := fa.lookUpRole(userID)
+	if userLookupCacheable(err) {
+		fa.cache.setUser(userID, cachedRole{role: role, docRef: docRef, err: err}, generation)
+	}
+	return role, docRef, err
+}
+
+// lookUpRole reads the user's role from the authorization collection.
+func (fa *firestoreAuthenticator) lookUpRole(userID string) (string, *firestore.DocumentRef, error) {
+	data := &collections.AuthEntry{}
+	docRef, err := fa.db.EntryForFieldValue(fa.authTable, hubcodes.UserIDKey, userID, data)
 	if err != nil {
 		log.Printf("error getting doc from authTable: %s", err.Error())
 		return NoRole, nil, err
 	}
-	data := &collections.AuthEntry{}
-	snapshot, err := docRef.Get(context.Background())
+	return data.Role, docRef, nil
+}
+
+// Forget drops the remembered role of the user, or of every user along with the hub's custom roles
+// if userID is empty, so that the next check reads it again.
+func (fa *firestoreAuthenticator) Forget(userID string) {
+	fa.cache.forgetUser(userID)
+}
+
+// UserRole gives the role of the user, or NoRole along with an error if it can't be found.
+func (fa *firestoreAuthenticator) UserRole(userID string) (string, error) {
+	role, _, err := fa.roleForUserID(userID)
+	return role, err
+}
+
+func (fa *firestoreAuthenticator) UserPermissions(userID string) ([]string, error) {
+	role, _, err := fa.roleForUserID(userID)
 	if err != nil {
-		log.Printf("Error getting snapshot: %s", err.Error())
-		return NoRole, nil, err
+		return nil, err
 	}
-	snapshot.DataTo(data)
-	role := data.Role
-	return role, docRef, nil
+	return fa.permissionsFor(userID, role)
 }
 
-func (fa *firestoreAuthenticator) CanCommit(userID string) (bool, *firestore.DocumentRef) {
-	return fa.verifyAccess(userID, opWrite)
+// permissionsFor gives the permissions the user has with the role. Service accounts don't get the
+// AdminPermissions even if a custom role was given them after they were created.
+func (fa *firestoreAuthenticator) permissionsFor(userID, role string) ([]string, error) {
+	permissions, err := fa.RolePermissions(role)
+	if err != nil || !apikeys.IsServiceAccount(userID) {
+		return permissions, err
+	}
+	return WithoutAdminPermissions(permissions), nil
 }
 
-func (fa *firestoreAuthenticator) CanCreateDoc(userID string) (bool, *firestore.DocumentRef) {
-	return fa.verifyAccess(userID, opWrite)
+// RolePermissions gives the permissions of the role. NoRole has none, and roles that aren't built
+// in or defined by the hub give an error.
+func (fa *firestoreAuthenticator) RolePermissions(role string) ([]string, error) {
+	if role == NoRole {
+		return []string{}, nil
+	}
+	if permissions, ok := builtinRoles[role]; ok {
+		return permissions, nil
+	}
+	definition, err := fa.customRole(role)
+	if err != nil {
+		return nil, err
+	}
+	return definition.Permissions, nil
 }
 
-func (fa *firestoreAuthenticator) CanDeleteDoc(userID string) (bool, *firestore.DocumentRef) {
-	return fa.verifyAccess(userID, opWrite)
+// customRole gives the definition of the hub's custom role.
+func (fa *firestoreAuthenticator) customRole(role string) (*collections.RoleDefinition, error) {
+	if cached, ok := fa.cache.role(role); ok {
+		return cached.definition, cached.err
+	}
+	generation := fa.cache.currentGeneration()
+	definition, err := fa.lookUpCustomRole(role)
+	if err == nil || wscodes.AsError(err).Code == wscodes.StatusRoleDoesntExist {
+		fa.cache.setRole(role, cachedPermissions{definition: definition, err: err}, generation)
+	}
+	return definition, err
 }
 
-func (fa *firestoreAuthenticator) CanRead(userID string) (bool, *firestore.DocumentRef) {
-	return fa.verifyAccess(userID, opRead)
+// lookUpCustomRole reads the definition of the custom role from the roles collection.
+func (fa *firestoreAuthenticator) lookUpCustomRole(role string) (*collections.RoleDefinition, error) {
+	notFound := wscodes.NewError(wscodes.StatusRoleDoesntExist, "role doesn't exist").WithDetail("role", role)
+	if fa.rolesTable == nil || !roleNamePattern.MatchString(role) {
+		return nil, notFound
+	}
+	exists, docRef, err := fa.db.DocExists(role, fa.rolesTable)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, notFound
+	}
+	definition := &collections.RoleDefinition{}
+	if err := fa.db.EntryForRef(docRef, definition); err != nil {
+		return nil, err
+	}
+	if definition.Deleted {
+		return nil, notFound
+	}
+	definition.Name = role
+	definition.Permissions = KnownPermissions(definition.Permissions)
+	return definition, nil
 }
 
-func (fa *firestoreAuthenticator) CanChangeUsers(userID string) (bool, *firestore.DocumentRef) {
-	return fa.verifyAccess(userID, opChangeUsers)
+// CheckRoleDefinition checks that the custom role has a name that isn't taken by a built-in role,
+// and only known permissions. It gives the definition with its permissions in a standard order.
+func CheckRoleDefinition(definition collections.RoleDefinition) (collections.RoleDefinition, error) {
+	if !roleNamePattern.MatchString(definition.Name) {
+		return definition, wscodes.NewError(wscodes.StatusInvalidRequest,
+			"role names can only have letters, digits, - and _").WithDetail("role", definition.Name)
+	}
+	if definition.Name == NoRole || IsBuiltinRole(definition.Name) {
+		return definition, wscodes.NewError(wscodes.StatusInvalidRequest,
+			"built-in roles can't be changed").WithDetail("role", definition.Name)
+	}
+	for _, p := range definition.Permissions {
+		if !IsPermission(p) {
+			return definition, wscodes.NewError(wscodes.StatusInvalidRequest,
+				"unknown permission").WithDetail("permission", p)
+		}
+	}
+	definition.Permissions = normalizePermissions(definition.Permissions)
+	return definition, nil
 }
 
 // AddOwnerToNewHub checks if the collection is empty (indicating a new hub) and adds ownerID as owner.
@@ -134,25 +236,22 @@ func AddOwnerToNewHub(ownerID string, collection *firestore.CollectionRef) error
 	return err
 }
 
-// UserIDFromToken grabs the client from the Firebase App and decodes the idToken.
-func UserIDFromToken(ctx context.Context, app *firebase.App, idToken string) (string, error) {
-	client, err := app.Auth(ctx)
-	if err != nil {
-		return "", err
-	}
-
-	token, err := client.VerifyIDToken(ctx, idToken)
-	if err != nil {
-		return "", err
+// CurrentAuthenticator gives the currently used authenticator for a hub's authorization and
+// custom roles collections. What it looks up is remembered for a short while.
+func CurrentAuthenticator(authTable, rolesTable *firestore.CollectionRef) Authenticator {
+	return &firestoreAuthenticator{
+		authTable:  authTable,
+		rolesTable: rolesTable,
+		db:         storage.DB,
+		cache:      newRoleCache(cacheTTL),
 	}
-
-	return token.UID, nil
 }
 
-// CurrentAuthenticator gives the currently used authenticator.
-func CurrentAuthenticator(authTable *firestore.CollectionRef) Authenticator {
-	return &firestoreAuthenticator{
-		authTable: authTable,
-		db:        storage.DB,
+// Watch has the authenticator listen for changes to its collections until ctx is done, so that a
+// changed role is noticed right away instead of once it expires from the cache. Authenticators
+// that don't cache anything are left alone.
+func Watch(ctx context.Context, a Authenticator) {
+	if fa, ok := a.(*firestoreAuthenticator); ok {
+		fa.watch(ctx)
 	}
 }
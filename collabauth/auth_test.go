@@ -39,63 +39,94 @@ func newAuthenticator(client *firestore.Client) *firestoreAuthenticator {
 		Role:   Viewer,
 	})
 
+	auth.Doc("reviewer").Set(context.Background(), collections.AuthEntry{
+		UserID: "reviewer",
+		Role:   "reviewer",
+	})
+
+	roles := client.Collection("test_roles")
+	roles.Doc("reviewer").Set(context.Background(), collections.RoleDefinition{
+		Permissions: []string{FileRead, FileComment, FileRename},
+	})
+
 	return &firestoreAuthenticator{
-		authTable: auth,
-		db:        storage.DB,
+		authTable:  auth,
+		rolesTable: roles,
+		db:         storage.DB,
 	}
 }
 
-func TestVerifyAccess(t *testing.T) {
+func TestCan(t *testing.T) {
 	client := testutils.NewFirestoreTestClient(context.Background())
 	auth := newAuthenticator(client)
 
 	cases := []struct {
 		name     string
 		userID   string
-		ops      []string
+		perms    []string
 		expected bool
 	}{
 		{
-			name:   "owner can do all",
-			userID: "owner",
-			ops: []string{
-				opChangeUsers,
-				opRead,
-				opWrite,
-			},
+			name:     "owner can do all",
+			userID:   "owner",
+			perms:    AllPermissions,
 			expected: true,
 		},
 		{
 			name:   "writer can write and read",
 			userID: "writer",
-			ops: []string{
-				opRead,
-				opWrite,
+			perms: []string{
+				FileRead,
+				FileEdit,
+				FileCreate,
+				FileDelete,
 			},
 			expected: true,
 		},
 		{
 			name:   "reader can do read",
 			userID: "reader",
-			ops: []string{
-				opRead,
+			perms: []string{
+				FileRead,
 			},
 			expected: true,
 		},
 		{
 			name:   "writer can't change users",
 			userID: "writer",
-			ops: []string{
-				opChangeUsers,
+			perms: []string{
+				MembersInvite,
+				MembersChangeRole,
+				RolesManage,
 			},
 			expected: false,
 		},
 		{
 			name:   "reader can't change users or write",
 			userID: "reader",
-			ops: []string{
-				opChangeUsers,
-				opWrite,
+			perms: []string{
+				MembersChangeRole,
+				FileEdit,
+				FileComment,
+			},
+			expected: false,
+		},
+		{
+			name:   "custom role has its permissions",
+			userID: "reviewer",
+			perms: []string{
+				FileRead,
+				FileComment,
+				FileRename,
+			},
+			expected: true,
+		},
+		{
+			name:   "custom role has no other permissions",
+			userID: "reviewer",
+			perms: []string{
+				FileEdit,
+				FileDelete,
 			},
 			expected: false,
 		},
@@ -103,10 +134,10 @@ func TestVerifyAccess(t *testing.T) {
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			for _, op := range tc.ops {
-				if ok, _ := auth.verifyAccess(tc.userID, op); ok != tc.expected {
-					t.Errorf("verifyAccess gave the wrong access for role %s and operation %s: got %t, want %t",
-						tc.userID, op, ok, tc.expected)
+			for _, perm := range tc.perms {
+				if ok, _ := auth.Can(tc.userID, perm); ok != tc.expected {
+					t.Errorf("Can gave the wrong access for role %s and permission %s: got %t, want %t",
+						tc.userID, perm, ok, tc.expected)
 				}
 			}
 
@@ -0,0 +1,202 @@
+package collabauth
+
+import (
+	log "collabserver/cloudlog"
+	"collabserver/collections"
+	"context"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// How long a user's role or a custom role's permissions are remembered. Changes are normally
+// picked up sooner through Forget and the snapshot listeners, so this only bounds how long a
+// change can go unnoticed if those miss it, e.g. when it's made by another server.
+const cacheTTL = 30 * time.Second
+
+// cachedRole is a user's role as it was looked up, along with the user's entry.
+type cachedRole struct {
+	role    string
+	docRef  *firestore.DocumentRef
+	err     error
+	expires time.Time
+}
+
+// cachedPermissions is a custom role's permissions as they were looked up.
+type cachedPermissions struct {
+	definition *collections.RoleDefinition
+	err        error
+	expires    time.Time
+}
+
+// roleCache remembers the roles of a hub's users and the permissions of its custom roles for up to
+// ttl. A zero ttl remembers nothing.
+type roleCache struct {
+	ttl time.Duration
+	// now gives the current time; it's time.Now unless a test needs otherwise.
+	now func() time.Time
+
+	mu    sync.Mutex
+	users map[string]cachedRole
+	roles map[string]cachedPermissions
+	// Counts what's been forgotten, so that a lookup that started before can't bring it back.
+	generation uint64
+}
+
+func newRoleCache(ttl time.Duration) *roleCache {
+	return &roleCache{ttl: ttl, now: time.Now}
+}
+
+// user gives the remembered role of the user, if it hasn't expired.
+func (c *roleCache) user(userID string) (cachedRole, bool) {
+	if c == nil || c.ttl <= 0 {
+		return cachedRole{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.users[userID]
+	if !ok || !c.now().Before(entry.expires) {
+		return cachedRole{}, false
+	}
+	return entry, true
+}
+
+// currentGeneration gives what setUser and setRole need to tell whether anything was forgotten
+// since a lookup started.
+func (c *roleCache) currentGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// setUser remembers the user's role, as looked up when the cache was at generation.
+func (c *roleCache) setUser(userID string, entry cachedRole, generation uint64) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if c.users == nil {
+		c.users = map[string]cachedRole{}
+	}
+	entry.expires = c.now().Add(c.ttl)
+	c.users[userID] = entry
+}
+
+// role gives the remembered definition of the custom role, if it hasn't expired.
+func (c *roleCache) role(name string) (cachedPermissions, bool) {
+	if c == nil || c.ttl <= 0 {
+		return cachedPermissions{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.roles[name]
+	if !ok || !c.now().Before(entry.expires) {
+		return cachedPermissions{}, false
+	}
+	return entry, true
+}
+
+// setRole remembers the custom role, as looked up when the cache was at generation.
+func (c *roleCache) setRole(name string, entry cachedPermissions, generation uint64) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if c.roles == nil {
+		c.roles = map[string]cachedPermissions{}
+	}
+	entry.expires = c.now().Add(c.ttl)
+	c.roles[name] = entry
+}
+
+// forgetUser drops the user's role, or every user's and custom role if userID is empty.
+func (c *roleCache) forgetUser(userID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if userID == "" {
+		c.users = nil
+		c.roles = nil
+		return
+	}
+	delete(c.users, userID)
+}
+
+// forgetRoles drops every custom role, since a change to one can't be tied to the users who have it.
+func (c *roleCache) forgetRoles() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.roles = nil
+}
+
+// userLookupCacheable reports whether looking up a user's role, which gave err, is worth
+// remembering: it either found the user's entry or found there is none, as opposed to failing in a
+// way that may not happen again.
+func userLookupCacheable(err error) bool {
+	return err == nil || err == iterator.Done
+}
+
+// watch forgets users whose authorization entries change and custom roles that change, until ctx
+// is done. If a listener stops early, entries still expire after the cache's ttl.
+func (fa *firestoreAuthenticator) watch(ctx context.Context) {
+	go watchCollection(ctx, fa.authTable, func() { fa.Forget("") }, func(doc *firestore.DocumentSnapshot) {
+		entry := collections.AuthEntry{}
+		if err := doc.DataTo(&entry); err != nil || entry.UserID == "" {
+			// The entry can't be tied to a user, so no one's role is trusted.
+			fa.Forget("")
+			return
+		}
+		fa.Forget(entry.UserID)
+	})
+	if fa.rolesTable != nil {
+		go watchCollection(ctx, fa.rolesTable, fa.cache.forgetRoles, func(*firestore.DocumentSnapshot) {
+			fa.cache.forgetRoles()
+		})
+	}
+}
+
+// watchCollection calls changed with each document of the collection that's added, modified or
+// removed, until ctx is done. The first snapshot has every document as added, so instead of going
+// through them all, reset is called once for whatever changed before the listener started.
+func watchCollection(ctx context.Context, collection *firestore.CollectionRef, reset func(), changed func(*firestore.DocumentSnapshot)) {
+	snapshots := collection.Snapshots(ctx)
+	defer snapshots.Stop()
+	for first := true; ; first = false {
+		snapshot, err := snapshots.Next()
+		if err != nil {
+			if ctx.Err() == nil && status.Code(err) != codes.Canceled {
+				log.Printf("Stopped watching %s for changes: %v", collection.Path, err)
+			}
+			return
+		}
+		if first {
+			reset()
+			continue
+		}
+		for _, change := range snapshot.Changes {
+			changed(change.Doc)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package collabauth
+
+import (
+	"collabserver/collections"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// countingDatastore serves roles and custom roles from maps, counting how often it's read.
+type countingDatastore struct {
+	roles       map[string]string
+	customRoles map[string][]string
+	reads       int
+}
+
+func (cd *countingDatastore) DocExists(docID string, collection *firestore.CollectionRef) (bool, *firestore.DocumentRef, error) {
+	cd.reads++
+	_, ok := cd.customRoles[docID]
+	return ok, &firestore.DocumentRef{ID: docID}, nil
+}
+
+func (cd *countingDatastore) EntryForFieldValue(collection *firestore.CollectionRef, fieldPath string, value, dataTo interface{}) (*firestore.DocumentRef, error) {
+	cd.reads++
+	userID := value.(string)
+	role, ok := cd.roles[userID]
+	if !ok {
+		return nil, iterator.Done
+	}
+	dataTo.(*collections.AuthEntry).Role = role
+	return &firestore.DocumentRef{ID: userID}, nil
+}
+
+func (cd *countingDatastore) EntryForRef(docRef *firestore.DocumentRef, dataTo interface{}) error {
+	cd.reads++
+	dataTo.(*collections.RoleDefinition).Permissions = cd.customRoles[docRef.ID]
+	return nil
+}
+
+func (cd *countingDatastore) CollectionIsEmpty(collection *firestore.CollectionRef) bool {
+	return false
+}
+
+// newCachedTestAuthenticator gives an authenticator over db whose cache's clock is at *now.
+func newCachedTestAuthenticator(db datastore, now *time.Time) *firestoreAuthenticator {
+	cache := newRoleCache(cacheTTL)
+	cache.now = func() time.Time { return *now }
+	return &firestoreAuthenticator{
+		rolesTable: &firestore.CollectionRef{},
+		db:         db,
+		cache:      cache,
+	}
+}
+
+func TestCacheSavesReads(t *testing.T) {
+	db := &countingDatastore{
+		roles:       map[string]string{"writer": Writer, "reviewer": "reviewer"},
+		customRoles: map[string][]string{"reviewer": {FileRead, FileComment}},
+	}
+	now := time.Now()
+	fa := newCachedTestAuthenticator(db, &now)
+
+	for i := 0; i < 3; i++ {
+		if ok, docRef := fa.Can("writer", FileEdit); !ok || docRef == nil || docRef.ID != "writer" {
+			t.Fatalf("Can(writer, %s) gave %v, %v but want true and the writer's entry", FileEdit, ok, docRef)
+		}
+	}
+	if db.reads != 1 {
+		t.Errorf("checking a writer 3 times read %d times but want 1", db.reads)
+	}
+
+	db.reads = 0
+	for i := 0; i < 3; i++ {
+		if ok, _ := fa.Can("reviewer", FileComment); !ok {
+			t.Fatalf("Can(reviewer, %s) gave false", FileComment)
+		}
+	}
+	// Once for the user, then the custom role's existence and definition.
+	if db.reads != 3 {
+		t.Errorf("checking a user with a custom role 3 times read %d times but want 3", db.reads)
+	}
+
+	db.reads = 0
+	for i := 0; i < 3; i++ {
+		if ok, _ := fa.Can("stranger", FileRead); ok {
+			t.Fatalf("Can(stranger, %s) gave true for a user without an entry", FileRead)
+		}
+	}
+	if db.reads != 1 {
+		t.Errorf("checking a user without an entry 3 times read %d times but want 1", db.reads)
+	}
+}
+
+func TestRevokedUserLosesAccess(t *testing.T) {
+	db := &countingDatastore{roles: map[string]string{"forgotten": Writer, "expired": Writer}}
+	now := time.Now()
+	fa := newCachedTestAuthenticator(db, &now)
+	for userID := range db.roles {
+		if ok, _ := fa.Can(userID, FileRead); !ok {
+			t.Fatalf("Can(%s, %s) gave false before the user was removed", userID, FileRead)
+		}
+	}
+	db.roles["forgotten"] = NoRole
+	delete(db.roles, "expired")
+
+	// A change the hub makes or hears of is seen right away.
+	fa.Forget("forgotten")
+	if ok, _ := fa.Can("forgotten", FileRead); ok {
+		t.Error("a removed user whose role was forgotten can still read the hub")
+	}
+
+	// A change that goes unnoticed is seen once the cached role expires, and not before.
+	now = now.Add(cacheTTL - time.Second)
+	if ok, _ := fa.Can("expired", FileRead); !ok {
+		t.Error("a cached role was looked up again before it expired")
+	}
+	now = now.Add(time.Second)
+	if ok, _ := fa.Can("expired", FileRead); ok {
+		t.Errorf("a removed user can still read the hub %v after the change", cacheTTL)
+	}
+}
+
+func TestForgetEverything(t *testing.T) {
+	db := &countingDatastore{
+		roles:       map[string]string{"reviewer": "reviewer"},
+		customRoles: map[string][]string{"reviewer": {FileRead, FileComment}},
+	}
+	now := time.Now()
+	fa := newCachedTestAuthenticator(db, &now)
+	if ok, _ := fa.Can("reviewer", FileComment); !ok {
+		t.Fatalf("Can(reviewer, %s) gave false before the role changed", FileComment)
+	}
+
+	db.customRoles["reviewer"] = []string{FileRead}
+	fa.Forget("")
+	if ok, _ := fa.Can("reviewer", FileComment); ok {
+		t.Error("a custom role's old permissions were used after everything was forgotten")
+	}
+}
+
+func TestForgetDuringLookup(t *testing.T) {
+	cache := newRoleCache(cacheTTL)
+	generation := cache.currentGeneration()
+	// The role changes while it's being looked up, so what was looked up is already out of date.
+	cache.forgetUser("writer")
+	cache.setUser("writer", cachedRole{role: Writer}, generation)
+	if _, ok := cache.user("writer"); ok {
+		t.Error("a role looked up before it was forgotten was remembered")
+	}
+}
@@ -0,0 +1,148 @@
+package collabauth
+
+import (
+	"collabserver/collections"
+	"sort"
+)
+
+// Permissions are the actions a role can allow. Each hub endpoint checks the one for what it does.
+const (
+	// FileRead allows listing the hub's files and members and reading files.
+	FileRead = "file.read"
+	// FileComment allows commenting on files. It's advisory only: comments are made by clients,
+	// which use it to decide whether to offer them, and the server never checks it.
+	FileComment = "file.comment"
+	// FileEdit allows committing operations to files and replacing their contents.
+	FileEdit   = "file.edit"
+	FileCreate = "file.create"
+	FileDelete = "file.delete"
+	FileRename = "file.rename"
+	// MembersInvite allows adding users to the hub.
+	MembersInvite = "members.invite"
+	// MembersChangeRole allows changing the roles of members, removing them and managing the
+	// hub's service accounts.
+	MembersChangeRole = "members.changeRole"
+	// RolesManage allows defining the hub's custom roles.
+	RolesManage = "roles.manage"
+	// AuditRead allows listing the hub's audit log.
+	AuditRead = "audit.read"
+)
+
+var (
+	// AllPermissions lists every permission, in the order they're shown to users.
+	AllPermissions = []string{
+		FileRead, FileComment, FileEdit, FileCreate, FileDelete, FileRename,
+		MembersInvite, MembersChangeRole, RolesManage, AuditRead,
+	}
+
+	// AdminPermissions are the permissions that manage the hub rather than its files. Service
+	// accounts never have them, so that a leaked key can't be used to take over the hub.
+	AdminPermissions = []string{MembersInvite, MembersChangeRole, RolesManage, AuditRead}
+
+	// builtinRoles gives the permissions of the roles every hub has. Each role can do everything
+	// the one before it can.
+	builtinRoles = map[string][]string{
+		Viewer:    {FileRead},
+		Commenter: {FileRead, FileComment},
+		Writer:    {FileRead, FileComment, FileEdit, FileCreate, FileDelete, FileRename},
+		Owner:     AllPermissions,
+	}
+)
+
+// IsBuiltinRole reports whether the role is one that every hub has. NoRole isn't one.
+func IsBuiltinRole(role string) bool {
+	_, ok := builtinRoles[role]
+	return ok
+}
+
+// BuiltinRolePermissions gives the permissions of the built-in role, or nil if it isn't one.
+func BuiltinRolePermissions(role string) []string {
+	return builtinRoles[role]
+}
+
+// IsPermission reports whether the permission is one of AllPermissions.
+func IsPermission(permission string) bool {
+	for _, p := range AllPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// KnownPermissions gives the permissions that are among AllPermissions. Custom roles stored before a
+// permission was removed may still name it.
+func KnownPermissions(permissions []string) []string {
+	known := []string{}
+	for _, p := range permissions {
+		if IsPermission(p) {
+			known = append(known, p)
+		}
+	}
+	return known
+}
+
+// WithoutAdminPermissions gives the permissions that aren't AdminPermissions.
+func WithoutAdminPermissions(permissions []string) []string {
+	kept := []string{}
+	for _, p := range permissions {
+		if !HasPermission(AdminPermissions, p) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// HasPermission reports whether the permission is among permissions.
+func HasPermission(permissions []string, permission string) bool {
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAllPermissions reports whether every one of wanted is among permissions. Users can only give
+// others roles whose permissions they have themselves.
+func HasAllPermissions(permissions, wanted []string) bool {
+	for _, p := range wanted {
+		if !HasPermission(permissions, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// FileRole gives the role a user with the hub role has for a file with the access list. An entry
+// for the user comes first, then one for their hub role, and otherwise it's their hub role.
+func FileRole(hubRole, userID string, acl []collections.FileACLEntry) string {
+	role := hubRole
+	for _, entry := range acl {
+		if entry.UserID != "" && entry.UserID == userID {
+			return entry.Role
+		}
+		if entry.HubRole != "" && entry.HubRole == hubRole {
+			role = entry.Role
+		}
+	}
+	return role
+}
+
+// normalizePermissions sorts the permissions in the order of AllPermissions and drops duplicates.
+func normalizePermissions(permissions []string) []string {
+	order := map[string]int{}
+	for i, p := range AllPermissions {
+		order[p] = i
+	}
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, p := range permissions {
+		if !seen[p] {
+			seen[p] = true
+			normalized = append(normalized, p)
+		}
+	}
+	sort.Slice(normalized, func(i, j int) bool { return order[normalized[i]] < order[normalized[j]] })
+	return normalized
+}
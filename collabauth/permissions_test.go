@@ -0,0 +1,69 @@
+package collabauth
+
+import (
+	"collabserver/collections"
+	"reflect"
+	"testing"
+)
+
+func TestBuiltinRolesAreNested(t *testing.T) {
+	roles := []string{Viewer, Commenter, Writer, Owner}
+	for i := 1; i < len(roles); i++ {
+		if !HasAllPermissions(builtinRoles[roles[i]], builtinRoles[roles[i-1]]) {
+			t.Errorf("%s doesn't have every permission of %s", roles[i], roles[i-1])
+		}
+	}
+}
+
+func TestCheckRoleDefinition(t *testing.T) {
+	role, err := CheckRoleDefinition(collections.RoleDefinition{
+		Name:        "reviewer",
+		Permissions: []string{FileRename, FileRead, FileRename},
+	})
+	if err != nil {
+		t.Fatalf("CheckRoleDefinition of a valid role failed: %v", err)
+	}
+	if want := []string{FileRead, FileRename}; !reflect.DeepEqual(role.Permissions, want) {
+		t.Errorf("CheckRoleDefinition gave permissions %v but want %v", role.Permissions, want)
+	}
+
+	invalid := []collections.RoleDefinition{
+		{Name: Writer, Permissions: []string{FileRead}},
+		{Name: NoRole},
+		{Name: "a/b", Permissions: []string{FileRead}},
+		{Name: "", Permissions: []string{FileRead}},
+		{Name: "reviewer", Permissions: []string{"file.everything"}},
+	}
+	for _, role := range invalid {
+		if _, err := CheckRoleDefinition(role); err == nil {
+			t.Errorf("CheckRoleDefinition(%+v) succeeded but want an error", role)
+		}
+	}
+}
+
+func TestFileRole(t *testing.T) {
+	acl := []collections.FileACLEntry{
+		{HubRole: Viewer, Role: NoRole},
+		{UserID: "ta", Role: Writer},
+		{HubRole: Writer, Role: Viewer},
+	}
+	tests := []struct {
+		hubRole, userID, want string
+	}{
+		{Viewer, "student", NoRole},
+		{Viewer, "ta", Writer},
+		{Writer, "editor", Viewer},
+		{Owner, "owner", Owner},
+	}
+	for _, test := range tests {
+		if got := FileRole(test.hubRole, test.userID, acl); got != test.want {
+			t.Errorf("FileRole(%s, %s) = %s but want %s", test.hubRole, test.userID, got, test.want)
+		}
+	}
+}
+
+func TestWithoutAdminPermissions(t *testing.T) {
+	if got := WithoutAdminPermissions(BuiltinRolePermissions(Owner)); !reflect.DeepEqual(got, BuiltinRolePermissions(Writer)) {
+		t.Errorf("owner permissions without the admin ones are %v but want the writer's %v", got, BuiltinRolePermissions(Writer))
+	}
+}
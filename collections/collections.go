@@ -2,6 +2,8 @@
 // structures/keys/values, as well as structs that define what is returned to clients.
 package collections
 
+import "time"
+
 // AuthEntry represents an entry in the our Firestore authorization collection.
 type AuthEntry struct {
 	UserID string `firestore:"userID"`
@@ -24,6 +26,8 @@ type UserInfo struct {
 	Email  string `json:"email"`
 	Role   string `json:"role"`
 	Status string `json:"status"`
+	// Anonymous is set for guests who came in through a public link, who have no email.
+	Anonymous bool `json:"anonymous,omitempty"`
 }
 
 // FileInfo contains info on a file within a hub.
@@ -32,6 +36,34 @@ type FileInfo struct {
 	Deleted         bool         `firestore:"deleted"`
 	Snapshot        FileSnapshot `json:"snapshot" firestore:"snapshot"`
 	MarkedForUpdate bool         `json:"needsUpdate" firestore:"snapshotNeedsUpdate"`
+	// LastModified is when the file's contents were last saved as a whole, e.g. through the contents API.
+	LastModified time.Time `json:"lastModified" firestore:"lastModified"`
+	// Checkpoint is a copy of the file's snapshot that it can be restored to, if one was made.
+	Checkpoint *FileCheckpoint `json:"checkpoint,omitempty" firestore:"checkpoint,omitempty"`
+	// ACL overrides the hub roles of some users for this file, e.g. to share it read-only or hide it.
+	ACL []FileACLEntry `json:"acl,omitempty" firestore:"acl,omitempty"`
+	// ReplacedBefore is the index after the file's latest save marker; ops made on top of fewer ops
+	// were made on the contents the save replaced.
+	ReplacedBefore int64 `json:"-" firestore:"replacedBefore,omitempty"`
+	// Editable is whether the user the files were listed for can edit this one, after its access
+	// list. It isn't stored.
+	Editable bool `json:"editable" firestore:"-"`
+}
+
+// FileACLEntry gives the users it matches a role for one file in place of their role in the hub.
+// It matches either a single user or everyone with a hub role.
+type FileACLEntry struct {
+	UserID  string `json:"userID,omitempty" firestore:"userID,omitempty"`
+	HubRole string `json:"hubRole,omitempty" firestore:"hubRole,omitempty"`
+	// Role is the role matched users have for the file; NONE hides the file from them.
+	Role string `json:"role" firestore:"role"`
+}
+
+// FileCheckpoint is a saved copy of a file's snapshot.
+type FileCheckpoint struct {
+	// The snapshot isn't sent to clients, since file lists only need to know that the checkpoint exists.
+	Snapshot FileSnapshot `json:"-" firestore:"snapshot"`
+	Created  time.Time    `json:"created" firestore:"created"`
 }
 
 // FileSnapshot holds a snapshot of a notebook file up to operation Index
@@ -49,3 +81,109 @@ type UserToHubEntry struct {
 	Hub    string `firestore:"hub"`
 	Role   string `firestore:"role"`
 }
+
+// OwnershipTransfer is an owner's offer to make another member of the hub an owner in their place,
+// which that member has to accept.
+type OwnershipTransfer struct {
+	From      string    `json:"from" firestore:"from"`
+	To        string    `json:"to" firestore:"to"`
+	Created   time.Time `json:"created" firestore:"created"`
+	ExpiresAt time.Time `json:"expiresAt" firestore:"expiresAt"`
+}
+
+// PendingInvitation is an invitation to a hub for an email that no user has signed up with yet. The
+// user gets the role once they sign up and connect.
+type PendingInvitation struct {
+	// Email is kept in lower case, since that's how it's looked up.
+	Email     string    `json:"email" firestore:"email"`
+	Hub       string    `json:"hub" firestore:"hub"`
+	Role      string    `json:"role" firestore:"role"`
+	InvitedBy string    `json:"invitedBy" firestore:"invitedBy"`
+	Created   time.Time `json:"created" firestore:"created"`
+}
+
+// ServiceAccount is a non-human member of a hub, such as a bot or a CI job, that authenticates
+// with an API key instead of an ID token. Only a hash of the key is stored.
+type ServiceAccount struct {
+	ID        string    `json:"id" firestore:"-"`
+	Name      string    `json:"name" firestore:"name"`
+	Role      string    `json:"role" firestore:"role"`
+	KeyHash   string    `json:"-" firestore:"keyHash"`
+	Revoked   bool      `json:"revoked" firestore:"revoked"`
+	Created   time.Time `json:"created" firestore:"created"`
+	CreatedBy string    `json:"createdBy" firestore:"createdBy"`
+	// Key is only given right after it's made or rotated, since it isn't stored.
+	Key string `json:"key,omitempty" firestore:"-"`
+}
+
+// RoleDefinition is a role and the permissions it gives. Besides the built-in roles every hub has,
+// owners can define their own, which are stored with the hub.
+type RoleDefinition struct {
+	Name        string   `json:"name" firestore:"-"`
+	Permissions []string `json:"permissions" firestore:"permissions"`
+	// Builtin is set on the roles every hub has, which can't be changed.
+	Builtin bool `json:"builtin" firestore:"-"`
+	Deleted bool `json:"-" firestore:"deleted"`
+}
+
+// Invite lets anyone with its token join a hub with a role, until it expires, is used up or is
+// revoked. Only a hash of the token is stored.
+type Invite struct {
+	ID        string    `json:"id" firestore:"-"`
+	Role      string    `json:"role" firestore:"role"`
+	ExpiresAt time.Time `json:"expiresAt" firestore:"expiresAt"`
+	// MaxUses is how many users can join with the invite; 0 means any number.
+	MaxUses int `json:"maxUses" firestore:"maxUses"`
+	Uses    int `json:"uses" firestore:"uses"`
+	// EmailDomain, if set, only lets users whose emails are at the domain, like example.com, join.
+	EmailDomain string    `json:"emailDomain,omitempty" firestore:"emailDomain"`
+	Revoked     bool      `json:"revoked" firestore:"revoked"`
+	TokenHash   string    `json:"-" firestore:"tokenHash"`
+	Created     time.Time `json:"created" firestore:"created"`
+	CreatedBy   string    `json:"createdBy" firestore:"createdBy"`
+	// Token is only given right after the invite is made, since it isn't stored.
+	Token string `json:"token,omitempty" firestore:"-"`
+}
+
+// PublicLink lets anyone with its token read a hub's files, or one of them, without signing in,
+// until it's revoked. Only a hash of the token is stored.
+type PublicLink struct {
+	ID string `json:"id" firestore:"-"`
+	// File is the only file the link shows, or "" if it shows every file viewers of the hub can read.
+	File      string    `json:"file,omitempty" firestore:"file"`
+	Revoked   bool      `json:"revoked" firestore:"revoked"`
+	TokenHash string    `json:"-" firestore:"tokenHash"`
+	Created   time.Time `json:"created" firestore:"created"`
+	CreatedBy string    `json:"createdBy" firestore:"createdBy"`
+	// Token is only given right after the link is made, since it isn't stored.
+	Token string `json:"token,omitempty" firestore:"-"`
+}
+
+// AuditEntry records a security-relevant event in a hub: who did what to whom or which file, and
+// what changed. Entries are only ever added, never changed.
+type AuditEntry struct {
+	ID   string    `json:"id" firestore:"-"`
+	Time time.Time `json:"time" firestore:"time"`
+	// Actor is the user ID of whoever caused the event.
+	Actor  string `json:"actor" firestore:"actor"`
+	Action string `json:"action" firestore:"action"`
+	// Target is the user ID, email, file or role the event was about, if any.
+	Target string `json:"target,omitempty" firestore:"target"`
+	Before string `json:"before,omitempty" firestore:"before"`
+	After  string `json:"after,omitempty" firestore:"after"`
+	// Details has anything else worth knowing about the event.
+	Details map[string]string `json:"details,omitempty" firestore:"details,omitempty"`
+}
+
+// AuditQuery says which audit entries to list, newest first. Empty fields don't filter.
+type AuditQuery struct {
+	Actor  string    `json:"actor,omitempty"`
+	Action string    `json:"action,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+	Until  time.Time `json:"until,omitempty"`
+	// Limit is the most entries to give at once.
+	Limit int `json:"limit,omitempty"`
+	// PageToken continues listing after the page it was given with.
+	PageToken string `json:"pageToken,omitempty"`
+}
@@ -0,0 +1,270 @@
+// Package config holds the server's tunable settings. Defaults are given by Default, and can be
+// overridden by a JSON file whose path is given in the COLLAB_CONFIG environment variable.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+
+	log "collabserver/cloudlog"
+)
+
+const (
+	// pathEnv is the environment variable holding the path of the JSON config file.
+	pathEnv = "COLLAB_CONFIG"
+	// environmentEnv is the environment variable naming the environment the server runs in, such
+	// as "dev" or "prod", which picks the settings that differ between them.
+	environmentEnv = "COLLAB_ENV"
+
+	// AnyOrigin allows websocket connections from every origin.
+	AnyOrigin = "*"
+
+	// AnyRole and AnyEndpoint are the keys of rate limit rules that apply when there's no
+	// rule for the specific role or endpoint.
+	AnyRole     = "*"
+	AnyEndpoint = "*"
+
+	// Firestore rejects batched writes with more than this many operations.
+	maxBatchWrites = 500
+
+	// The ways ID tokens can be verified: as Firebase ID tokens, as JWTs signed by a key in a JWKS,
+	// or as JWTs signed with a shared secret.
+	VerifierFirebase = "firebase"
+	VerifierJWKS     = "jwks"
+	VerifierHMAC     = "hmac"
+)
+
+var (
+	// Current is the config the server is running with.
+	Current *Config
+	// Environment is the environment the server runs in, or "" if it isn't set.
+	Environment = os.Getenv(environmentEnv)
+)
+
+func init() {
+	var err error
+	Current, err = Load(os.Getenv(pathEnv))
+	if err != nil {
+		log.Fatalf("loading config failed: %+v", err)
+	}
+}
+
+// Config is the root of the server's settings.
+type Config struct {
+	RateLimits  RateLimits  `json:"rateLimits"`
+	Limits      Limits      `json:"limits"`
+	Compression Compression `json:"compression"`
+	Auth        Auth        `json:"auth"`
+	Origins     Origins     `json:"origins"`
+	Debug       Debug       `json:"debug"`
+}
+
+// Debug configures the internal listener serving the server's metrics and memory stats. It's kept
+// off the public port since none of what it serves is meant for clients.
+type Debug struct {
+	// Address is where /debug/vars is served, which should only be reachable from inside the
+	// deployment. An empty address turns the listener off.
+	Address string `json:"address"`
+}
+
+// Origins configures which web pages can open websocket connections. Connections that don't send
+// an Origin header, which browsers always do, aren't from web pages and are always allowed, as
+// are connections from pages served by this server. No other origins are allowed by default; the
+// Docker image runs with config/collab.json, which allows JupyterLab served locally on its default
+// port, and deployments whose clients are served from elsewhere need to add their origins there.
+type Origins struct {
+	// Allowed are the other origins that can connect, like "https://app.example.com". A host of
+	// "*.example.com" allows every subdomain of example.com, but not example.com itself, and
+	// AnyOrigin allows every origin.
+	Allowed []string `json:"allowed"`
+	// Environments replace Allowed with their own list when the server runs in them, so that one
+	// config file can hold the origins of each environment.
+	Environments map[string][]string `json:"environments"`
+}
+
+// AllowedIn gives the origins allowed in the environment.
+func (o Origins) AllowedIn(environment string) []string {
+	if allowed, ok := o.Environments[environment]; ok {
+		return allowed
+	}
+	return o.Allowed
+}
+
+// Auth configures how the ID tokens that clients send are verified.
+type Auth struct {
+	// Verifier is VerifierFirebase, VerifierJWKS or VerifierHMAC.
+	Verifier string `json:"verifier"`
+	// JWKS is the path or http(s) URL of the JSON Web Key Set that VerifierJWKS checks RS256 and
+	// ES256 signatures against. Key sets from URLs are fetched again every JWKSRefreshSeconds, and
+	// when a token names a key that isn't in the set.
+	JWKS               string `json:"jwks"`
+	JWKSRefreshSeconds int    `json:"jwksRefreshSeconds"`
+	// HMACSecret is the shared secret that VerifierHMAC checks HS256 signatures against.
+	HMACSecret string `json:"hmacSecret"`
+	// If set, the iss and aud claims of JWTs must match them.
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// UserIDClaim is the claim of JWTs that holds the user's ID.
+	UserIDClaim string `json:"userIDClaim"`
+}
+
+// Compression configures permessage-deflate compression of websocket frames sent to clients.
+type Compression struct {
+	Enabled bool `json:"enabled"`
+	// Level is the flate compression level, from 1 (fastest) to 9 (smallest).
+	Level int `json:"level"`
+	// Frames smaller than ThresholdBytes are sent uncompressed, since compressing them saves little.
+	ThresholdBytes int `json:"thresholdBytes"`
+}
+
+// Limits configures the maximum sizes of incoming messages.
+type Limits struct {
+	// MaxFrameBytes is the largest websocket frame read from a client.
+	MaxFrameBytes int64 `json:"maxFrameBytes"`
+	// MaxOpsPerMessage is the most operations a single message can hold. Operations of a message are
+	// committed in one Firestore batch, so it can't be more than maxBatchWrites.
+	MaxOpsPerMessage int `json:"maxOpsPerMessage"`
+	// MaxOpBytes is the largest single operation.
+	MaxOpBytes int `json:"maxOpBytes"`
+	// MaxFileStateBytes is the largest file state a client can send.
+	MaxFileStateBytes int `json:"maxFileStateBytes"`
+}
+
+// RateLimits configures the token buckets that limit how fast messages are handled.
+type RateLimits struct {
+	// Client rules apply to each client on its own, keyed by endpoint and then by the client's
+	// role in its current hub (clients that aren't in a hub have no role).
+	Client map[string]map[string]Rate `json:"client"`
+	// Hub rules apply to all messages of an endpoint in a hub, regardless of the sender.
+	Hub map[string]Rate `json:"hub"`
+	// A client that is rate limited MaxViolations times within ViolationWindowSeconds is disconnected.
+	MaxViolations          int `json:"maxViolations"`
+	ViolationWindowSeconds int `json:"violationWindowSeconds"`
+}
+
+// Rate is a token bucket that refills at PerSecond tokens a second and holds at most Burst tokens.
+// A zero PerSecond means no limit.
+type Rate struct {
+	PerSecond float64 `json:"perSecond"`
+	Burst     int     `json:"burst"`
+}
+
+// Default gives the settings used for anything the config file doesn't set.
+func Default() *Config {
+	return &Config{
+		RateLimits: RateLimits{
+			Client: map[string]map[string]Rate{
+				AnyEndpoint:   {AnyRole: {PerSecond: 10, Burst: 20}},
+				"FILE_UPDATE": {AnyRole: {PerSecond: 20, Burst: 40}},
+				"MODIFY_USER": {AnyRole: {PerSecond: 1, Burst: 5}},
+				"LIST_USERS":  {AnyRole: {PerSecond: 2, Burst: 10}},
+				"LIST_FILES":  {AnyRole: {PerSecond: 2, Burst: 10}},
+				"LIST_HUB":    {AnyRole: {PerSecond: 2, Burst: 10}},
+			},
+			Hub: map[string]Rate{
+				"FILE_UPDATE": {PerSecond: 200, Burst: 400},
+				"MODIFY_USER": {PerSecond: 5, Burst: 20},
+			},
+			MaxViolations:          50,
+			ViolationWindowSeconds: 60,
+		},
+		Limits: Limits{
+			MaxFrameBytes:    4 << 20,
+			MaxOpsPerMessage: maxBatchWrites,
+			// Operations and file states are stored in Firestore documents, which can be at most 1 MiB.
+			MaxOpBytes:        512 << 10,
+			MaxFileStateBytes: 1000 << 10,
+		},
+		Compression: Compression{
+			Enabled:        true,
+			Level:          1,
+			ThresholdBytes: 1024,
+		},
+		Auth: Auth{
+			Verifier:           VerifierFirebase,
+			JWKSRefreshSeconds: 3600,
+			UserIDClaim:        "sub",
+		},
+		Debug: Debug{
+			Address: "localhost:8090",
+		},
+	}
+}
+
+// Load reads the config file at path on top of the defaults. An empty path gives the defaults.
+func Load(path string) (*Config, error) {
+	config := Default()
+	if path == "" {
+		return config, nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(contents, config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Limits.MaxOpsPerMessage > maxBatchWrites {
+		return nil, fmt.Errorf("limits.maxOpsPerMessage can be at most %d", maxBatchWrites)
+	}
+	for environment, allowed := range config.Origins.Environments {
+		if err := checkOrigins(allowed); err != nil {
+			return nil, fmt.Errorf("origins.environments.%s: %v", environment, err)
+		}
+	}
+	if err := checkOrigins(config.Origins.Allowed); err != nil {
+		return nil, fmt.Errorf("origins.allowed: %v", err)
+	}
+	switch config.Auth.Verifier {
+	case VerifierFirebase:
+	case VerifierJWKS:
+		if config.Auth.JWKS == "" {
+			return nil, fmt.Errorf("auth.jwks is needed for the %s verifier", VerifierJWKS)
+		}
+	case VerifierHMAC:
+		if config.Auth.HMACSecret == "" {
+			return nil, fmt.Errorf("auth.hmacSecret is needed for the %s verifier", VerifierHMAC)
+		}
+	default:
+		return nil, fmt.Errorf("auth.verifier %q is not one of %s, %s or %s",
+			config.Auth.Verifier, VerifierFirebase, VerifierJWKS, VerifierHMAC)
+	}
+	return config, nil
+}
+
+// checkOrigins checks that the allowed origins are AnyOrigin or have a scheme and a host.
+func checkOrigins(allowed []string) error {
+	for _, origin := range allowed {
+		if origin == AnyOrigin {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("%q is not an origin like https://example.com", origin)
+		}
+	}
+	return nil
+}
+
+// ClientRate gives the rate a client with the given role can send messages to endpoint at,
+// falling back to the AnyRole and AnyEndpoint rules. It also gives the endpoint key of the rule used,
+// so that endpoints without their own rule can share a bucket.
+func (rl RateLimits) ClientRate(endpoint, role string) (string, Rate) {
+	for _, e := range []string{endpoint, AnyEndpoint} {
+		rules, ok := rl.Client[e]
+		if !ok {
+			continue
+		}
+		if rate, ok := rules[role]; ok {
+			return e, rate
+		}
+		if rate, ok := rules[AnyRole]; ok {
+			return e, rate
+		}
+	}
+	return AnyEndpoint, Rate{}
+}
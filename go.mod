@@ -6,7 +6,9 @@ require (
 	cloud.google.com/go v0.76.0 // indirect
 	cloud.google.com/go/firestore v1.4.0
 	cloud.google.com/go/logging v1.2.0
+	cloud.google.com/go/pubsub v1.3.1
 	firebase.google.com/go v3.13.0+incompatible
+	github.com/fxamacker/cbor/v2 v2.4.0
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
 	go.opencensus.io v0.22.6 // indirect
@@ -14,5 +16,4 @@ require (
 	google.golang.org/api v0.39.0
 	google.golang.org/genproto v0.0.0-20210207032614-bba0dbe2a9ea // indirect
 	google.golang.org/grpc v1.35.0
-	cloud.google.com/go/pubsub v1.3.1
 )
@@ -0,0 +1,76 @@
+package hub
+
+import (
+	log "collabserver/cloudlog"
+)
+
+const (
+	// featureAcks is the HELLO feature for clients that acknowledge the messages they've processed
+	// by sending ACK with the sequence number of the latest one.
+	featureAcks = "acks"
+
+	// The most unacknowledged broadcasts remembered per client; older ones are forgotten.
+	maxUnackedBroadcasts = 1024
+)
+
+// sequence gives a copy of the message numbered with the client's next sequence number, since the
+// same message can be sent to many clients. It is only called from writePump.
+func (c *Client) sequence(message *Message) *Message {
+	c.seq++
+	numbered := *message
+	numbered.Seq = c.seq
+	if c.hasFeature(featureAcks) && !isReply(message) {
+		c.mu.Lock()
+		c.unacked = append(c.unacked, c.seq)
+		if len(c.unacked) > maxUnackedBroadcasts {
+			c.unacked = c.unacked[len(c.unacked)-maxUnackedBroadcasts:]
+		}
+		c.mu.Unlock()
+	}
+	return &numbered
+}
+
+// handleAck records that the client has processed every message up to and including message.Seq.
+func (c *Client) handleAck(message *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := 0
+	for i < len(c.unacked) && c.unacked[i] <= message.Seq {
+		i++
+	}
+	c.unacked = c.unacked[i:]
+}
+
+// unackedBroadcasts gives the sequence numbers of the broadcasts sent to the client that it hasn't
+// acknowledged, if it uses acks.
+func (c *Client) unackedBroadcasts() []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int64{}, c.unacked...)
+}
+
+// logUnacked notes the broadcasts a client leaves without having processed, which means its view
+// of the hub was out of date by that much.
+func (c *Client) logUnacked(hubName string) {
+	if unacked := c.unackedBroadcasts(); len(unacked) > 0 {
+		log.Printf("user %s left hub %s with %d unacknowledged broadcasts (from seq %d)",
+			c.userID, hubName, len(unacked), unacked[0])
+	}
+}
+
+// isReply reports whether the message is a reply to one of its receiver's requests rather
+// than a broadcast.
+func isReply(message *Message) bool {
+	return message.ReplyTo != "" || (len(message.Route) > 0 && message.Route[0] == routeOrigin)
+}
+
+// asReplyTo gives the message marked as a reply to request. Messages can be shared between
+// clients, so it works on a copy.
+func asReplyTo(message *Message, request *Message) *Message {
+	if request == nil || request.UID == "" {
+		return message
+	}
+	reply := *message
+	reply.ReplyTo = request.UID
+	return &reply
+}
@@ -0,0 +1,46 @@
+package hub
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSequenceAndAck(t *testing.T) {
+	client := &Client{features: map[string]bool{featureAcks: true}}
+	broadcast := &Message{Endpoint: endpointListUsers, Route: []string{routeBroadcast}}
+	reply := &Message{Endpoint: endpointListFiles, Route: []string{routeOrigin}}
+
+	var seqs []int64
+	for _, message := range []*Message{broadcast, reply, broadcast, broadcast} {
+		seqs = append(seqs, client.sequence(message).Seq)
+	}
+	if want := []int64{1, 2, 3, 4}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("sequence numbered messages %v but want %v", seqs, want)
+	}
+	if broadcast.Seq != 0 {
+		t.Error("sequence changed the shared message")
+	}
+	if want := []int64{1, 3, 4}; !reflect.DeepEqual(client.unackedBroadcasts(), want) {
+		t.Errorf("unacked broadcasts are %v but want %v", client.unackedBroadcasts(), want)
+	}
+
+	client.handleAck(&Message{Endpoint: endpointAck, Seq: 3})
+	if want := []int64{4}; !reflect.DeepEqual(client.unackedBroadcasts(), want) {
+		t.Errorf("unacked broadcasts after ACK are %v but want %v", client.unackedBroadcasts(), want)
+	}
+}
+
+func TestHandleSendMessageMarksReplies(t *testing.T) {
+	origin := &Client{send: make(chan *Message, 1)}
+	other := &Client{send: make(chan *Message, 1)}
+	h := &Hub{clients: map[*Client]bool{origin: true, other: true}}
+	request := &Message{UID: "7", client: origin}
+
+	h.handleSendMessage(&Message{UID: "7", Route: []string{routeBroadcast}}, request)
+	if got := (<-origin.send).ReplyTo; got != "7" {
+		t.Errorf("origin got a broadcast replying to %q but want %q", got, "7")
+	}
+	if got := (<-other.send).ReplyTo; got != "" {
+		t.Errorf("other client got a broadcast replying to %q but want no reply", got)
+	}
+}
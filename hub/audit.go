@@ -0,0 +1,74 @@
+package hub
+
+import (
+	log "collabserver/cloudlog"
+	"collabserver/collabauth"
+	"collabserver/collections"
+	"collabserver/hubcodes"
+	wscodes "collabserver/websocketcodes"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+const (
+	// How many audit entries are listed at once, unless asked for fewer.
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 200
+)
+
+// recordAudit adds the entry to the audit log of the hub at hubRef, stamping it with the time. A
+// failure is logged rather than failing what was audited, which has already happened.
+func recordAudit(db datastore, hubRef *firestore.DocumentRef, entry collections.AuditEntry) {
+	entry.Time = time.Now()
+	if _, err := db.AddEntry(hubRef.Collection(auditID), "", entry); err != nil {
+		log.Printf("Error recording %s by %s in the audit log of hub %s: %v", entry.Action, entry.Actor, hubRef.ID, err)
+	}
+}
+
+// recordAudit adds an entry to the hub's audit log.
+func (h *Hub) recordAudit(actor, action, target, before, after string) {
+	recordAudit(h.db, h.ref, collections.AuditEntry{
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Before: before,
+		After:  after,
+	})
+}
+
+// memberAuditAction gives the audit action for a member's role changing from before to after.
+func memberAuditAction(before, after string) string {
+	switch {
+	case before == "" || before == collabauth.NoRole:
+		return hubcodes.AuditMemberAdded
+	case after == collabauth.NoRole:
+		return hubcodes.AuditMemberRemoved
+	default:
+		return hubcodes.AuditMemberRoleChanged
+	}
+}
+
+// handleListAudit lists a page of the hub's audit log, which needs the AuditRead permission.
+func (h *Hub) handleListAudit(message *Message) *Message {
+	if ok, _ := h.auth.Can(message.client.userID, collabauth.AuditRead); !ok {
+		return toOriginWithError(message, errUnauthorized)
+	}
+	query := collections.AuditQuery{}
+	if message.AuditQuery != nil {
+		query = *message.AuditQuery
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultAuditPageSize
+	} else if query.Limit > maxAuditPageSize {
+		query.Limit = maxAuditPageSize
+	}
+	entries, next, err := h.db.AuditEntries(h.audit, query)
+	if err != nil {
+		return toOriginWithError(message, err)
+	}
+	returnMessage := toOriginWithStatus(message, wscodes.StatusSuccess, "")
+	returnMessage.AuditEntries = entries
+	returnMessage.NextPageToken = next
+	return returnMessage
+}
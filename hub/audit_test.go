@@ -0,0 +1,51 @@
+package hub
+
+import (
+	"collabserver/collabauth"
+	"collabserver/collections"
+	"collabserver/hubcodes"
+	wscodes "collabserver/websocketcodes"
+	"testing"
+)
+
+func TestMemberAuditAction(t *testing.T) {
+	tests := []struct {
+		before, after, want string
+	}{
+		{collabauth.NoRole, collabauth.Viewer, hubcodes.AuditMemberAdded},
+		{"", collabauth.Writer, hubcodes.AuditMemberAdded},
+		{collabauth.Writer, collabauth.Viewer, hubcodes.AuditMemberRoleChanged},
+		{collabauth.Writer, collabauth.NoRole, hubcodes.AuditMemberRemoved},
+	}
+	for _, test := range tests {
+		if got := memberAuditAction(test.before, test.after); got != test.want {
+			t.Errorf("memberAuditAction(%q, %q) = %s but want %s", test.before, test.after, got, test.want)
+		}
+	}
+}
+
+func TestListAudit(t *testing.T) {
+	db := &fakeDatastore{}
+	h := &Hub{
+		db: db,
+		auth: &fakeAuthenticator{roles: map[string]string{
+			"owner":  collabauth.Owner,
+			"writer": collabauth.Writer,
+		}},
+	}
+	listAudit := func(userID string, query *collections.AuditQuery) *Message {
+		return h.handleListAudit(&Message{Endpoint: endpointListAudit, AuditQuery: query, client: &Client{userID: userID}})
+	}
+
+	if reply := listAudit("writer", nil); reply.Error == nil || reply.Error.Code != wscodes.StatusEndpointUnauthorized {
+		t.Errorf("a writer listing the audit log got %+v but want %s", reply, wscodes.StatusEndpointUnauthorized)
+	}
+	if reply := listAudit("owner", nil); reply.Error != nil || db.auditQuery.Limit != defaultAuditPageSize {
+		t.Errorf("listing the audit log without a limit gave %v and a limit of %d but want %d",
+			reply.Error, db.auditQuery.Limit, defaultAuditPageSize)
+	}
+	listAudit("owner", &collections.AuditQuery{Action: hubcodes.AuditFileDeleted, Limit: 10 * maxAuditPageSize})
+	if db.auditQuery.Limit != maxAuditPageSize || db.auditQuery.Action != hubcodes.AuditFileDeleted {
+		t.Errorf("listing the audit log queried %+v but want a limit of %d and the action kept", db.auditQuery, maxAuditPageSize)
+	}
+}
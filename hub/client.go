@@ -2,9 +2,16 @@ package hub
 
 import (
 	log "collabserver/cloudlog"
+	"collabserver/config"
+	"collabserver/metrics"
+	"collabserver/ratelimit"
+	wscodes "collabserver/websocketcodes"
 	"errors"
 	"fmt"
-
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,26 +27,33 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 9223372036854775807
+	// Frames are read up to this many times the configured maximum frame size so that a frame that's
+	// too large can still be answered with a status; anything larger than that closes the connection.
+	readLimitFactor = 2
 )
 
 var (
-	errNoHub         = errors.New("client is not connected to a hub")
 	errNoBackendChan = errors.New("client does not have a backend channel assigned")
+	errFrameTooLarge = errors.New("websocket frame is larger than the maximum message size")
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
+// upgrader is shared by all websocket connections, so it's only built once.
+var upgrader = newUpgrader(config.Current, config.Environment)
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	userID string
 
-	// Send self through this channel to disconnect from the hub.
-	unregister chan *Client
+	// Set for guests, who connected with a public link rather than as a user. They can only read
+	// the link's hub, and only the file it's for if it's for one.
+	guest *guestPass
+
+	// Set for the clients of sessions, which make requests for REST and Jupyter callers rather than
+	// for a connection of their own.
+	session bool
+
+	// The hub sends the client back through this chan when it leaves, set when it's handed to one.
+	returnTo chan *Client
 
 	// The channel to send messages from the client to.
 	toBackend chan *Message
@@ -56,6 +70,35 @@ type Client struct {
 	stopCh chan struct{}
 
 	closed bool
+
+	// Guards the fields below it, which are shared between the pumps and the hub.
+	mu sync.Mutex
+
+	// The client's role in the hub it's connected to, if any.
+	role string
+
+	// The protocol version agreed on with HELLO, and the features enabled for the connection.
+	protocol int
+	features map[string]bool
+
+	// Whether the client agreed to permessage-deflate compression when connecting.
+	compress bool
+
+	// Whether the client's transport only carries text, so binary encodings can't be enabled.
+	textOnly bool
+
+	// Sequence numbers of broadcasts the client hasn't acknowledged yet, when it uses acks.
+	unacked []int64
+
+	// The sequence number of the latest message sent to the client; only used by writePump.
+	seq int64
+
+	// The UID of the CONNECT_HUB or HUB_CREATE request that's handing the client to a hub.
+	connectRequestUID string
+
+	// Per endpoint rate limits of the client, and the times it went over them.
+	limits  *ratelimit.Limiter
+	strikes *ratelimit.Strikes
 }
 
 // IsClosed returns true if the client is closed and shouldn't be interacted with anymore.
@@ -70,16 +113,22 @@ func (c *Client) IsClosed() bool {
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
-		c.Unregister()
+		c.leave()
 		c.conn.Close()
-		c.closed = true
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
+	maxFrameBytes := config.Current.Limits.MaxFrameBytes
+	c.conn.SetReadLimit(maxFrameBytes * readLimitFactor)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		var message Message
-		err := c.conn.ReadJSON(&message)
+		frameType, data, err := c.readFrame(maxFrameBytes)
+		if err == errFrameTooLarge {
+			// There's no way to know which request this was without decoding it, so there's no UID.
+			c.reply(toOriginWithError(&Message{}, wscodes.Errorf(wscodes.StatusMessageTooLarge,
+				"messages can be at most %d bytes", maxFrameBytes).
+				WithDetail("limit", strconv.FormatInt(maxFrameBytes, 10))))
+			continue
+		}
 		if err != nil {
 			log.Printf("read pump error %+v", err)
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
@@ -87,14 +136,47 @@ func (c *Client) readPump() {
 			}
 			break
 		}
-		message.client = c
-		err = c.clientToBackend(&message)
+		var message Message
+		err = codecForFrame(frameType).unmarshal(data, &message)
 		if err != nil {
-			log.Printf("error sending %#v to backend: %s", message, err.Error())
+			log.Printf("read pump error %+v", err)
+			break
+		}
+		if disconnect := c.handleIncoming(&message); disconnect {
+			break
 		}
 	}
 }
 
+// handleIncoming handles a message received from the client over any transport, answering it
+// directly or passing it on to the backend. It reports whether the client should be disconnected.
+func (c *Client) handleIncoming(message *Message) bool {
+	message.client = c
+	if message.Endpoint == endpointHello {
+		c.reply(c.handleHello(message))
+		return false
+	}
+	if message.Endpoint == endpointAck {
+		c.handleAck(message)
+		return false
+	}
+	if reply := checkMessageLimits(message); reply != nil {
+		c.reply(reply)
+		return false
+	}
+	if ok, disconnect := c.checkRateLimit(message); !ok {
+		if disconnect {
+			log.Printf("disconnecting user %s for going over rate limits", c.userID)
+		}
+		return disconnect
+	}
+	err := c.clientToBackend(message)
+	if err != nil {
+		log.Printf("error sending %#v to backend: %s", message, err.Error())
+	}
+	return false
+}
+
 // writePump pumps messages from the hub to the websocket connection.
 //
 // A goroutine running writePump is started for each connection. The
@@ -117,7 +199,13 @@ func (c *Client) writePump() {
 				return
 			}
 
-			err := c.conn.WriteJSON(message)
+			codec := c.sendCodec()
+			data, err := codec.marshal(c.sequence(c.adaptToProtocol(message)))
+			if err != nil {
+				log.Printf("error encoding message %#v: %v", message, err)
+				continue
+			}
+			err = c.writeFrame(codec.frameType(), data)
 			if err != nil {
 				return
 			}
@@ -138,25 +226,97 @@ func (c *Client) Start() {
 	go c.readPump()
 }
 
-// Unregister removes the client from the current hub.
-func (c *Client) Unregister() error {
-	if c.unregister == nil {
-		return errNoHub
+// leave marks the client as closed once its connection has ended and takes it out of its hub. A
+// client that isn't in a hub stops the connector from responding to it instead.
+func (c *Client) leave() {
+	c.closed = true
+	c.clientToBackend(&Message{Endpoint: endpointDisconnectFromHub, client: c})
+}
+
+// writeFrame writes a frame to the connection, compressing it if compression is on for the
+// connection and the frame is at least the configured threshold.
+func (c *Client) writeFrame(frameType int, data []byte) error {
+	compress := c.compress && len(data) >= config.Current.Compression.ThresholdBytes
+	c.conn.EnableWriteCompression(compress)
+	before, counted := metrics.BytesWritten(c.conn.UnderlyingConn())
+	err := c.conn.WriteMessage(frameType, data)
+	if err != nil {
+		return err
 	}
-	// We check stopCh twice to ensure that we read a stop request before attempting to read
-	// from a potentially closed chan (c.toBackend)
+	if counted {
+		after, _ := metrics.BytesWritten(c.conn.UnderlyingConn())
+		metrics.RecordFrame(int64(len(data)), after-before, compress)
+	}
+	return nil
+}
+
+// readFrame reads the next frame from the connection, giving its type and contents. If the frame
+// is larger than maxBytes, the rest of it is discarded and errFrameTooLarge is returned.
+func (c *Client) readFrame(maxBytes int64) (int, []byte, error) {
+	frameType, reader, err := c.conn.NextReader()
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxBytes+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		// Drain the frame so the next one can be read; the connection's read limit bounds this.
+		if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+			return 0, nil, err
+		}
+		return 0, nil, errFrameTooLarge
+	}
+	return frameType, data, nil
+}
+
+// reply sends a message straight back to the client without going through a hub. Replies are
+// dropped if the client's send buffer is full, since it isn't keeping up with what it has sent.
+func (c *Client) reply(message *Message) {
 	select {
-	case <-c.stopCh:
-		return fmt.Errorf("client received stop send request")
+	case c.send <- message:
 	default:
 	}
-	select {
-	case <-c.stopCh:
-		return fmt.Errorf("client received stop send request")
-	case c.unregister <- c:
+}
+
+// setRole sets the role the client has in the hub it's connected to.
+func (c *Client) setRole(role string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.role = role
+}
+
+// getRole gives the role the client has in the hub it's connected to.
+func (c *Client) getRole() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.role
+}
+
+// checkRateLimit reports whether the message is within the client's rate limit for its endpoint,
+// replying with a RATE_LIMITED message if not. It also reports whether the client has gone over
+// its limits often enough that it should be disconnected.
+func (c *Client) checkRateLimit(message *Message) (bool, bool) {
+	reply := c.rateLimited(message)
+	if reply == nil {
+		return true, false
 	}
+	c.reply(reply)
+	maxViolations := config.Current.RateLimits.MaxViolations
+	return false, maxViolations > 0 && c.strikes.Add(time.Now()) >= maxViolations
+}
 
-	return nil
+// rateLimited gives the RATE_LIMITED reply to the message if it goes over the client's rate limit
+// for its endpoint, or nil if it doesn't.
+func (c *Client) rateLimited(message *Message) *Message {
+	role := c.getRole()
+	endpoint, rate := config.Current.RateLimits.ClientRate(message.Endpoint, role)
+	ok, retryAfter := c.limits.Allow(endpoint+"/"+role, rate.PerSecond, rate.Burst, time.Now())
+	if ok {
+		return nil
+	}
+	return rateLimitedMessage(message, retryAfter)
 }
 
 // Assign the channels that the Client will need to use for communication with a hub.
@@ -188,5 +348,13 @@ func (c *Client) clientToBackend(message *Message) error {
 // NewClient returns a newly instantiated client. Hub is not assigned and will need to be in order to
 // perform hub related actions.
 func NewClient(userID string, conn *websocket.Conn) *Client {
-	return &Client{userID: userID, conn: conn, send: make(chan *Message, 256)}
+	window := time.Duration(config.Current.RateLimits.ViolationWindowSeconds) * time.Second
+	return &Client{
+		userID:   userID,
+		conn:     conn,
+		send:     make(chan *Message, 256),
+		protocol: protocolV1,
+		limits:   ratelimit.NewLimiter(),
+		strikes:  ratelimit.NewStrikes(window),
+	}
 }
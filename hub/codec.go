@@ -0,0 +1,75 @@
+package hub
+
+import (
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// featureCBOR is the HELLO feature that switches the messages sent to a client to CBOR in binary
+	// frames, starting with the HELLO reply. Clients can send either encoding at any time, since the
+	// frame type says which one a message is in.
+	featureCBOR = "cbor"
+)
+
+// codec encodes and decodes messages for one kind of websocket frame.
+type codec interface {
+	marshal(message *Message) ([]byte, error)
+	unmarshal(data []byte, message *Message) error
+	// frameType is the websocket message type that the codec's messages are sent in.
+	frameType() int
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) marshal(message *Message) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (jsonCodec) unmarshal(data []byte, message *Message) error {
+	return json.Unmarshal(data, message)
+}
+
+func (jsonCodec) frameType() int {
+	return websocket.TextMessage
+}
+
+// cborCodec uses the same field names as JSON, since the cbor package falls back to json tags.
+type cborCodec struct{}
+
+func (cborCodec) marshal(message *Message) ([]byte, error) {
+	return cbor.Marshal(message)
+}
+
+func (cborCodec) unmarshal(data []byte, message *Message) error {
+	return cbor.Unmarshal(data, message)
+}
+
+func (cborCodec) frameType() int {
+	return websocket.BinaryMessage
+}
+
+// codecForFrame gives the codec of messages received in the given frame type.
+func codecForFrame(frameType int) codec {
+	if frameType == websocket.BinaryMessage {
+		return cborCodec{}
+	}
+	return jsonCodec{}
+}
+
+// sendCodec gives the codec used for messages sent to the client.
+func (c *Client) sendCodec() codec {
+	if c.hasFeature(featureCBOR) {
+		return cborCodec{}
+	}
+	return jsonCodec{}
+}
+
+// hasFeature reports whether the feature was enabled for the client with HELLO.
+func (c *Client) hasFeature(feature string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.features[feature]
+}
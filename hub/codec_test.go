@@ -0,0 +1,86 @@
+package hub
+
+import (
+	"collabserver/collections"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// notebookMessage gives a message shaped like a FILE_RETRIEVE reply for a notebook with
+// the given number of pending operations.
+func notebookMessage(numOps int) *Message {
+	ops := make([]string, numOps)
+	for i := range ops {
+		ops[i] = fmt.Sprintf(`{"type":"insert","cell":%d,"index":%d,"text":"print(%d)"}`, i%20, i, i)
+	}
+	return &Message{
+		UID:        "42",
+		Endpoint:   endpointFileRetrieve,
+		Route:      []string{routeOrigin},
+		Status:     "SUCCESS",
+		File:       "Untitled.ipynb",
+		Index:      int64(numOps),
+		Operations: ops,
+		FileState:  `{"cells":[{"source":"` + strings.Repeat("x = 1\\n", 20000) + `"}]}`,
+		UserList:   []collections.UserInfo{{Email: "owner@example.com", Role: "OWNER", Status: "ONLINE"}},
+		FileList:   []collections.FileInfo{{Name: "Untitled.ipynb", Snapshot: collections.FileSnapshot{Index: 3}}},
+		HubList:    []string{"ABCDEF"},
+		HubName:    "ABCDEF",
+		Features:   []string{featureCBOR},
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	codecs := map[string]codec{
+		"json": jsonCodec{},
+		"cbor": cborCodec{},
+	}
+	original := notebookMessage(50)
+	for name, c := range codecs {
+		t.Run(name, func(t *testing.T) {
+			data, err := c.marshal(original)
+			if err != nil {
+				t.Fatalf("marshal gave error: %v", err)
+			}
+			decoded := &Message{}
+			err = c.unmarshal(data, decoded)
+			if err != nil {
+				t.Fatalf("unmarshal gave error: %v", err)
+			}
+			if !reflect.DeepEqual(decoded, original) {
+				t.Errorf("round trip gave %#v but want %#v", decoded, original)
+			}
+		})
+	}
+}
+
+func BenchmarkCodec(b *testing.B) {
+	codecs := map[string]codec{
+		"json": jsonCodec{},
+		"cbor": cborCodec{},
+	}
+	message := notebookMessage(500)
+	for name, c := range codecs {
+		b.Run(name+"/marshal", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := c.marshal(message); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		data, err := c.marshal(message)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name+"/unmarshal", func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if err := c.unmarshal(data, &Message{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
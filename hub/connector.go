@@ -1,32 +1,70 @@
 package hub
 
 import (
+	"collabserver/apikeys"
 	log "collabserver/cloudlog"
+	"collabserver/collabauth"
+	"collabserver/collections"
+	"collabserver/config"
+	"collabserver/hubcodes"
+	"collabserver/ratelimit"
 	"collabserver/storage"
 	"collabserver/websocketcodes"
 	"math/rand"
 	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	errHubCreateFailed = websocketcodes.NewError(websocketcodes.StatusFailure, "failed to create hub")
+	errHubNotFound     = websocketcodes.NewError(websocketcodes.StatusHubDoesntExist, "hub doesn't exist")
+	errHubClosed       = websocketcodes.NewError(websocketcodes.StatusFailure, "hub closed while connecting to it")
 )
 
 const (
 	hubCodeLength             = 6
 	letters                   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
 	maxCodeGenerationAttempts = 10
+	// How many times a client is handed to a hub that closes just before taking it.
+	maxConnectAttempts = 3
 )
 
 // Connector facilitates connecting users to a hub and also keeps track of which hubs
 // are instantiated in the backend.
 type Connector struct {
+	// Guards hubs, since clients are handled in their own goroutines.
+	mu   sync.Mutex
 	hubs map[string]*Hub
 
 	db datastore
 
+	// Guards invitationsChecked, the users whose pending invitations have been accepted, or are
+	// being, since the server started.
+	invitationsMu      sync.Mutex
+	invitationsChecked map[string]bool
+
+	// Guards streams, the open event streams keyed by their connection IDs.
+	streamsMu sync.Mutex
+	streams   map[string]*eventStream
+	// Guards tickets, the unredeemed event stream tickets keyed by their values.
+	ticketsMu sync.Mutex
+	tickets   map[string]streamTicket
+
+	// Guards sessionLimits, the rate limits of REST requests keyed by the user, or the public link
+	// for guests, making them. Each request gets its own session, so the limits outlive them.
+	sessionLimitsMu sync.Mutex
+	sessionLimits   map[string]*ratelimit.Limiter
+
 	// Used to receive clients back from hubs.
 	clientQueue chan *Client
 }
 
 func (hc *Connector) init() {
 	hc.hubs = map[string]*Hub{}
+	hc.streams = map[string]*eventStream{}
+	hc.tickets = map[string]streamTicket{}
+	hc.sessionLimits = map[string]*ratelimit.Limiter{}
 	hc.db = storage.DB
 
 	hc.clientQueue = make(chan *Client)
@@ -36,20 +74,85 @@ func (hc *Connector) init() {
 // GetOrRetrieve looks for the hub in the database and creates a new entry if it doesn't exist,
 // returning the result either way.
 func (hc *Connector) GetOrRetrieve(hubName, userID string) (*Hub, error) {
-	currentHub, ok := hc.hubs[hubName]
-	if !ok || currentHub.IsClosed() {
-		var err error
-		currentHub, err = CreateOrRetrieveHub(hubName, userID)
+	if currentHub := hc.openHub(hubName); currentHub != nil {
+		return currentHub, nil
+	}
+	// The datastore is read without holding mu, so that other hubs can be reached meanwhile.
+	retrieved, err := CreateOrRetrieveHub(hubName, userID)
+	if err != nil {
+		log.Printf("Error creating hub %s: %v", hubName, err)
+		return nil, err
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if currentHub, ok := hc.hubs[hubName]; ok && !currentHub.IsClosed() {
+		// Someone else opened the hub first; the retrieved one was never run, so it can be dropped.
+		return currentHub, nil
+	}
+	hc.hubs[hubName] = retrieved
+	go retrieved.Run()
+	return retrieved, nil
+}
+
+// openHub gives the hub with the name if it's open, or nil if it isn't.
+func (hc *Connector) openHub(hubName string) *Hub {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if currentHub, ok := hc.hubs[hubName]; ok && !currentHub.IsClosed() {
+		return currentHub
+	}
+	return nil
+}
+
+// connectClient hands the client to the hub with the name, opening the hub if it isn't open.
+// request is the client's message asking to join the hub, and the hub sends the client back
+// through returnClient when it leaves.
+func (hc *Connector) connectClient(hubName string, client *Client, returnClient chan *Client, request *Message) error {
+	for i := 0; i < maxConnectAttempts; i++ {
+		hub, err := hc.GetOrRetrieve(hubName, client.userID)
 		if err != nil {
-			log.Printf("Error creating hub %s: %v", hubName, err)
-			return nil, err
+			return err
+		}
+		if hub.registerClient(client, returnClient, request) {
+			return nil
 		}
+		// The hub closed just before taking the client, so it's opened again.
+	}
+	return errHubClosed.WithDetail("hub", hubName)
+}
 
-		hc.hubs[hubName] = currentHub
-		go currentHub.Run()
+// createHub makes a hub with a newly generated code, with userID as its owner.
+func (hc *Connector) createHub(userID string) (*Hub, error) {
+	hubs := hc.db.CollectionForID(hubsID, nil)
+	for i := 0; i < maxCodeGenerationAttempts; i++ {
+		hubName := generateRandomHubCode(hubCodeLength)
+		// Retrieving a hub that already exists would hand someone else's hub to the user.
+		if exists, _, err := hc.db.DocExists(hubName, hubs); err != nil || exists {
+			continue
+		}
+		hub, err := hc.GetOrRetrieve(hubName, userID)
+		if err != nil {
+			log.Printf("Error while generating new hub code: %#v", err.Error())
+			continue
+		}
+		return hub, nil
 	}
+	return nil, errHubCreateFailed
+}
 
-	return currentHub, nil
+// ServiceAccount gives the hub's service account with the ID, for checking API keys against.
+func (hc *Connector) ServiceAccount(hubName, accountID string) (*collections.ServiceAccount, error) {
+	hubs := hc.db.CollectionForID(hubsID, nil)
+	if hubs == nil {
+		return nil, ErrorCollectionNotFound
+	}
+	account := &collections.ServiceAccount{}
+	err := hc.db.EntryForRef(hubs.Doc(hubName).Collection(serviceAccountsID).Doc(accountID), account)
+	if err != nil {
+		return nil, err
+	}
+	account.ID = accountID
+	return account, nil
 }
 
 // RetrieveHubList gives a list of hubs that user userID can access.
@@ -68,6 +171,10 @@ func (hc *Connector) ReceiveBackClients() {
 				return
 			}
 
+			if client.IsClosed() {
+				// Its connection ended while it was in the hub.
+				continue
+			}
 			go hc.respondUntilHandoff(client)
 		}
 	}
@@ -75,16 +182,146 @@ func (hc *Connector) ReceiveBackClients() {
 
 // ServeWs handles the websocket connection and responds to the messages from the client until it connects to a hub.
 func (hc *Connector) ServeWs(userID string, w http.ResponseWriter, r *http.Request, response http.Header) {
-	upgrader.CheckOrigin = func(r *http.Request) bool { return true }
+	client := startClient(userID, nil, w, r, response)
+	if client == nil {
+		return
+	}
+	hc.checkPendingInvitations(userID)
+	go hc.respondUntilHandoff(client)
+}
+
+// startClient upgrades the request to a websocket connection and starts a client for userID on it,
+// giving nil if the upgrade fails. guest is the client's pass if it's a guest's.
+func startClient(userID string, guest *guestPass, w http.ResponseWriter, r *http.Request, response http.Header) *Client {
 	conn, err := upgrader.Upgrade(w, r, response)
 	if err != nil {
 		log.Println(err)
-		return
+		return nil
 	}
 
+	compression := config.Current.Compression
 	client := NewClient(userID, conn)
+	client.guest = guest
+	if compression.Enabled && clientAcceptsCompression(r) {
+		client.compress = true
+		conn.SetCompressionLevel(compression.Level)
+	}
 	client.Start()
-	go hc.respondUntilHandoff(client)
+	return client
+}
+
+// checkPendingInvitations accepts the user's pending invitations in the background, so that
+// connecting doesn't wait on it. Once they've been accepted they aren't looked for again, since no
+// more are made for emails that someone has signed up with.
+func (hc *Connector) checkPendingInvitations(userID string) {
+	if apikeys.IsServiceAccount(userID) {
+		return
+	}
+	hc.invitationsMu.Lock()
+	defer hc.invitationsMu.Unlock()
+	if hc.invitationsChecked[userID] {
+		return
+	}
+	if hc.invitationsChecked == nil {
+		hc.invitationsChecked = map[string]bool{}
+	}
+	hc.invitationsChecked[userID] = true
+	go func() {
+		if !hc.acceptPendingInvitations(userID) {
+			// Look again next time, e.g. once the user has verified their email.
+			hc.invitationsMu.Lock()
+			defer hc.invitationsMu.Unlock()
+			delete(hc.invitationsChecked, userID)
+		}
+	}()
+}
+
+// acceptPendingInvitations makes the user a member of the hubs their email was invited to before
+// they signed up, and lets the users who invited them know. Only verified emails count, since anyone
+// can sign up with an email they don't own. It reports whether every invitation was accepted.
+func (hc *Connector) acceptPendingInvitations(userID string) bool {
+	email, err := hc.db.VerifiedEmail(userID)
+	if err != nil {
+		log.Printf("Error getting the verified email of user %s: %v", userID, err)
+		return false
+	}
+	if email == "" {
+		return false
+	}
+	invitations, err := hc.db.PendingInvitations(email)
+	if err != nil {
+		log.Printf("Error getting pending invitations of user %s: %v", userID, err)
+		return false
+	}
+	accepted := true
+	for _, invitation := range invitations {
+		joined, err := hc.acceptPendingInvitation(userID, invitation)
+		if err != nil {
+			log.Printf("Error accepting invitation of user %s to hub %s: %v", userID, invitation.Hub, err)
+			accepted = false
+			continue
+		}
+		if _, err := hc.db.DeletePendingInvitation(email, invitation.Hub); err != nil {
+			log.Printf("Error deleting invitation of user %s to hub %s: %v", userID, invitation.Hub, err)
+		}
+		if !joined {
+			continue
+		}
+		log.Printf("User %s joined hub %s as %s, invited by %s", userID, invitation.Hub, invitation.Role, invitation.InvitedBy)
+		hc.notifyHub(invitation.Hub, &Message{
+			Endpoint:       endpointInvitationAccepted,
+			HubName:        invitation.Hub,
+			ModifyUserID:   email,
+			ModifyUserRole: invitation.Role,
+			Status:         websocketcodes.StatusSuccess,
+			Route:          []string{invitation.InvitedBy},
+		})
+	}
+	return accepted
+}
+
+// acceptPendingInvitation gives the user the invitation's role, reporting whether they joined the
+// hub. Invitations to hubs that no longer exist are dropped, and users who were given a role some
+// other way since keep it.
+func (hc *Connector) acceptPendingInvitation(userID string, invitation collections.PendingInvitation) (bool, error) {
+	exists, hubRef, err := hc.db.DocExists(invitation.Hub, hc.db.CollectionForID(hubsID, nil))
+	if err != nil || !exists {
+		return false, err
+	}
+	users := hubRef.Collection(authID)
+	authEntry := &collections.AuthEntry{}
+	memberRef, _ := hc.db.EntryForFieldValue(users, hubcodes.UserIDKey, userID, authEntry)
+	if memberRef != nil && authEntry.Role != collabauth.NoRole {
+		return true, nil
+	}
+	if err := setMemberRole(hc.db, users, invitation.Hub, userID, invitation.Role, memberRef); err != nil {
+		return false, err
+	}
+	hc.forgetRole(invitation.Hub, userID)
+	recordAudit(hc.db, hubRef, collections.AuditEntry{
+		Actor:   invitation.InvitedBy,
+		Action:  hubcodes.AuditMemberAdded,
+		Target:  userID,
+		Before:  collabauth.NoRole,
+		After:   invitation.Role,
+		Details: map[string]string{"email": invitation.Email},
+	})
+	return true, nil
+}
+
+// forgetRole has the hub, if it's open, look the user's role up again, for when it was changed
+// from outside the hub.
+func (hc *Connector) forgetRole(hubName, userID string) {
+	if hub := hc.openHub(hubName); hub != nil {
+		hub.auth.Forget(userID)
+	}
+}
+
+// notifyHub has the hub send the message to its clients, if the hub is open.
+func (hc *Connector) notifyHub(hubName string, message *Message) {
+	if hub := hc.openHub(hubName); hub != nil {
+		go hub.notify(message)
+	}
 }
 
 // Responds to client messages (currently only supporting hub list and connect requests) until the client connects to a hub.
@@ -101,35 +338,54 @@ func (hc *Connector) respondUntilHandoff(client *Client) {
 			log.Print("channel to client has been closed in hub connector")
 			return
 		}
+		if client.IsClosed() {
+			// The client's connection ended before it joined a hub.
+			return
+		}
+		if client.guest != nil && !guestCanAsk(client.guest, msg) {
+			client.send <- toOriginWithError(msg, errUnauthorized)
+			continue
+		}
 		var returnMessage *Message
 		switch msg.Endpoint {
 		case endpointListHub:
-			hubList := hc.RetrieveHubList(client.userID)
+			hubList := []string{}
+			if client.guest != nil {
+				hubList = append(hubList, client.guest.hubName)
+			} else {
+				hubList = hc.RetrieveHubList(client.userID)
+			}
 			returnMessage = toOriginWithStatus(msg, websocketcodes.StatusSuccess, "ok")
 			returnMessage.HubList = hubList
 		case endpointConnectToHub:
-			hub, err := hc.GetOrRetrieve(msg.HubName, client.userID)
+			err := hc.connectClient(msg.HubName, client, hc.clientQueue, msg)
 			if err != nil {
-				returnMessage = toOriginWithStatus(msg, websocketcodes.StatusFailure, "failed to retrieve hub")
+				returnMessage = toOriginWithError(msg, websocketcodes.AsError(err).WithDetail("hub", msg.HubName))
+			} else {
+				return
+			}
+		case endpointJoinHubWithInvite:
+			hubName, err := hc.JoinHubWithInvite(client.userID, msg.InviteToken)
+			if err == nil {
+				err = hc.connectClient(hubName, client, hc.clientQueue, msg)
+			}
+			if err != nil {
+				returnMessage = toOriginWithError(msg, err)
 			} else {
-				hub.registerClient(client, hc.clientQueue)
 				return
 			}
 		case endpointHubCreate:
-			for i := 0; i < maxCodeGenerationAttempts; i++ {
-				hubName := generateRandomHubCode(hubCodeLength)
-				hub, err := hc.GetOrRetrieve(hubName, client.userID)
-				if err != nil {
-					log.Printf("Error while generating new hub code: %#v", err.Error())
-					continue
-				}
-				hub.registerClient(client, hc.clientQueue)
+			hub, err := hc.createHub(client.userID)
+			if err == nil {
+				err = hc.connectClient(hub.name, client, hc.clientQueue, msg)
+			}
+			if err != nil {
+				returnMessage = toOriginWithError(msg, err)
+			} else {
 				return
 			}
-			// If we're here, we continued every loop and failed to make a hub
-			returnMessage = toOriginWithStatus(msg, websocketcodes.StatusFailure, "failed to create hub")
 		default:
-			returnMessage = toOriginWithStatus(msg, websocketcodes.StatusNotConnectedToHub, "Connect to a hub first")
+			returnMessage = toOriginWithError(msg, websocketcodes.NewError(websocketcodes.StatusNotConnectedToHub, "Connect to a hub first"))
 		}
 		client.send <- returnMessage
 	}
@@ -142,6 +398,13 @@ func NewConnector() *Connector {
 	return hubconnector
 }
 
+// clientAcceptsCompression reports whether the upgrade request offers permessage-deflate, which
+// the upgrader then agrees to when compression is enabled.
+func clientAcceptsCompression(r *http.Request) bool {
+	extensions := strings.Join(r.Header.Values("Sec-WebSocket-Extensions"), ",")
+	return strings.Contains(extensions, "permessage-deflate")
+}
+
 func generateRandomHubCode(n int) string {
 	runes := make([]byte, n)
 	for i := range runes {
@@ -0,0 +1,240 @@
+package hub
+
+import (
+	"collabserver/apikeys"
+	log "collabserver/cloudlog"
+	"collabserver/config"
+	wscodes "collabserver/websocketcodes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The event stream transport is for clients that can't keep a websocket open, e.g. because a proxy
+// in between breaks them. The server sends messages as Server-Sent Events on a long-lived GET
+// request, and the client sends messages by POSTing them with the connection ID it was given when
+// the stream opened. Both ends go through a Client like websocket connections do, so hubs can't
+// tell the difference.
+//
+// Browsers can't set headers on the GET request of an event stream, so instead of putting their
+// credentials in its URL, clients first POST for a ticket with their usual Authorization header and
+// open the stream with the ticket. Tickets are only good for a short while and for a single stream.
+
+const (
+	// connectionEvent is the first event on a stream, telling the client its connection ID.
+	connectionEvent = "connection"
+
+	connectionIDBytes = 16
+	ticketBytes       = 16
+	// How long a ticket can be used to open a stream for after it's issued.
+	ticketLifetime = 30 * time.Second
+)
+
+var (
+	errStreamingUnsupported = errors.New("response writer doesn't support streaming")
+)
+
+// eventStream is an open event stream and the client it carries messages for.
+type eventStream struct {
+	id     string
+	client *Client
+	// Closed when the client should be disconnected.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// disconnect ends the stream.
+func (s *eventStream) disconnect() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// streamTicket lets the user open an event stream until it expires.
+type streamTicket struct {
+	userID  string
+	expires time.Time
+}
+
+type connectionEventData struct {
+	ConnectionID string `json:"connectionID"`
+}
+
+// ServeEvents streams messages to userID as Server-Sent Events until the request ends, and
+// responds to the messages POSTed to ServeEventPost until the client connects to a hub.
+func (hc *Connector) ServeEvents(userID string, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println(errStreamingUnsupported)
+		http.Error(w, errStreamingUnsupported.Error(), http.StatusInternalServerError)
+		return
+	}
+	stream, err := hc.openStream(userID)
+	if err != nil {
+		log.Printf("Error opening event stream: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	client := stream.client
+	defer func() {
+		hc.closeStream(stream)
+		client.leave()
+	}()
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// Keeps nginx style proxies from buffering the stream.
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	data, _ := json.Marshal(connectionEventData{ConnectionID: stream.id})
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", connectionEvent, data); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	hc.checkPendingInvitations(client.userID)
+	go hc.respondUntilHandoff(client)
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-client.send:
+			if !ok {
+				// The hub closed the channel.
+				return
+			}
+			numbered := client.sequence(client.adaptToProtocol(message))
+			data, err := jsonCodec{}.marshal(numbered)
+			if err != nil {
+				log.Printf("error encoding message %#v: %v", message, err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", numbered.Seq, data)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			// A comment, which clients ignore, so that proxies don't time out an idle stream.
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-stream.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// ServeEventPost handles a message that userID sends over the event stream with the connection ID.
+// The request only says whether the message was accepted; any reply comes over the stream.
+func (hc *Connector) ServeEventPost(userID, connectionID string, w http.ResponseWriter, r *http.Request) {
+	stream := hc.stream(connectionID)
+	if stream == nil {
+		http.Error(w, "connection doesn't exist", http.StatusNotFound)
+		return
+	}
+	if stream.client.userID != userID {
+		http.Error(w, "connection belongs to another user", http.StatusForbidden)
+		return
+	}
+	client := stream.client
+	maxFrameBytes := config.Current.Limits.MaxFrameBytes
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxFrameBytes+1))
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) > maxFrameBytes {
+		client.reply(toOriginWithError(&Message{}, wscodes.Errorf(wscodes.StatusMessageTooLarge,
+			"messages can be at most %d bytes", maxFrameBytes).
+			WithDetail("limit", strconv.FormatInt(maxFrameBytes, 10))))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	var message Message
+	err = jsonCodec{}.unmarshal(data, &message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if disconnect := client.handleIncoming(&message); disconnect {
+		stream.disconnect()
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// IssueStreamTicket gives a ticket that userID can open a single event stream with shortly.
+func (hc *Connector) IssueStreamTicket(userID string) (string, error) {
+	ticket, err := apikeys.RandomHex(ticketBytes)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	hc.ticketsMu.Lock()
+	defer hc.ticketsMu.Unlock()
+	// Tickets that were never redeemed are dropped as new ones are issued.
+	for value, issued := range hc.tickets {
+		if now.After(issued.expires) {
+			delete(hc.tickets, value)
+		}
+	}
+	hc.tickets[ticket] = streamTicket{userID: userID, expires: now.Add(ticketLifetime)}
+	return ticket, nil
+}
+
+// RedeemStreamTicket gives the user the ticket was issued to, or "" if it doesn't exist, has
+// expired or was already redeemed.
+func (hc *Connector) RedeemStreamTicket(ticket string) string {
+	hc.ticketsMu.Lock()
+	defer hc.ticketsMu.Unlock()
+	issued, ok := hc.tickets[ticket]
+	if !ok {
+		return ""
+	}
+	delete(hc.tickets, ticket)
+	if time.Now().After(issued.expires) {
+		return ""
+	}
+	return issued.userID
+}
+
+// openStream makes a text only client for userID and keeps it under a new connection ID.
+func (hc *Connector) openStream(userID string) (*eventStream, error) {
+	id, err := apikeys.RandomHex(connectionIDBytes)
+	if err != nil {
+		return nil, err
+	}
+	client := NewClient(userID, nil)
+	client.textOnly = true
+	stream := &eventStream{
+		id:     id,
+		client: client,
+		done:   make(chan struct{}),
+	}
+	hc.streamsMu.Lock()
+	defer hc.streamsMu.Unlock()
+	hc.streams[stream.id] = stream
+	return stream, nil
+}
+
+// stream gives the open stream with the connection ID, or nil if there is none.
+func (hc *Connector) stream(connectionID string) *eventStream {
+	hc.streamsMu.Lock()
+	defer hc.streamsMu.Unlock()
+	return hc.streams[connectionID]
+}
+
+func (hc *Connector) closeStream(stream *eventStream) {
+	hc.streamsMu.Lock()
+	defer hc.streamsMu.Unlock()
+	delete(hc.streams, stream.id)
+	stream.disconnect()
+}
@@ -0,0 +1,145 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newEventServer(hc *Connector) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			hc.ServeEventPost("user", strings.TrimPrefix(r.URL.Path, "/"), w, r)
+			return
+		}
+		hc.ServeEvents("user", w, r)
+	}))
+}
+
+// nextData reads the data of the next event on the stream.
+func nextData(t *testing.T, reader *bufio.Reader) string {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream failed: %v", err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
+
+func TestEventStreamHello(t *testing.T) {
+	hc := &Connector{streams: map[string]*eventStream{}, db: &fakeDatastore{}}
+	server := newEventServer(hc)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("opening event stream failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("event stream has content type %s", got)
+	}
+	reader := bufio.NewReader(resp.Body)
+	connection := connectionEventData{}
+	if err := json.Unmarshal([]byte(nextData(t, reader)), &connection); err != nil || connection.ConnectionID == "" {
+		t.Fatalf("first event doesn't give a connection ID: %v", err)
+	}
+
+	hello := `{"uid":"1","endpoint":"HELLO","protocolVersion":2,"features":["cbor","acks"]}`
+	post, err := http.Post(server.URL+"/"+connection.ConnectionID, "application/json", strings.NewReader(hello))
+	if err != nil {
+		t.Fatalf("posting HELLO failed: %v", err)
+	}
+	post.Body.Close()
+	if post.StatusCode != http.StatusAccepted {
+		t.Errorf("posting HELLO gave status %d but want %d", post.StatusCode, http.StatusAccepted)
+	}
+
+	reply := Message{}
+	if err := json.Unmarshal([]byte(nextData(t, reader)), &reply); err != nil {
+		t.Fatalf("HELLO reply isn't JSON: %v", err)
+	}
+	if reply.ReplyTo != "1" || reply.Seq != 1 {
+		t.Errorf("HELLO reply has replyTo %q and seq %d", reply.ReplyTo, reply.Seq)
+	}
+	// Event streams are text only, so CBOR can't be enabled.
+	if len(reply.Features) != 1 || reply.Features[0] != featureAcks {
+		t.Errorf("HELLO over an event stream enabled features %v but want [%s]", reply.Features, featureAcks)
+	}
+}
+
+func TestEventStreamEndStopsConnector(t *testing.T) {
+	hc := &Connector{streams: map[string]*eventStream{}, db: &fakeDatastore{}}
+	server := newEventServer(hc)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("opening event stream failed: %v", err)
+	}
+	reader := bufio.NewReader(resp.Body)
+	connection := connectionEventData{}
+	if err := json.Unmarshal([]byte(nextData(t, reader)), &connection); err != nil {
+		t.Fatalf("first event doesn't give a connection ID: %v", err)
+	}
+	client := hc.stream(connection.ConnectionID).client
+	// The connector answers LIST_HUB, so it's responding to the client once the reply comes.
+	post, err := http.Post(server.URL+"/"+connection.ConnectionID, "application/json",
+		strings.NewReader(`{"uid":"1","endpoint":"LIST_HUB"}`))
+	if err != nil {
+		t.Fatalf("posting LIST_HUB failed: %v", err)
+	}
+	post.Body.Close()
+	nextData(t, reader)
+
+	resp.Body.Close()
+	select {
+	case <-client.stopCh:
+	case <-time.After(5 * time.Second):
+		t.Errorf("connector still responds to the client after its stream ended")
+	}
+}
+
+func TestEventPostToUnknownConnection(t *testing.T) {
+	hc := &Connector{streams: map[string]*eventStream{}, db: &fakeDatastore{}}
+	server := newEventServer(hc)
+	defer server.Close()
+
+	post, err := http.Post(server.URL+"/unknown", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("posting failed: %v", err)
+	}
+	post.Body.Close()
+	if post.StatusCode != http.StatusNotFound {
+		t.Errorf("posting to an unknown connection gave status %d but want %d", post.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestStreamTicketsAreSingleUse(t *testing.T) {
+	hc := &Connector{tickets: map[string]streamTicket{}}
+	ticket, err := hc.IssueStreamTicket("user")
+	if err != nil {
+		t.Fatalf("issuing a ticket failed: %v", err)
+	}
+	if userID := hc.RedeemStreamTicket(ticket); userID != "user" {
+		t.Errorf("redeeming a ticket gave user %q but want user", userID)
+	}
+	if userID := hc.RedeemStreamTicket(ticket); userID != "" {
+		t.Errorf("redeeming a ticket again gave user %q", userID)
+	}
+
+	hc.tickets["expired"] = streamTicket{userID: "user", expires: time.Now().Add(-time.Second)}
+	if userID := hc.RedeemStreamTicket("expired"); userID != "" {
+		t.Errorf("redeeming an expired ticket gave user %q", userID)
+	}
+	if userID := hc.RedeemStreamTicket("made up"); userID != "" {
+		t.Errorf("redeeming a ticket that wasn't issued gave user %q", userID)
+	}
+}
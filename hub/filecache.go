@@ -0,0 +1,263 @@
+package hub
+
+import (
+	log "collabserver/cloudlog"
+	"collabserver/collections"
+	"collabserver/hubcodes"
+	"collabserver/remotejob"
+	"collabserver/storage"
+	wscodes "collabserver/websocketcodes"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+)
+
+const (
+	// The number of a file's most recent operations kept in memory for answering catch-up requests.
+	// Clients further behind than this are served from the datastore instead.
+	maxCachedOps = 1000
+
+	// saveMarkerOp takes up the index of a save that replaced the file's contents. It's never sent
+	// to clients nor applied, since the snapshot is always at or after the latest one. The
+	// datastore drops it, and the ops before it, when reading ops.
+	saveMarkerOp = ""
+)
+
+// fileHead is the in-memory state of a file that the hub needs for committing operations, so
+// that a file update doesn't have to look the file up and read its operations every time.
+// It is only accessed from the hub's Run goroutine and so needs no locking.
+type fileHead struct {
+	// The file's Document and its operations subcollection.
+	ref *firestore.DocumentRef
+	ops *firestore.CollectionRef
+
+	// The index that the next committed operation will take.
+	head int64
+
+	// The most recent operations of the file; tail[i] is the operation at index tailStart+i.
+	tail      []string
+	tailStart int64
+
+	// The index of the latest operation applied to the file's snapshot, as of the last read.
+	snapshotIndex int64
+
+	// The latest operation index at the time a snapshot update was last requested.
+	updateRequestedAt int64
+
+	// Ops made on top of fewer ops than this were made on contents that a save has since replaced,
+	// or 0 if the file has never been saved.
+	replacedBefore int64
+
+	// The file's access list, which overrides hub roles for it.
+	acl []collections.FileACLEntry
+}
+
+// fileHead gives the cached head of the file, reading it from the datastore on first access.
+func (h *Hub) fileHead(fileName string) (*fileHead, error) {
+	if fh, ok := h.fileHeads[fileName]; ok {
+		return fh, nil
+	}
+	data := collections.FileInfo{}
+	docRef, err := h.db.EntryForFieldValue(h.files, hubcodes.FileNameKey, fileName, &data)
+	if err != nil {
+		return nil, err
+	}
+	fh := &fileHead{
+		ref:               docRef,
+		ops:               h.db.CollectionForID(opsID, docRef),
+		snapshotIndex:     int64(data.Snapshot.Index),
+		updateRequestedAt: -1,
+		replacedBefore:    data.ReplacedBefore,
+		acl:               data.ACL,
+	}
+	// OpsForFile gives the ops starting from idx-1, so this reads every op after the snapshot.
+	ops, start, err := h.db.OpsForFile(fh.ops, fh.snapshotIndex+2)
+	if err != nil {
+		return nil, err
+	}
+	if start == -1 {
+		start = fh.snapshotIndex + 1
+	}
+	fh.tailStart = start
+	fh.head = start
+	fh.append(ops)
+	if data.MarkedForUpdate {
+		// Don't request another update until the pending one has had a chance to finish.
+		fh.updateRequestedAt = fh.head - 1
+	}
+
+	h.fileHeads[fileName] = fh
+	delete(h.fileACLs, fileName)
+	return fh, nil
+}
+
+// forgetFile drops the cached head and access list of the file, e.g. when it's renamed or deleted.
+func (h *Hub) forgetFile(fileName string) {
+	delete(h.fileHeads, fileName)
+	delete(h.fileACLs, fileName)
+}
+
+// fileACL gives the access list of the file, from its cached head if it has one and otherwise
+// reading it just once.
+func (h *Hub) fileACL(fileName string) ([]collections.FileACLEntry, error) {
+	if fh, ok := h.fileHeads[fileName]; ok {
+		return fh.acl, nil
+	}
+	if acl, ok := h.fileACLs[fileName]; ok {
+		return acl, nil
+	}
+	data := collections.FileInfo{}
+	if _, err := h.db.EntryForFieldValue(h.files, hubcodes.FileNameKey, fileName, &data); err != nil {
+		return nil, err
+	}
+	h.rememberACL(fileName, data.ACL)
+	return data.ACL, nil
+}
+
+// rememberACL keeps the access list of a file whose head isn't cached.
+func (h *Hub) rememberACL(fileName string, acl []collections.FileACLEntry) {
+	if h.fileACLs == nil {
+		h.fileACLs = map[string][]collections.FileACLEntry{}
+	}
+	h.fileACLs[fileName] = acl
+}
+
+// append adds newly committed ops to the head, trimming the tail to maxCachedOps.
+func (fh *fileHead) append(ops []string) {
+	fh.tail = append(fh.tail, ops...)
+	fh.head += int64(len(ops))
+	if extra := len(fh.tail) - maxCachedOps; extra > 0 {
+		// Reslicing doesn't copy; the trimmed ops are let go of the next time append grows the
+		// array, which only copies the ops still in the tail.
+		fh.tail = fh.tail[extra:]
+		fh.tailStart += int64(extra)
+	}
+}
+
+// reload reads the ops committed at or after the head that the hub doesn't know of, which happens
+// when another server commits to the same file.
+func (h *Hub) reload(fh *fileHead) error {
+	// OpsForFile gives the ops starting from idx-1, so this reads the ops from the head onwards.
+	ops, start, err := h.db.OpsForFile(fh.ops, fh.head+1)
+	if err != nil {
+		return err
+	}
+	if start == -1 {
+		return nil
+	}
+	if start > fh.head {
+		// Another server saved the file, so the ops up to its save marker were left out; the
+		// cached ones were made on the contents it replaced too.
+		fh.tail = []string{}
+		fh.tailStart = start
+		fh.head = start
+		fh.replacedBefore = start
+		fh.snapshotIndex = start - 1
+	} else if start != fh.head {
+		return fmt.Errorf("operations read from index %d but want %d", start, fh.head)
+	}
+	fh.append(ops)
+	return nil
+}
+
+// opsSince gives the file's operations from index idx onwards and the index of the first one
+// returned. Ops still in the tail are served from memory, otherwise they're read from the datastore.
+func (h *Hub) opsSince(fh *fileHead, idx int64) ([]string, int64, error) {
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= fh.tailStart {
+		if idx >= fh.head {
+			return []string{}, idx, nil
+		}
+		ops, start := afterSave(fh.tail[idx-fh.tailStart:], idx)
+		return append([]string{}, ops...), start, nil
+	}
+	ops, start, err := h.db.OpsForFile(fh.ops, idx+1)
+	if err != nil {
+		return nil, idx, err
+	}
+	if start == -1 {
+		start = idx
+	}
+	return ops, start, nil
+}
+
+// afterSave drops the ops up to and including the latest save marker from ops, which start at
+// index start, since they were made on replaced contents. It gives the ops left and their start.
+func afterSave(ops []string, start int64) ([]string, int64) {
+	for i := len(ops) - 1; i >= 0; i-- {
+		if ops[i] == saveMarkerOp {
+			return ops[i+1:], start + int64(i) + 1
+		}
+	}
+	return ops, start
+}
+
+// commitOps checks the index of the incoming ops against the file's head and writes them if they
+// start at the head. It gives the status, the index and ops to send back, and any extra text about
+// the status.
+func (h *Hub) commitOps(fh *fileHead, idx int64, ops []string, committerID string) (string, int64, []string, string) {
+	switch {
+	case fh.replacedBefore > 0 && idx < fh.replacedBefore:
+		// The client's state is from before a save replaced the contents, so its ops can't be
+		// committed or caught up; it has to retrieve the file again.
+		return wscodes.StatusFileReplaced, fh.replacedBefore - 1, []string{}, ""
+	case idx > fh.head:
+		log.Printf("operation index: %d larger than upper bound", idx)
+		return wscodes.StatusOperationTooNew, idx, []string{}, ""
+	case idx < fh.head:
+		// The client is behind (or has nothing if idx is negative), so send it what it's missing.
+		retOps, start, err := h.opsSince(fh, idx)
+		if err != nil {
+			return wscodes.StatusOperationCommitError, idx, []string{}, err.Error()
+		}
+		return wscodes.StatusOperationTooOld, start, retOps, ""
+	}
+	err := h.db.AppendOps(fh.ops, idx, ops, committerID)
+	if err == storage.ErrOpIndexTaken {
+		// The cached head is out of date, so catch up and send the client what it's missing.
+		if err := h.reload(fh); err != nil {
+			return wscodes.StatusOperationCommitError, idx, []string{}, err.Error()
+		}
+		if fh.replacedBefore > 0 && idx < fh.replacedBefore {
+			return wscodes.StatusFileReplaced, fh.replacedBefore - 1, []string{}, ""
+		}
+		if fh.head > idx {
+			retOps, start, err := h.opsSince(fh, idx)
+			if err != nil {
+				return wscodes.StatusOperationCommitError, idx, []string{}, err.Error()
+			}
+			return wscodes.StatusOperationTooOld, start, retOps, ""
+		}
+	}
+	if err != nil {
+		return wscodes.StatusOperationCommitError, idx, []string{}, err.Error()
+	}
+	fh.append(ops)
+	return wscodes.StatusOperationCommitted, idx, ops, ""
+}
+
+// requestSnapshotUpdate asks the remote service to bring the file's snapshot up to date once
+// enough ops have been committed since the snapshot or since the last request, or as soon as there
+// are any if now is set.
+func (h *Hub) requestSnapshotUpdate(fh *fileHead, fileName string, now bool) {
+	latestOpIndex := fh.head - 1
+	base := fh.snapshotIndex
+	if fh.updateRequestedAt > base {
+		base = fh.updateRequestedAt
+	}
+	threshold := int64(maxOpsBeforeUpdate)
+	if now {
+		threshold = 0
+	}
+	if latestOpIndex-base <= threshold {
+		return
+	}
+	// Mark it as needing an update; the remote service will read and perform
+	// the necessary transaction atomically (i.e. if this is called multiple times and
+	// one of the runs finishes then all other runs will terminate without any writes).
+	h.db.UpdateEntry(fh.ref, hubcodes.FileUpdateKey, true)
+	remotejob.FileUpdateRequest(h.name, fileName)
+	fh.updateRequestedAt = latestOpIndex
+}
@@ -0,0 +1,171 @@
+package hub
+
+import (
+	"collabserver/storage"
+	wscodes "collabserver/websocketcodes"
+	"reflect"
+	"testing"
+)
+
+func TestCommitOps(t *testing.T) {
+	cases := []struct {
+		name       string
+		idx        int64
+		ops        []string
+		wantStatus string
+		wantIdx    int64
+		wantOps    []string
+		wantHead   int64
+	}{
+		{
+			name:       "ops at the head are committed",
+			idx:        3,
+			ops:        []string{"d", "e"},
+			wantStatus: wscodes.StatusOperationCommitted,
+			wantIdx:    3,
+			wantOps:    []string{"d", "e"},
+			wantHead:   5,
+		},
+		{
+			name:       "ops behind the head get the missing ops",
+			idx:        1,
+			ops:        []string{"x"},
+			wantStatus: wscodes.StatusOperationTooOld,
+			wantIdx:    1,
+			wantOps:    []string{"b", "c"},
+			wantHead:   3,
+		},
+		{
+			name:       "negative index gets every op",
+			idx:        -1,
+			wantStatus: wscodes.StatusOperationTooOld,
+			wantIdx:    0,
+			wantOps:    []string{"a", "b", "c"},
+			wantHead:   3,
+		},
+		{
+			name:       "ops past the head are rejected",
+			idx:        4,
+			ops:        []string{"x"},
+			wantStatus: wscodes.StatusOperationTooNew,
+			wantIdx:    4,
+			wantOps:    []string{},
+			wantHead:   3,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &Hub{db: &fakeDatastore{}}
+			fh := &fileHead{snapshotIndex: -1, updateRequestedAt: -1}
+			fh.append([]string{"a", "b", "c"})
+
+			status, idx, ops, _ := h.commitOps(fh, tc.idx, tc.ops, "writer")
+			if status != tc.wantStatus {
+				t.Errorf("commitOps gave status %s but want %s", status, tc.wantStatus)
+			}
+			if idx != tc.wantIdx {
+				t.Errorf("commitOps gave index %d but want %d", idx, tc.wantIdx)
+			}
+			if !reflect.DeepEqual(ops, tc.wantOps) {
+				t.Errorf("commitOps gave ops %v but want %v", ops, tc.wantOps)
+			}
+			if fh.head != tc.wantHead {
+				t.Errorf("file head is %d after commitOps but want %d", fh.head, tc.wantHead)
+			}
+		})
+	}
+}
+
+func TestFileHeadTailIsBounded(t *testing.T) {
+	fh := &fileHead{}
+	for i := 0; i < maxCachedOps+10; i++ {
+		fh.append([]string{"op"})
+	}
+	if len(fh.tail) != maxCachedOps {
+		t.Errorf("tail has %d ops but want %d", len(fh.tail), maxCachedOps)
+	}
+	if fh.tailStart != 10 {
+		t.Errorf("tail starts at %d but want %d", fh.tailStart, 10)
+	}
+	if fh.head != maxCachedOps+10 {
+		t.Errorf("head is %d but want %d", fh.head, maxCachedOps+10)
+	}
+}
+
+func TestCommitOpsCatchesUpWithOtherServers(t *testing.T) {
+	// Another server committed "d" and "e" after this hub cached the head.
+	h := &Hub{db: &fakeDatastore{appendErr: storage.ErrOpIndexTaken, ops: []string{"d", "e"}, opsStart: 3}}
+	fh := &fileHead{snapshotIndex: -1, updateRequestedAt: -1}
+	fh.append([]string{"a", "b", "c"})
+
+	status, idx, ops, _ := h.commitOps(fh, 3, []string{"x"}, "writer")
+	if status != wscodes.StatusOperationTooOld || idx != 3 || !reflect.DeepEqual(ops, []string{"d", "e"}) {
+		t.Errorf("commitOps at a taken index gave %s, %d, %v but want %s, 3, [d e]",
+			status, idx, ops, wscodes.StatusOperationTooOld)
+	}
+	if fh.head != 5 {
+		t.Errorf("file head is %d after catching up but want 5", fh.head)
+	}
+}
+
+func TestSaveTurnsAwayOpsOnReplacedContents(t *testing.T) {
+	h := &Hub{db: &fakeDatastore{}}
+	fh := &fileHead{snapshotIndex: -1, updateRequestedAt: -1}
+	fh.append([]string{"a", "b", "c"})
+
+	if err := h.saveSnapshot(fh, "{}", "writer"); err != nil {
+		t.Fatal(err)
+	}
+	if fh.head != 4 || fh.snapshotIndex != 3 {
+		t.Errorf("saving gave head %d and snapshot index %d but want 4 and 3", fh.head, fh.snapshotIndex)
+	}
+	// A client that had every op before the save made its ops on the replaced contents.
+	status, idx, ops, _ := h.commitOps(fh, 3, []string{"x"}, "writer")
+	if status != wscodes.StatusFileReplaced || idx != 3 || len(ops) != 0 {
+		t.Errorf("commitOps on replaced contents gave %s, %d, %v but want %s, 3, []",
+			status, idx, ops, wscodes.StatusFileReplaced)
+	}
+	// The save marker is never given to clients catching up.
+	if status, _, _, _ := h.commitOps(fh, 1, []string{"x"}, "writer"); status != wscodes.StatusFileReplaced {
+		t.Errorf("catching up from before the save gave %s but want %s", status, wscodes.StatusFileReplaced)
+	}
+	if status, _, _, _ := h.commitOps(fh, 4, []string{"d"}, "writer"); status != wscodes.StatusOperationCommitted {
+		t.Errorf("commitOps on the saved contents gave %s but want %s", status, wscodes.StatusOperationCommitted)
+	}
+}
+
+func TestOpsSinceLeavesOutSaveMarker(t *testing.T) {
+	h := &Hub{db: &fakeDatastore{}}
+	fh := &fileHead{snapshotIndex: -1, updateRequestedAt: -1}
+	fh.append([]string{"a", "b", "c"})
+	if err := h.saveSnapshot(fh, "{}", "writer"); err != nil {
+		t.Fatal(err)
+	}
+	fh.append([]string{"d"})
+
+	for _, idx := range []int64{0, 3, 4} {
+		ops, start, err := h.opsSince(fh, idx)
+		if err != nil || start != 4 || !reflect.DeepEqual(ops, []string{"d"}) {
+			t.Errorf("opsSince(%d) gave %v, %d, %v but want [d], 4, nil", idx, ops, start, err)
+		}
+	}
+}
+
+func TestCommitOpsAfterAnotherServerSaved(t *testing.T) {
+	// Another server saved the file at index 4 and then committed "e"; the datastore leaves out
+	// the save marker and everything before it.
+	h := &Hub{db: &fakeDatastore{appendErr: storage.ErrOpIndexTaken, ops: []string{"e"}, opsStart: 5}}
+	fh := &fileHead{snapshotIndex: -1, updateRequestedAt: -1}
+	fh.append([]string{"a", "b", "c", "d"})
+
+	status, idx, ops, _ := h.commitOps(fh, 4, []string{"x"}, "writer")
+	if status != wscodes.StatusFileReplaced || idx != 4 || len(ops) != 0 {
+		t.Errorf("commitOps on replaced contents gave %s, %d, %v but want %s, 4, []",
+			status, idx, ops, wscodes.StatusFileReplaced)
+	}
+	if fh.head != 6 || fh.replacedBefore != 5 || fh.snapshotIndex != 4 {
+		t.Errorf("file head is %d, replaced before %d, snapshot at %d but want 6, 5 and 4",
+			fh.head, fh.replacedBefore, fh.snapshotIndex)
+	}
+}
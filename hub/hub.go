@@ -4,15 +4,22 @@
 package hub
 
 import (
+	"collabserver/apikeys"
 	log "collabserver/cloudlog"
 	"collabserver/collabauth"
 	"collabserver/collections"
+	"collabserver/hubcodes"
+	"collabserver/ratelimit"
 	"collabserver/storage"
+	wscodes "collabserver/websocketcodes"
 	"context"
 	"errors"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -22,12 +29,27 @@ const (
 	filesID       = "files"
 	opsID         = "operations"
 	usersToHubsID = "usersToHubs"
+	// The service accounts of a hub, keyed by account ID.
+	serviceAccountsID = "serviceAccounts"
+	// The custom roles of a hub, keyed by name.
+	rolesID = "roles"
+	// The invites of a hub, keyed by invite ID.
+	invitesID = "invites"
+	// The audit log of a hub, which is only ever added to.
+	auditID = "audit"
+	// The public links of a hub, keyed by link ID.
+	publicLinksID = "publicLinks"
 
 	// The number of seconds between each update message broadcast to clients.
 	updateInterval = 2
 	// The number of operations before a file state update Pub/Sub message is sent
 	// to our Cloud Function.
 	maxOpsBeforeUpdate = 500
+	// How long to wait on a hub to take a notification.
+	notifyTimeout = 5 * time.Second
+	// How long a hub stays open without clients, so that API requests in a row don't each open it
+	// again.
+	hubIdleTimeout = 30 * time.Second
 )
 
 var (
@@ -36,7 +58,7 @@ var (
 	// ErrorCollectionNotFound is given when there is an error while retrieving a Collection of a given
 	// id from a Document.
 	ErrorCollectionNotFound = errors.New("could not find the collection")
-	errUnauthorized         = errors.New("user not authorized to perform action")
+	errUnauthorized         = wscodes.NewError(wscodes.StatusEndpointUnauthorized, "user not authorized to perform action")
 )
 
 // Type definitions mostly to facilitate testing; can drop in a faked struct without relying on
@@ -47,7 +69,7 @@ type datastore interface {
 	AddEntry(collection *firestore.CollectionRef, id string, data interface{}) (*firestore.DocumentRef, error)
 	DocExists(docID string, collection *firestore.CollectionRef) (bool, *firestore.DocumentRef, error)
 	UpdateEntry(docRef *firestore.DocumentRef, path string, value interface{}) error
-	CommitOps(opsCollection *firestore.CollectionRef, idx int64, ops []string, committerID string) (string, int64, []string, string)
+	AppendOps(opsCollection *firestore.CollectionRef, idx int64, ops []string, committerID string) error
 	OpsForFile(opsCollection *firestore.CollectionRef, idx int64) ([]string, int64, error)
 	DeleteDocument(docRef *firestore.DocumentRef) error
 	CollectionForID(collectionID string, docRef *firestore.DocumentRef) *firestore.CollectionRef
@@ -55,8 +77,24 @@ type datastore interface {
 	AllFiles(collection *firestore.CollectionRef) ([]collections.FileInfo, error)
 	UserIDsForEmails(emails []string) (map[string]string, error)
 	EntryForFieldValue(collection *firestore.CollectionRef, fieldPath string, value, dataTo interface{}) (*firestore.DocumentRef, error)
+	EntryForRef(docRef *firestore.DocumentRef, dataTo interface{}) error
 	AllHubsForUser(userID string) []string
 	UpdateUsersHubList(userID, hubName, role string) error
+	AllServiceAccounts(collection *firestore.CollectionRef) ([]collections.ServiceAccount, error)
+	AllRoleDefinitions(collection *firestore.CollectionRef) ([]collections.RoleDefinition, error)
+	AllInvites(collection *firestore.CollectionRef) ([]collections.Invite, error)
+	AllPublicLinks(collection *firestore.CollectionRef) ([]collections.PublicLink, error)
+	RedeemInvite(docRef *firestore.DocumentRef, check func(invite *collections.Invite) error) (*collections.Invite, error)
+	UserEmails(userIDs []string) (map[string]string, error)
+	VerifiedEmail(userID string) (string, error)
+	SetPendingInvitation(invitation collections.PendingInvitation) error
+	DeletePendingInvitation(email, hubName string) (bool, error)
+	PendingInvitations(email string) ([]collections.PendingInvitation, error)
+	HubPendingInvitations(hubName string) ([]collections.PendingInvitation, error)
+	TransferOwnership(hubRef *firestore.DocumentRef, users *firestore.CollectionRef, ownerRole, formerRole string,
+		check func(transfer *collections.OwnershipTransfer, fromRole, toRole string) error) (*collections.OwnershipTransfer, string, error)
+	AllAuthEntries(collection *firestore.CollectionRef) ([]collections.AuthEntry, error)
+	AuditEntries(collection *firestore.CollectionRef, query collections.AuditQuery) ([]collections.AuditEntry, string, error)
 }
 
 // Hub maintains the set of active clients and send messages to the clients based on processor rules.
@@ -64,8 +102,12 @@ type Hub struct {
 	// Name of this hub
 	name string
 
-	// set to true if hub has been closed; can't be reused and needs to be disposed of.
-	isClosed bool
+	// Closed once the hub has closed; a closed hub can't be reused and needs to be disposed of.
+	done chan struct{}
+
+	// Fires once the hub has been without clients for idleTimeout, or is nil while it has some.
+	idle        <-chan time.Time
+	idleTimeout time.Duration
 
 	// Registered clients.
 	clients map[*Client]bool
@@ -79,16 +121,15 @@ type Hub struct {
 	// Unregister requests from clients.
 	unregister chan *Client
 
+	// Messages from outside of the hub to send to its clients.
+	notifications chan *Message
+
 	// Send the client through the chan on unregister to return it to the hub.Connector.
 	clientReturn map[*Client]chan *Client
 
 	// Send on the chan to stop client messages to this hub.
 	stopClientSend map[*Client]chan struct{}
 
-	// Send on this chan to stop the periodic broadcast messages to all clients of the hub;
-	// used on hub close.
-	stopPeriodicUpdates chan int
-
 	db datastore
 
 	// The DocumentRef that this hub is represented by in the datastore.
@@ -97,12 +138,44 @@ type Hub struct {
 	// An Authenticator instance for the hub's authentication collection.
 	auth collabauth.Authenticator
 
+	// Stops auth from listening for changes to the hub's roles; called on hub close.
+	stopWatchingAuth context.CancelFunc
+
 	// A collection of users with ids and roles, also used for authentication.
 	users *firestore.CollectionRef
 
 	// A collection of files that hold operations subcollections and file data.
 	files *firestore.CollectionRef
 
+	// A collection of the hub's service accounts, whose roles are kept in users like everyone else's.
+	serviceAccounts *firestore.CollectionRef
+
+	// A collection of the roles defined by the hub, in addition to the built-in ones.
+	roles *firestore.CollectionRef
+
+	// A collection of the invite links that let people join the hub.
+	invites *firestore.CollectionRef
+
+	// A collection of the hub's audit entries.
+	audit *firestore.CollectionRef
+
+	// A collection of the public links that let guests read the hub without signing in.
+	publicLinks *firestore.CollectionRef
+
+	// Guards guests, the connected guests' public links keyed by their user IDs. Periodic user
+	// list updates read it outside of Run.
+	guestsMu sync.Mutex
+	guests   map[string]*collections.PublicLink
+
+	// Rate limits of each endpoint across all clients of the hub.
+	limits *ratelimit.Limiter
+
+	// Cached heads of the files that have been accessed, keyed by file name.
+	fileHeads map[string]*fileHead
+	// Access lists of files whose heads aren't cached, keyed by file name, so that broadcasts
+	// about them can be filtered without loading their heads.
+	fileACLs map[string][]collections.FileACLEntry
+
 	// A top level collection of our database; used for quickly obtaining the hubs that a given
 	// user can access.
 	masterUsersList *firestore.CollectionRef
@@ -111,6 +184,8 @@ type Hub struct {
 // hubRef defines what a hub entry looks like in the hubs collection.
 type hubRef struct {
 	name string
+	// OwnershipTransfer is the transfer waiting for its new owner to accept it, if any.
+	OwnershipTransfer *collections.OwnershipTransfer `firestore:"ownershipTransfer,omitempty"`
 }
 
 // CreateOrRetrieveHub attempts to fetch the hub from the db, and creates a new one
@@ -134,9 +209,17 @@ func newHub(hubName, userID string, hubs *firestore.CollectionRef) (*Hub, error)
 			// Some unknown, unhandled error; DocExists silences the NotFound error.
 			return nil, err
 		}
+		// Service accounts belong to a single hub, so they can't make new ones.
+		if apikeys.IsServiceAccount(userID) {
+			return nil, errUnauthorized
+		}
 		// At this point Create should work (or at least not fail due to Doc already existing),
 		// but it's possible there might be some connection error or something.
 		err = createHubWithOwner(docRef, hubName, userID)
+		if status.Code(err) == codes.AlreadyExists {
+			// Someone else made the hub in the meantime, so it's opened like any existing hub.
+			err = nil
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -170,6 +253,13 @@ func createHubWithOwner(docRef *firestore.DocumentRef, hubName, ownerID string)
 		Hub:    hubName,
 		Role:   collabauth.Owner,
 	})
+	if err == nil {
+		recordAudit(storage.DB, docRef, collections.AuditEntry{
+			Actor:  ownerID,
+			Action: hubcodes.AuditHubCreated,
+			Target: hubName,
+		})
+	}
 
 	return err
 }
@@ -188,18 +278,28 @@ func (h *Hub) init() error {
 		log.Printf("Could not get files collection for hub %s", h.name)
 		return ErrorCollectionNotFound
 	}
-	h.auth = collabauth.CurrentAuthenticator(authCollection)
+	h.roles = h.ref.Collection(rolesID)
+	h.auth = collabauth.CurrentAuthenticator(authCollection, h.roles)
 	h.users = authCollection
 	h.files = fileCollection
+	h.serviceAccounts = h.ref.Collection(serviceAccountsID)
+	h.invites = h.ref.Collection(invitesID)
+	h.audit = h.ref.Collection(auditID)
+	h.publicLinks = h.ref.Collection(publicLinksID)
+	h.guests = make(map[string]*collections.PublicLink)
+	h.fileHeads = make(map[string]*fileHead)
+	h.fileACLs = make(map[string][]collections.FileACLEntry)
+	h.limits = ratelimit.NewLimiter()
 	h.inbound = make(chan *Message)
 	h.register = make(chan *Client)
 	h.unregister = make(chan *Client)
+	h.notifications = make(chan *Message)
 	h.clients = make(map[*Client]bool)
 	h.stopClientSend = make(map[*Client]chan struct{})
 
 	h.clientReturn = make(map[*Client]chan *Client)
-
-	go h.startPeriodicUpdates()
+	h.done = make(chan struct{})
+	h.idleTimeout = hubIdleTimeout
 
 	return nil
 }
@@ -207,73 +307,133 @@ func (h *Hub) init() error {
 // Run starts the hub and listens on all channels for messages.
 func (h *Hub) Run() {
 	log.Printf("start hub: %s", h.name)
+	// Nothing is started before Run, so that a hub that's never run needs no cleaning up.
+	go h.startPeriodicUpdates()
+	// Close the hub if no client ever comes.
+	h.idle = time.After(h.idleTimeout)
 	for {
 		select {
-		case client, ok := <-h.register:
-			if !ok {
-				return
-			}
-
+		case client := <-h.register:
+			h.idle = nil
+			h.clientReturn[client] = client.returnTo
 			// Set up for if the client disconnects from the hub.
 			h.stopClientSend[client] = make(chan struct{})
 			client.assignChans(h.inbound, h.stopClientSend[client])
+			if client.IsClosed() {
+				// Its connection ended while it was being handed over, too late to tell the hub.
+				h.unregisterClient(client)
+				break
+			}
 			// The minimum permissions for hub access is read access.
-			if err := h.ConnectUser(client.userID); err != nil {
+			var err error
+			switch {
+			case client.guest != nil:
+				err = h.admitGuest(client)
+			case client.session:
+				// Sessions only last a request, so they don't mark the user as viewing the hub.
+				if ok, _ := h.auth.Can(client.userID, collabauth.FileRead); !ok {
+					err = errUnauthorized
+				}
+			default:
+				err = h.ConnectUser(client.userID)
+			}
+			if err != nil {
 				log.Printf("User %s does not have permission to access hub %s: %v", client.userID, h.name, err)
+				// Answer the connect request so the client isn't left waiting on it.
+				client.reply(toOriginWithError(&Message{UID: client.connectRequestUID, Endpoint: endpointConnectToHub}, err))
 				h.unregisterClient(client)
 				break
 			}
+			if client.guest == nil {
+				if role, err := h.auth.UserRole(client.userID); err == nil {
+					client.setRole(role)
+				}
+			}
 			h.clients[client] = true
-			h.sendMessage(client, h.hubConnectSuccessMessage(client))
-		case client, ok := <-h.unregister:
-			if !ok {
-				return
+			// Only members connecting count; sessions come and go with every REST request. The
+			// entry is written in the background so that it doesn't hold up the hub.
+			if client.guest == nil && !client.session {
+				go h.recordAudit(client.userID, hubcodes.AuditHubConnected, "", "", "")
+				h.watchAuth()
 			}
+			h.sendMessage(client, h.hubConnectSuccessMessage(client))
+		case client := <-h.unregister:
 			log.Print("returning client to connector")
 			if _, ok := h.clients[client]; ok {
 				h.unregisterClient(client)
 			}
-		case message, ok := <-h.inbound:
+		case message := <-h.inbound:
 			// Auth check is in processMessage.
-			if !ok {
-				return
-			}
 			retMessage := h.processMessage(message)
-			h.handleSendMessage(retMessage, message.client)
+			h.handleSendMessage(retMessage, message)
+		case message := <-h.notifications:
+			h.handleSendMessage(message, nil)
+		case <-h.idle:
+			h.closeHub()
+			return
 		}
 	}
 }
 
-func (h *Hub) registerClient(client *Client, returnClient chan *Client) {
-	if h.IsClosed() {
+// registerClient hands the client to the hub, reporting whether the hub took it; hubs that have
+// closed don't. request is the client's message asking to join it, and the hub sends the client
+// back through returnClient when it leaves.
+func (h *Hub) registerClient(client *Client, returnClient chan *Client, request *Message) bool {
+	log.Printf("registering client of user %s to hub: %s", client.userID, h.name)
+	client.returnTo = returnClient
+	client.connectRequestUID = request.UID
+	select {
+	case h.register <- client:
+		return true
+	case <-h.done:
 		log.Print("register client failed because hub is closed")
-		return
+		return false
 	}
-	log.Printf("registering client: %#v to hub: %#v", client, h)
-	h.clientReturn[client] = returnClient
-	h.register <- client
 }
 
 func (h *Hub) unregisterClient(client *Client) {
-	h.DisconnectUser(client.userID)
+	if client.guest != nil {
+		h.removeGuest(client.userID)
+	} else if !client.session {
+		h.DisconnectUser(client.userID)
+	}
+	client.logUnacked(h.name)
+	client.setRole("")
 	h.clientReturn[client] <- client
 	delete(h.clientReturn, client)
 	h.removeClient(client)
 }
 
-// determines where to send the message based on message.Route
-func (h *Hub) handleSendMessage(message *Message, origin *Client) {
+// determines where to send the message based on message.Route. request is the message being
+// replied to, or nil if the message isn't a reply; whatever is sent to its sender is marked as a reply.
+func (h *Hub) handleSendMessage(message *Message, request *Message) {
 	if message == nil {
 		// No op
 		return
 	}
+	var origin *Client
+	if request != nil {
+		origin = request.client
+	}
 	if len(message.Route) > 0 {
 		if message.Route[0] == routeBroadcast {
 			for client := range h.clients {
-				h.sendMessage(client, message)
+				// Broadcasts about a file only go to those who can read it.
+				if message.File != "" && !h.canReadFile(client, message.File) {
+					continue
+				}
+				// Guests only hear about files, and who else is in the hub.
+				if message.File == "" && client.guest != nil && message.Endpoint != endpointListUsers {
+					continue
+				}
+				if client == origin {
+					h.sendMessage(client, asReplyTo(message, request))
+				} else {
+					h.sendMessage(client, message)
+				}
 			}
 		} else if message.Route[0] == routeOrigin {
-			h.sendMessage(origin, message)
+			h.sendMessage(origin, asReplyTo(message, request))
 		} else {
 			routes := make(map[string]bool)
 			for _, dest := range message.Route {
@@ -305,13 +465,12 @@ func (h *Hub) sendMessage(client *Client, message *Message) {
 }
 
 // startPeriodicUpdates currently sends a list of all users in this hub to all
-// connected clients.
+// connected clients, until the hub closes.
 // There are some periodic updates like the hub's file list that are polled for on the client side
 // due to how JupyterLab polls for directory contents.
 func (h *Hub) startPeriodicUpdates() {
 	ticker := time.NewTicker(updateInterval * time.Second)
-	// for closing the goroutine.
-	h.stopPeriodicUpdates = make(chan int)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
@@ -328,8 +487,9 @@ func (h *Hub) startPeriodicUpdates() {
 				UserList: users,
 			}
 
-			h.handleSendMessage(message, nil)
-		case <-h.stopPeriodicUpdates:
+			// The clients are only touched in Run, so the hub sends the update from there.
+			h.notify(message)
+		case <-h.done:
 			return
 		}
 	}
@@ -338,7 +498,23 @@ func (h *Hub) startPeriodicUpdates() {
 // IsClosed determines if a hub has been closed or not. Useful for maintaining a list of hubs
 // that may or may not need to be closed as needed.
 func (h *Hub) IsClosed() bool {
-	return h.isClosed
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// notify has the hub send the message to its clients, giving up if the hub doesn't take it in time,
+// such as when it has closed.
+func (h *Hub) notify(message *Message) {
+	select {
+	case h.notifications <- message:
+	case <-h.done:
+	case <-time.After(notifyTimeout):
+		log.Printf("Hub %s didn't take a %s notification", h.name, message.Endpoint)
+	}
 }
 
 // hands the client back to the hub connector.
@@ -351,22 +527,28 @@ func (h *Hub) removeClient(client *Client) {
 	delete(h.stopClientSend, client)
 	delete(h.clients, client)
 	if len(h.clients) == 0 {
-		h.closeHub()
+		h.idle = time.After(h.idleTimeout)
+	}
+}
+
+// watchAuth starts listening for changes to the hub's roles, unless it already has. It's left until
+// a member connects, since the listeners are only worth their cost for hubs that stay open a while,
+// and hubs that only ever serve sessions are closed again soon after.
+func (h *Hub) watchAuth() {
+	if h.stopWatchingAuth != nil {
+		return
 	}
+	var watchCtx context.Context
+	watchCtx, h.stopWatchingAuth = context.WithCancel(context.Background())
+	collabauth.Watch(watchCtx, h.auth)
 }
 
+// closeHub stops the hub, which Run only does once it has had no clients for idleTimeout.
+// Channels that others send on aren't closed; senders select on done instead.
 func (h *Hub) closeHub() {
-	for client := range h.clients {
-		h.unregisterClient(client)
+	close(h.done)
+	if h.stopWatchingAuth != nil {
+		h.stopWatchingAuth()
 	}
-	close(h.register)
-	close(h.unregister)
-	close(h.inbound)
-	go func() {
-		// This can hang depending on where in the call stack closeHub is called.
-		// Doing this in a goroutine means functions can resolve and avoid the hang.
-		h.stopPeriodicUpdates <- 0
-	}()
-	h.isClosed = true
 	log.Printf("close hub: %s", h.name)
 }
@@ -1,16 +1,31 @@
 package hub
 
 import (
+	"collabserver/collabauth"
 	"collabserver/collections"
 	testutils "collabserver/testing"
+	wscodes "collabserver/websocketcodes"
 	"context"
 	"testing"
+	"time"
 
 	"cloud.google.com/go/firestore"
 )
 
 type fakeDatastore struct {
 	connectUserResult bool
+	authEntries       []collections.AuthEntry
+	// The last query AuditEntries was called with.
+	auditQuery collections.AuditQuery
+	// Given by AppendOps if set, and the ops OpsForFile gives from index opsStart.
+	appendErr error
+	ops       []string
+	opsStart  int64
+	// Given by AllInvites and HubPendingInvitations.
+	invites            []collections.Invite
+	pendingInvitations []collections.PendingInvitation
+	// Given by VerifiedEmail.
+	verifiedEmail string
 }
 
 func (fd *fakeDatastore) AddEntry(collection *firestore.CollectionRef, id string, data interface{}) (*firestore.DocumentRef, error) {
@@ -23,8 +38,8 @@ func (fd *fakeDatastore) DocExists(docID string, collection *firestore.Collectio
 func (fd *fakeDatastore) UpdateEntry(docRef *firestore.DocumentRef, path string, value interface{}) error {
 	return nil
 }
-func (fd *fakeDatastore) CommitOps(opsCollection *firestore.CollectionRef, idx int64, ops []string, committerID string) (string, int64, []string, string) {
-	return "", 0, nil, ""
+func (fd *fakeDatastore) AppendOps(opsCollection *firestore.CollectionRef, idx int64, ops []string, committerID string) error {
+	return fd.appendErr
 }
 func (fd *fakeDatastore) CollectionForID(collectionID string, docRef *firestore.DocumentRef) *firestore.CollectionRef {
 	return nil
@@ -42,6 +57,10 @@ func (fd *fakeDatastore) EntryForFieldValue(collection *firestore.CollectionRef,
 	return nil, nil
 }
 
+func (fd *fakeDatastore) EntryForRef(docRef *firestore.DocumentRef, dataTo interface{}) error {
+	return nil
+}
+
 func (fd *fakeDatastore) UserIDsForEmails(emails []string) (map[string]string, error) {
 	return nil, nil
 }
@@ -58,8 +77,270 @@ func (fd *fakeDatastore) UpdateUsersHubList(userID, hubName, role string) error
 	return nil
 }
 
+func (fd *fakeDatastore) AllServiceAccounts(collection *firestore.CollectionRef) ([]collections.ServiceAccount, error) {
+	return nil, nil
+}
+
+func (fd *fakeDatastore) AllRoleDefinitions(collection *firestore.CollectionRef) ([]collections.RoleDefinition, error) {
+	return nil, nil
+}
+
+func (fd *fakeDatastore) AllInvites(collection *firestore.CollectionRef) ([]collections.Invite, error) {
+	return fd.invites, nil
+}
+
+func (fd *fakeDatastore) AllPublicLinks(collection *firestore.CollectionRef) ([]collections.PublicLink, error) {
+	return nil, nil
+}
+
+func (fd *fakeDatastore) RedeemInvite(docRef *firestore.DocumentRef, check func(invite *collections.Invite) error) (*collections.Invite, error) {
+	return nil, nil
+}
+
+func (fd *fakeDatastore) UserEmails(userIDs []string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (fd *fakeDatastore) TransferOwnership(hubRef *firestore.DocumentRef, users *firestore.CollectionRef, ownerRole, formerRole string,
+	check func(transfer *collections.OwnershipTransfer, fromRole, toRole string) error) (*collections.OwnershipTransfer, string, error) {
+	return nil, "", nil
+}
+
+func (fd *fakeDatastore) VerifiedEmail(userID string) (string, error) {
+	return fd.verifiedEmail, nil
+}
+
+func (fd *fakeDatastore) SetPendingInvitation(invitation collections.PendingInvitation) error {
+	return nil
+}
+
+func (fd *fakeDatastore) DeletePendingInvitation(email, hubName string) (bool, error) {
+	return false, nil
+}
+
+func (fd *fakeDatastore) PendingInvitations(email string) ([]collections.PendingInvitation, error) {
+	return nil, nil
+}
+
+func (fd *fakeDatastore) HubPendingInvitations(hubName string) ([]collections.PendingInvitation, error) {
+	return fd.pendingInvitations, nil
+}
+
+func (fd *fakeDatastore) AllAuthEntries(collection *firestore.CollectionRef) ([]collections.AuthEntry, error) {
+	return fd.authEntries, nil
+}
+
+func (fd *fakeDatastore) AuditEntries(collection *firestore.CollectionRef, query collections.AuditQuery) ([]collections.AuditEntry, string, error) {
+	fd.auditQuery = query
+	return nil, "", nil
+}
+
 func (fd *fakeDatastore) OpsForFile(opsCollection *firestore.CollectionRef, idx int64) ([]string, int64, error) {
-	return nil, 0, nil
+	if fd.ops == nil {
+		return nil, 0, nil
+	}
+	return fd.ops, fd.opsStart, nil
+}
+
+// fakeAuthenticator gives users the built-in roles in roles, or the custom ones in customRoles.
+type fakeAuthenticator struct {
+	roles       map[string]string
+	customRoles map[string][]string
+	// The users whose roles were forgotten, in order.
+	forgotten []string
+}
+
+func (fa *fakeAuthenticator) Can(userID, permission string) (bool, *firestore.DocumentRef) {
+	permissions, _ := fa.UserPermissions(userID)
+	return collabauth.HasPermission(permissions, permission), nil
+}
+
+func (fa *fakeAuthenticator) UserRole(userID string) (string, error) {
+	if role, ok := fa.roles[userID]; ok {
+		return role, nil
+	}
+	return collabauth.NoRole, ErrorEntryNotFound
+}
+
+func (fa *fakeAuthenticator) UserPermissions(userID string) ([]string, error) {
+	role, err := fa.UserRole(userID)
+	if err != nil {
+		return nil, err
+	}
+	return fa.RolePermissions(role)
+}
+
+func (fa *fakeAuthenticator) RolePermissions(role string) ([]string, error) {
+	if role == collabauth.NoRole {
+		return []string{}, nil
+	}
+	if permissions, ok := fa.customRoles[role]; ok {
+		return permissions, nil
+	}
+	if !collabauth.IsBuiltinRole(role) {
+		return nil, ErrorEntryNotFound
+	}
+	return collabauth.BuiltinRolePermissions(role), nil
+}
+
+func (fa *fakeAuthenticator) Forget(userID string) {
+	fa.forgotten = append(fa.forgotten, userID)
+}
+
+func TestHubStaysOpenUntilIdle(t *testing.T) {
+	h := &Hub{name: "IDLE", ref: (&firestore.Client{}).Collection(hubsID).Doc("IDLE")}
+	if err := h.init(); err != nil {
+		t.Fatal(err)
+	}
+	h.db = &fakeDatastore{}
+	h.auth = &fakeAuthenticator{roles: map[string]string{"owner": collabauth.Owner}}
+	h.idleTimeout = 50 * time.Millisecond
+	go h.Run()
+
+	for i := 0; i < 2; i++ {
+		client := NewClient("owner", nil)
+		returned := make(chan *Client, 1)
+		if !h.registerClient(client, returned, &Message{UID: "connect"}) {
+			t.Fatalf("the hub didn't take client %d", i)
+		}
+		if reply := <-client.send; reply.Endpoint != endpointConnectToHub || reply.Error != nil {
+			t.Fatalf("client %d got %+v but want a successful %s reply", i, reply, endpointConnectToHub)
+		}
+		go h.handBackClient(client)
+		<-returned
+		// Requests one after another use the same hub instead of opening it each time.
+		if h.IsClosed() {
+			t.Fatalf("the hub closed as soon as client %d left", i)
+		}
+	}
+
+	select {
+	case <-h.done:
+	case <-time.After(time.Second):
+		t.Fatal("the hub didn't close after being left without clients")
+	}
+	if h.registerClient(NewClient("owner", nil), make(chan *Client, 1), &Message{}) {
+		t.Error("a closed hub took a client")
+	}
+}
+
+func TestFileBroadcastsFollowACL(t *testing.T) {
+	teacher := &Client{userID: "teacher", role: collabauth.Owner, send: make(chan *Message, 1)}
+	student := &Client{userID: "student", role: collabauth.Viewer, send: make(chan *Message, 1)}
+	ta := &Client{userID: "ta", role: collabauth.Viewer, send: make(chan *Message, 1)}
+	h := &Hub{
+		clients: map[*Client]bool{teacher: true, student: true, ta: true},
+		auth: &fakeAuthenticator{roles: map[string]string{
+			"teacher": collabauth.Owner,
+			"student": collabauth.Viewer,
+			"ta":      collabauth.Viewer,
+		}},
+		fileHeads: map[string]*fileHead{
+			"answers.ipynb": {acl: []collections.FileACLEntry{
+				{HubRole: collabauth.Viewer, Role: collabauth.NoRole},
+				{UserID: "ta", Role: collabauth.Writer},
+			}},
+		},
+	}
+
+	h.handleSendMessage(&Message{File: "answers.ipynb", Route: []string{routeBroadcast}}, nil)
+	if len(student.send) != 0 {
+		t.Error("a client hidden from the file got a broadcast about it")
+	}
+	if len(teacher.send) != 1 || len(ta.send) != 1 {
+		t.Error("clients that can read the file didn't get a broadcast about it")
+	}
+
+	if err := h.checkFileAccess("student", "answers.ipynb", h.fileHeads["answers.ipynb"].acl, collabauth.FileRead); wscodes.AsError(err).Code != wscodes.StatusFileDoesntExist {
+		t.Errorf("checkFileAccess for a hidden file gave %v but want %s", err, wscodes.StatusFileDoesntExist)
+	}
+	if err := h.checkFileAccess("ta", "answers.ipynb", h.fileHeads["answers.ipynb"].acl, collabauth.FileEdit); err != nil {
+		t.Errorf("checkFileAccess for a file the user was made a writer of gave %v", err)
+	}
+}
+
+func TestRoleChangeReachesConnectedClients(t *testing.T) {
+	owner := &Client{userID: "owner", role: collabauth.Owner, send: make(chan *Message, 1)}
+	writer := &Client{userID: "writer", role: collabauth.Writer, send: make(chan *Message, 1)}
+	removed := &Client{userID: "removed", role: collabauth.Writer, send: make(chan *Message, 1)}
+	returned := make(chan *Client, 1)
+	h := &Hub{
+		db:      &fakeDatastore{},
+		clients: map[*Client]bool{owner: true, writer: true, removed: true},
+		auth:    &fakeAuthenticator{},
+		clientReturn: map[*Client]chan *Client{
+			owner: make(chan *Client, 1), writer: make(chan *Client, 1), removed: returned,
+		},
+		stopClientSend: map[*Client]chan struct{}{
+			owner: make(chan struct{}), writer: make(chan struct{}), removed: make(chan struct{}),
+		},
+	}
+
+	h.applyRoleChange("writer", collabauth.Viewer)
+	if forgotten := h.auth.(*fakeAuthenticator).forgotten; len(forgotten) != 1 || forgotten[0] != "writer" {
+		t.Errorf("the hub forgot the roles of %v but want [writer]", forgotten)
+	}
+	if len(writer.send) != 1 {
+		t.Fatal("a downgraded client wasn't told of its new role")
+	}
+	message := <-writer.send
+	if message.Endpoint != endpointRoleChanged || message.ModifyUserRole != collabauth.Viewer ||
+		collabauth.HasPermission(message.Permissions, collabauth.FileEdit) {
+		t.Errorf("a downgraded client got %+v but want a ROLE_CHANGED message for %s", message, collabauth.Viewer)
+	}
+	if !h.clients[writer] || writer.getRole() != collabauth.Viewer {
+		t.Error("a downgraded client that can still read the hub wasn't kept with its new role")
+	}
+	if len(owner.send) != 0 {
+		t.Error("a client whose role didn't change was told of a role change")
+	}
+
+	h.applyRoleChange("removed", collabauth.NoRole)
+	if h.clients[removed] {
+		t.Error("a client that can no longer read the hub is still in it")
+	}
+	select {
+	case client := <-returned:
+		if client != removed {
+			t.Errorf("the hub handed back %v but want the removed client", client)
+		}
+	default:
+		t.Error("a client that can no longer read the hub wasn't handed back to the connector")
+	}
+}
+
+func TestACLChangeDropsClientsThatLoseTheFile(t *testing.T) {
+	ta := &Client{userID: "ta", role: collabauth.Viewer, send: make(chan *Message, 1)}
+	student := &Client{userID: "student", role: collabauth.Viewer, send: make(chan *Message, 1)}
+	returned := make(chan *Client, 1)
+	h := &Hub{
+		db:      &fakeDatastore{},
+		clients: map[*Client]bool{ta: true, student: true},
+		auth:    &fakeAuthenticator{},
+		clientReturn: map[*Client]chan *Client{
+			ta: make(chan *Client, 1), student: returned,
+		},
+		stopClientSend: map[*Client]chan struct{}{
+			ta: make(chan struct{}), student: make(chan struct{}),
+		},
+	}
+
+	h.dropFileReaders("answers.ipynb", nil, []collections.FileACLEntry{
+		{HubRole: collabauth.Viewer, Role: collabauth.NoRole},
+		{UserID: "ta", Role: collabauth.Writer},
+	})
+	if !h.clients[ta] || len(ta.send) != 0 {
+		t.Error("a client that can still read the file was told it's gone or disconnected")
+	}
+	if len(student.send) != 1 {
+		t.Fatal("a client that can no longer read the file wasn't told it's gone")
+	}
+	if message := <-student.send; message.Endpoint != endpointFileDelete || message.File != "answers.ipynb" {
+		t.Errorf("a client that can no longer read the file got %+v but want a %s message for it", message, endpointFileDelete)
+	}
+	if h.clients[student] || len(returned) != 1 {
+		t.Error("a client that can no longer read the file wasn't disconnected")
+	}
 }
 
 func fakeProcessMessage(message *Message) *Message {
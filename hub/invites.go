@@ -0,0 +1,244 @@
+package hub
+
+import (
+	"collabserver/apikeys"
+	log "collabserver/cloudlog"
+	"collabserver/collabauth"
+	"collabserver/collections"
+	"collabserver/hubcodes"
+	wscodes "collabserver/websocketcodes"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// How long invites last when their creator doesn't say.
+	defaultInviteLifetime = 7 * 24 * time.Hour
+	// Invites can't last longer than this, so that a forgotten link stops working eventually.
+	maxInviteLifetime = 90 * 24 * time.Hour
+
+	inviteIDBytes = 8
+)
+
+var (
+	errInviteInvalid = wscodes.NewError(wscodes.StatusInviteInvalid, "invite is invalid")
+
+	// The reasons an invite can't be used.
+	errInviteRevoked     = errors.New("revoked")
+	errInviteExpired     = errors.New("expired")
+	errInviteUsedUp      = errors.New("used up")
+	errInviteEmailDomain = errors.New("email domain not allowed")
+)
+
+// handleInvites lists, creates or revokes the hub's invites, which needs the MembersInvite permission.
+func (h *Hub) handleInvites(message *Message) *Message {
+	if ok, _ := h.auth.Can(message.client.userID, collabauth.MembersInvite); !ok {
+		return toOriginWithError(message, errUnauthorized)
+	}
+	if message.InviteAction == inviteList {
+		invites, err := h.db.AllInvites(h.invites)
+		if err != nil {
+			return toOriginWithError(message, err)
+		}
+		returnMessage := toOriginWithStatus(message, wscodes.StatusSuccess, "")
+		returnMessage.Invites = invites
+		return returnMessage
+	}
+	if message.Invite == nil {
+		return toOriginWithError(message, wscodes.NewError(wscodes.StatusInvalidRequest, "invite not given"))
+	}
+	var invite *collections.Invite
+	var err error
+	switch message.InviteAction {
+	case inviteCreate:
+		invite, err = h.createInvite(*message.Invite, message.client.userID)
+	case inviteRevoke:
+		invite, err = h.revokeInvite(message.Invite.ID)
+	default:
+		err = wscodes.NewError(wscodes.StatusInvalidRequest, "unknown invite action").
+			WithDetail("inviteAction", message.InviteAction)
+	}
+	if err != nil {
+		return toOriginWithError(message, err)
+	}
+	action := hubcodes.AuditInviteCreated
+	if message.InviteAction == inviteRevoke {
+		action = hubcodes.AuditInviteRevoked
+	}
+	h.recordAudit(message.client.userID, action, invite.ID, "", invite.Role)
+	returnMessage := toOriginWithStatus(message, wscodes.StatusOperationCommitted, "")
+	returnMessage.Invite = invite
+	return returnMessage
+}
+
+// createInvite adds an invite like the one requested to the hub, giving it along with its token. The
+// creator must have every permission of the invite's role, like when adding a user directly.
+func (h *Hub) createInvite(requested collections.Invite, creator string) (*collections.Invite, error) {
+	if requested.Role == collabauth.NoRole || requested.MaxUses < 0 {
+		return nil, wscodes.NewError(wscodes.StatusInvalidRequest, "invites need a role and a max use count of 0 or more")
+	}
+	rolePermissions, err := h.auth.RolePermissions(requested.Role)
+	if err != nil {
+		return nil, err
+	}
+	creatorPermissions, err := h.auth.UserPermissions(creator)
+	if err != nil || !collabauth.HasAllPermissions(creatorPermissions, rolePermissions) {
+		return nil, errUnauthorized
+	}
+	now := time.Now()
+	expiresAt := requested.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(defaultInviteLifetime)
+	}
+	if !expiresAt.After(now) || expiresAt.Sub(now) > maxInviteLifetime {
+		return nil, wscodes.NewError(wscodes.StatusInvalidRequest, "invites must expire within 90 days").
+			WithDetail("expiresAt", expiresAt.Format(time.RFC3339))
+	}
+	id, err := apikeys.RandomHex(inviteIDBytes)
+	if err != nil {
+		return nil, err
+	}
+	token, hash, err := newHubToken(h.name, id)
+	if err != nil {
+		return nil, err
+	}
+	invite := collections.Invite{
+		ID:          id,
+		Role:        requested.Role,
+		ExpiresAt:   expiresAt,
+		MaxUses:     requested.MaxUses,
+		EmailDomain: strings.ToLower(strings.TrimPrefix(requested.EmailDomain, "@")),
+		TokenHash:   hash,
+		Created:     now,
+		CreatedBy:   creator,
+	}
+	if _, err := h.db.AddEntry(h.invites, id, invite); err != nil {
+		return nil, err
+	}
+	log.Printf("Created invite %s to hub %s as %s, requested by %s", id, h.name, invite.Role, creator)
+	invite.Token = token
+	return &invite, nil
+}
+
+// revokeInvite stops the invite from letting anyone else join. Users who already joined with it stay.
+func (h *Hub) revokeInvite(id string) (*collections.Invite, error) {
+	notFound := wscodes.NewError(wscodes.StatusInviteDoesntExist, "invite doesn't exist").WithDetail("id", id)
+	if id == "" {
+		return nil, notFound
+	}
+	exists, ref, err := h.db.DocExists(id, h.invites)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, notFound
+	}
+	invite := &collections.Invite{}
+	if err := h.db.EntryForRef(ref, invite); err != nil {
+		return nil, err
+	}
+	if err := h.db.UpdateEntry(ref, hubcodes.InviteRevokedKey, true); err != nil {
+		return nil, err
+	}
+	invite.ID = id
+	invite.Revoked = true
+	return invite, nil
+}
+
+// JoinHubWithInvite makes the user a member of the invite's hub with the invite's role, giving the
+// hub's name. Users who are already members keep their role, and don't use the invite up.
+func (hc *Connector) JoinHubWithInvite(userID, token string) (string, error) {
+	// Service accounts belong to the hub they were made in.
+	if apikeys.IsServiceAccount(userID) {
+		return "", errUnauthorized
+	}
+	hubName, inviteID, secret, err := parseHubToken(token)
+	if err != nil {
+		return "", errInviteInvalid
+	}
+	exists, hubRef, err := hc.db.DocExists(hubName, hc.db.CollectionForID(hubsID, nil))
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errInviteInvalid
+	}
+	email := ""
+	check := func(invite *collections.Invite) error {
+		if !apikeys.Matches(secret, invite.TokenHash) {
+			return errInviteInvalid
+		}
+		if err := checkInvite(invite, email, time.Now()); err != nil {
+			return errInviteInvalid.WithDetail("reason", err.Error())
+		}
+		return nil
+	}
+	inviteRef := hubRef.Collection(invitesID).Doc(inviteID)
+	invite := &collections.Invite{}
+	if err := hc.db.EntryForRef(inviteRef, invite); err != nil {
+		return "", errInviteInvalid
+	}
+	if invite.EmailDomain != "" {
+		// Anyone can sign up with an email they don't own, so only verified ones count.
+		email, err = hc.db.VerifiedEmail(userID)
+		if err != nil {
+			return "", err
+		}
+	}
+	// Members need a valid invite too, so that tokens can't be used to find out who is a member.
+	if err := check(invite); err != nil {
+		return "", err
+	}
+	users := hubRef.Collection(authID)
+	authEntry := &collections.AuthEntry{}
+	memberRef, _ := hc.db.EntryForFieldValue(users, hubcodes.UserIDKey, userID, authEntry)
+	if memberRef != nil && authEntry.Role != collabauth.NoRole {
+		return hubName, nil
+	}
+	// The role may have been deleted since the invite was made.
+	auth := collabauth.CurrentAuthenticator(users, hubRef.Collection(rolesID))
+	if _, err := auth.RolePermissions(invite.Role); err != nil {
+		return "", errInviteInvalid.WithDetail("reason", "role no longer exists")
+	}
+	invite, err = hc.db.RedeemInvite(inviteRef, check)
+	if err != nil {
+		return "", err
+	}
+	if err := setMemberRole(hc.db, users, hubName, userID, invite.Role, memberRef); err != nil {
+		return "", err
+	}
+	// The open hub may remember the user as not being a member.
+	hc.forgetRole(hubName, userID)
+	recordAudit(hc.db, hubRef, collections.AuditEntry{
+		Actor:   userID,
+		Action:  hubcodes.AuditMemberAdded,
+		Target:  userID,
+		Before:  collabauth.NoRole,
+		After:   invite.Role,
+		Details: map[string]string{"invite": inviteID},
+	})
+	log.Printf("User %s joined hub %s as %s with invite %s", userID, hubName, invite.Role, inviteID)
+	return hubName, nil
+}
+
+// checkInvite reports why the invite can't be used at the time by the user with the email, if it can't.
+func checkInvite(invite *collections.Invite, email string, now time.Time) error {
+	switch {
+	case invite.Revoked:
+		return errInviteRevoked
+	case !now.Before(invite.ExpiresAt):
+		return errInviteExpired
+	case invite.MaxUses > 0 && invite.Uses >= invite.MaxUses:
+		return errInviteUsedUp
+	case invite.EmailDomain != "" && !hasEmailDomain(email, invite.EmailDomain):
+		return errInviteEmailDomain
+	}
+	return nil
+}
+
+// hasEmailDomain reports whether the email address is at the domain, ignoring case.
+func hasEmailDomain(email, domain string) bool {
+	i := strings.LastIndex(email, "@")
+	return i >= 0 && strings.EqualFold(email[i+1:], domain)
+}
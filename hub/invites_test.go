@@ -0,0 +1,75 @@
+package hub
+
+import (
+	"collabserver/collabauth"
+	"collabserver/collections"
+	wscodes "collabserver/websocketcodes"
+	"testing"
+	"time"
+)
+
+func TestCheckInvite(t *testing.T) {
+	now := time.Now()
+	valid := collections.Invite{ExpiresAt: now.Add(time.Hour), MaxUses: 2, Uses: 1, EmailDomain: "example.com"}
+	tests := []struct {
+		name  string
+		edit  func(invite *collections.Invite)
+		email string
+		want  error
+	}{
+		{"valid", func(*collections.Invite) {}, "ada@Example.com", nil},
+		{"revoked", func(i *collections.Invite) { i.Revoked = true }, "ada@example.com", errInviteRevoked},
+		{"expired", func(i *collections.Invite) { i.ExpiresAt = now }, "ada@example.com", errInviteExpired},
+		{"used up", func(i *collections.Invite) { i.Uses = 2 }, "ada@example.com", errInviteUsedUp},
+		{"unlimited", func(i *collections.Invite) { i.MaxUses, i.Uses = 0, 100 }, "ada@example.com", nil},
+		{"other domain", func(*collections.Invite) {}, "ada@example.com.evil.org", errInviteEmailDomain},
+		{"no email", func(*collections.Invite) {}, "", errInviteEmailDomain},
+		{"any domain", func(i *collections.Invite) { i.EmailDomain = "" }, "", nil},
+	}
+	for _, test := range tests {
+		invite := valid
+		test.edit(&invite)
+		if err := checkInvite(&invite, test.email, now); err != test.want {
+			t.Errorf("%s: checkInvite gave %v but want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestDeleteRoleGivenByInvites(t *testing.T) {
+	now := time.Now()
+	db := &fakeDatastore{}
+	h := &Hub{name: "HUB", db: db, auth: &fakeAuthenticator{customRoles: map[string][]string{"ta": {collabauth.FileRead}}}}
+
+	db.invites = []collections.Invite{{ID: "usable", Role: "ta", ExpiresAt: now.Add(time.Hour), EmailDomain: "example.com"}}
+	if err := h.deleteRole("ta"); wscodes.AsError(err).Code != wscodes.StatusRoleInUse {
+		t.Errorf("deleting a role given by a usable invite gave %v but want %s", err, wscodes.StatusRoleInUse)
+	}
+
+	db.invites = []collections.Invite{{ID: "expired", Role: "ta", ExpiresAt: now}}
+	db.pendingInvitations = []collections.PendingInvitation{{Email: "ada@example.com", Hub: "HUB", Role: "ta"}}
+	if err := h.deleteRole("ta"); wscodes.AsError(err).Code != wscodes.StatusRoleInUse {
+		t.Errorf("deleting a role given by a pending invitation gave %v but want %s", err, wscodes.StatusRoleInUse)
+	}
+}
+
+func TestPendingInvitationsNeedVerifiedEmail(t *testing.T) {
+	db := &fakeDatastore{}
+	hc := &Connector{db: db}
+	if hc.acceptPendingInvitations("user") {
+		t.Error("the pending invitations of a user without a verified email were accepted")
+	}
+	db.verifiedEmail = "ada@example.com"
+	if !hc.acceptPendingInvitations("user") {
+		t.Error("the pending invitations of a user with a verified email weren't accepted")
+	}
+}
+
+func TestJoiningMakesTheOpenHubForgetTheRole(t *testing.T) {
+	auth := &fakeAuthenticator{}
+	hc := &Connector{hubs: map[string]*Hub{"HUB": {auth: auth, done: make(chan struct{})}}}
+	hc.forgetRole("HUB", "user")
+	hc.forgetRole("CLOSED", "user")
+	if len(auth.forgotten) != 1 || auth.forgotten[0] != "user" {
+		t.Errorf("the open hub forgot the roles of %v but want [user]", auth.forgotten)
+	}
+}
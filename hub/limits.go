@@ -0,0 +1,33 @@
+package hub
+
+import (
+	"collabserver/config"
+	wscodes "collabserver/websocketcodes"
+	"strconv"
+)
+
+// checkMessageLimits checks the decoded message against the configured size limits, giving the
+// reply to send back if it's over any of them or nil otherwise. The limit that was exceeded is
+// given in the error's details so that clients can split what they send to fit.
+func checkMessageLimits(message *Message) *Message {
+	limits := config.Current.Limits
+	if len(message.Operations) > limits.MaxOpsPerMessage {
+		return toOriginWithError(message, limitError(wscodes.StatusTooManyOperations,
+			"messages can have at most %d operations", limits.MaxOpsPerMessage))
+	}
+	for _, op := range message.Operations {
+		if len(op) > limits.MaxOpBytes {
+			return toOriginWithError(message, limitError(wscodes.StatusOperationTooLarge,
+				"operations can be at most %d bytes", limits.MaxOpBytes))
+		}
+	}
+	if len(message.FileState) > limits.MaxFileStateBytes {
+		return toOriginWithError(message, limitError(wscodes.StatusFileStateTooLarge,
+			"file states can be at most %d bytes", limits.MaxFileStateBytes))
+	}
+	return nil
+}
+
+func limitError(code, format string, limit int) *wscodes.Error {
+	return wscodes.Errorf(code, format, limit).WithDetail("limit", strconv.Itoa(limit))
+}
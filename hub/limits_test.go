@@ -0,0 +1,75 @@
+package hub
+
+import (
+	"collabserver/config"
+	"collabserver/ratelimit"
+	wscodes "collabserver/websocketcodes"
+	"strings"
+	"testing"
+)
+
+func TestCheckMessageLimits(t *testing.T) {
+	limits := config.Current.Limits
+	cases := []struct {
+		name       string
+		message    *Message
+		wantStatus string
+	}{
+		{
+			name:    "message within limits passes",
+			message: &Message{Operations: []string{"op"}, FileState: "{}"},
+		},
+		{
+			name:       "too many operations",
+			message:    &Message{Operations: make([]string, limits.MaxOpsPerMessage+1)},
+			wantStatus: wscodes.StatusTooManyOperations,
+		},
+		{
+			name:       "operation too large",
+			message:    &Message{Operations: []string{strings.Repeat("a", limits.MaxOpBytes+1)}},
+			wantStatus: wscodes.StatusOperationTooLarge,
+		},
+		{
+			name:       "file state too large",
+			message:    &Message{FileState: strings.Repeat("a", limits.MaxFileStateBytes+1)},
+			wantStatus: wscodes.StatusFileStateTooLarge,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			reply := checkMessageLimits(tc.message)
+			if tc.wantStatus == "" {
+				if reply != nil {
+					t.Errorf("checkMessageLimits gave reply %#v when not expecting one", reply)
+				}
+				return
+			}
+			if reply == nil || reply.Status != tc.wantStatus {
+				t.Errorf("checkMessageLimits gave reply %#v but want status %s", reply, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestSessionLimitsOutliveSessions(t *testing.T) {
+	hc := &Connector{sessionLimits: map[string]*ratelimit.Limiter{}}
+	newSession := func(userID string) *session {
+		client := NewClient(userID, nil)
+		client.limits = hc.sessionLimiter(userID)
+		return &session{client: client}
+	}
+	_, rate := config.Current.RateLimits.ClientRate(endpointListFiles, "")
+	first := newSession("USER")
+	for i := 0; i < rate.Burst; i++ {
+		if reply := first.client.rateLimited(&Message{Endpoint: endpointListFiles}); reply != nil {
+			t.Fatalf("request %d was rate limited: %#v", i, reply)
+		}
+	}
+	_, err := newSession("USER").call(&Message{Endpoint: endpointListFiles})
+	if err == nil || wscodes.AsError(err).Code != wscodes.StatusRateLimited {
+		t.Errorf("call on a new session of the same user gave %v but want %s", err, wscodes.StatusRateLimited)
+	}
+	if reply := newSession("OTHER").client.rateLimited(&Message{Endpoint: endpointListFiles}); reply != nil {
+		t.Errorf("another user's session was rate limited: %#v", reply)
+	}
+}
@@ -1,6 +1,9 @@
 package hub
 
-import "collabserver/collections"
+import (
+	"collabserver/collections"
+	wscodes "collabserver/websocketcodes"
+)
 
 const (
 	endpointPassthrough       = "PASSTHROUGH"
@@ -16,6 +19,22 @@ const (
 	endpointDisconnectFromHub = "DISCONNECT_HUB"
 	endpointHubCreate         = "HUB_CREATE"
 	endpointFileRetrieve      = "FILE_RETRIEVE"
+	endpointHello             = "HELLO"
+	endpointAck               = "ACK"
+	endpointFileSave          = "FILE_SAVE"
+	endpointFileCheckpoint    = "FILE_CHECKPOINT"
+	endpointServiceAccounts   = "SERVICE_ACCOUNTS"
+	endpointRoles             = "ROLES"
+	endpointFileACL           = "FILE_ACL"
+	endpointInvites           = "INVITES"
+	endpointJoinHubWithInvite = "JOIN_HUB_WITH_INVITE"
+	// Sent to the user who invited someone by email once that person signs up and joins.
+	endpointInvitationAccepted = "INVITATION_ACCEPTED"
+	// Sent to a user's clients when their role in the hub, or what it lets them do, changes.
+	endpointRoleChanged       = "ROLE_CHANGED"
+	endpointTransferOwnership = "TRANSFER_OWNERSHIP"
+	endpointListAudit         = "LIST_AUDIT"
+	endpointPublicLinks       = "PUBLIC_LINKS"
 
 	routeBroadcast = "BROADCAST"
 	routeOrigin    = "ORIGIN"
@@ -23,6 +42,31 @@ const (
 	userAdd    = "ADD"
 	userRemove = "REMOVE"
 	userModify = "MODIFY"
+
+	checkpointCreate  = "CREATE"
+	checkpointRestore = "RESTORE"
+	checkpointDelete  = "DELETE"
+
+	serviceAccountList   = "LIST"
+	serviceAccountCreate = "CREATE"
+	serviceAccountRotate = "ROTATE"
+	serviceAccountRevoke = "REVOKE"
+
+	roleList   = "LIST"
+	roleSet    = "SET"
+	roleDelete = "DELETE"
+
+	inviteList   = "LIST"
+	inviteCreate = "CREATE"
+	inviteRevoke = "REVOKE"
+
+	publicLinkList   = "LIST"
+	publicLinkCreate = "CREATE"
+	publicLinkRevoke = "REVOKE"
+
+	ownershipOffer  = "OFFER"
+	ownershipAccept = "ACCEPT"
+	ownershipCancel = "CANCEL"
 )
 
 // Message defines the Websocket message between browser and this real-time server
@@ -30,6 +74,12 @@ type Message struct {
 	// UID is used for file operations; clients won't send another message until their
 	// outstanding message of the same id is sent back with a success.
 	UID string `json:"uid"`
+	// Seq numbers the messages sent to a client, increasing by one with each message. In an ACK
+	// from the client, it's the latest message the client has processed.
+	Seq int64 `json:"seq,omitempty"`
+	// ReplyTo is the UID of the request this message answers. It's empty on broadcasts that
+	// weren't caused by a request of the receiving client.
+	ReplyTo string `json:"replyTo,omitempty"`
 	// Endpoint specifies how the message should be handled, i.e. pushing file operations, connecting to a hub, etc.
 	Endpoint string `json:"endpoint"`
 	// Route is single item list of routeBroadcast or routeOrigin, or otherwise a list of clients to send the message to.
@@ -38,6 +88,10 @@ type Message struct {
 	Status string `json:"status"`
 	// Text is intended to provide additional info about the Status if possible.
 	Text string `json:"text"`
+	// Error describes the failure in more detail when the request failed.
+	Error *wscodes.Error `json:"error,omitempty"`
+	// RetryAfter is the number of milliseconds to wait before retrying a rate limited request.
+	RetryAfter int64 `json:"retryAfter,omitempty"`
 	// File is the name of the notebook file in the hub, e.g. Untitled.ipynb
 	File string `json:"file"`
 	// Index is the starting index of the operation if this is a file update request.
@@ -50,6 +104,9 @@ type Message struct {
 	ModifyUserType string `json:"modifyUserType"`
 	// ModifyUserRole is the role the user is being changed to if applicable
 	ModifyUserRole string `json:"modifyUserRole"`
+	// Permissions are what the user's new role lets them do, in ROLE_CHANGED messages, or what
+	// the user's role lets them do in replies to file lists.
+	Permissions []string `json:"permissions,omitempty"`
 	// ModifyUserID is the email of the user being modified.
 	ModifyUserID string `json:"modifyUserID"`
 
@@ -58,6 +115,62 @@ type Message struct {
 	// FileState is passed to the client on initial connection to a file to use as a base for applying operations.
 	// It is also passed from the client to the backend on initial file load in case the backend needs it.
 	FileState string `json:"fileState"`
+	// UpToDate asks FILE_RETRIEVE to have the snapshot brought up to date with the file's operations,
+	// for callers that need the file's current contents rather than a snapshot to apply them to.
+	UpToDate bool `json:"upToDate,omitempty"`
+
+	// FileACL is the access list of File, overriding the hub roles of the users it names for the file.
+	FileACL []collections.FileACLEntry `json:"fileACL,omitempty"`
+
+	// CheckpointAction says what to do with the file's checkpoint: create, restore or delete it.
+	CheckpointAction string `json:"checkpointAction,omitempty"`
+
+	// ServiceAccountAction says what to do with the hub's service accounts: list them, create
+	// one, rotate one's API key or revoke it.
+	ServiceAccountAction string `json:"serviceAccountAction,omitempty"`
+	// ServiceAccount is the account being created or changed. Replies to creating or rotating give
+	// it back along with its new key, which can't be retrieved again.
+	ServiceAccount *collections.ServiceAccount `json:"serviceAccount,omitempty"`
+	// ServiceAccounts lists the hub's service accounts.
+	ServiceAccounts []collections.ServiceAccount `json:"serviceAccounts,omitempty"`
+
+	// RoleAction says what to do with the hub's roles: list them, or define or delete a custom role.
+	RoleAction string `json:"roleAction,omitempty"`
+	// RoleDefinition is the custom role being defined or deleted.
+	RoleDefinition *collections.RoleDefinition `json:"roleDefinition,omitempty"`
+	// RoleDefinitions lists the built-in and custom roles of the hub.
+	RoleDefinitions []collections.RoleDefinition `json:"roleDefinitions,omitempty"`
+
+	// InviteAction says what to do with the hub's invites: list them, or create or revoke one.
+	InviteAction string `json:"inviteAction,omitempty"`
+	// Invite is the invite being created or revoked. Replies to creating one give it back along
+	// with its token, which can't be retrieved again.
+	Invite *collections.Invite `json:"invite,omitempty"`
+	// Invites lists the hub's invites.
+	Invites []collections.Invite `json:"invites,omitempty"`
+	// InviteToken is the token of the invite a JOIN_HUB_WITH_INVITE request joins the hub with.
+	InviteToken string `json:"inviteToken,omitempty"`
+
+	// PublicLinkAction says what to do with the hub's public links: list them, or create or revoke one.
+	PublicLinkAction string `json:"publicLinkAction,omitempty"`
+	// PublicLink is the public link being created or revoked. Replies to creating one give it back
+	// along with its token, which can't be retrieved again.
+	PublicLink *collections.PublicLink `json:"publicLink,omitempty"`
+	// PublicLinks lists the hub's public links.
+	PublicLinks []collections.PublicLink `json:"publicLinks,omitempty"`
+
+	// OwnershipAction says what to do with the hub's ownership transfer: offer it to the member with
+	// the email in ModifyUserID, accept it, or cancel it.
+	OwnershipAction string `json:"ownershipAction,omitempty"`
+	// OwnershipTransfer is the transfer that was offered, accepted or cancelled.
+	OwnershipTransfer *collections.OwnershipTransfer `json:"ownershipTransfer,omitempty"`
+
+	// AuditQuery says which of the hub's audit entries to list.
+	AuditQuery *collections.AuditQuery `json:"auditQuery,omitempty"`
+	// AuditEntries lists a page of the hub's audit entries, newest first.
+	AuditEntries []collections.AuditEntry `json:"auditEntries,omitempty"`
+	// NextPageToken is the PageToken for the next page of AuditEntries, or "" if it was the last.
+	NextPageToken string `json:"nextPageToken,omitempty"`
 
 	// UserList is passed to the client and lists members of the hub and their statuses.
 	UserList []collections.UserInfo `json:"userList"`
@@ -67,5 +180,11 @@ type Message struct {
 	HubList []string `json:"hubList"`
 
 	HubName string `json:"hubName"`
-	client  *Client
+
+	// ProtocolVersion is the protocol version asked for by a HELLO message, and the one agreed on in the reply.
+	ProtocolVersion int `json:"protocolVersion,omitempty"`
+	// Features are the optional features asked for by a HELLO message, and the ones enabled in the reply.
+	Features []string `json:"features,omitempty"`
+
+	client *Client
 }
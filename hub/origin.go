@@ -0,0 +1,106 @@
+package hub
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "collabserver/cloudlog"
+	"collabserver/config"
+	"collabserver/metrics"
+
+	"github.com/gorilla/websocket"
+)
+
+// originPattern is an allowed origin, whose host may match any subdomain.
+type originPattern struct {
+	scheme string
+	// host is the host to match, or the domain whose subdomains match if wildcard is set.
+	host     string
+	port     string
+	wildcard bool
+}
+
+// originChecker decides which origins can open websocket connections; see config.Origins.
+type originChecker struct {
+	any      bool
+	patterns []originPattern
+}
+
+// newOriginChecker gives a checker allowing the origins, which are checked by config.Load.
+func newOriginChecker(allowed []string) *originChecker {
+	oc := &originChecker{}
+	for _, origin := range allowed {
+		if origin == config.AnyOrigin {
+			oc.any = true
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			continue
+		}
+		p := originPattern{
+			scheme: strings.ToLower(u.Scheme),
+			host:   strings.ToLower(u.Hostname()),
+			port:   u.Port(),
+		}
+		if strings.HasPrefix(p.host, "*.") {
+			p.host = p.host[1:]
+			p.wildcard = true
+		}
+		oc.patterns = append(oc.patterns, p)
+	}
+	return oc
+}
+
+// allows reports whether the origin is allowed.
+func (oc *originChecker) allows(origin string) bool {
+	if oc.any {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	scheme, host, port := strings.ToLower(u.Scheme), strings.ToLower(u.Hostname()), u.Port()
+	for _, p := range oc.patterns {
+		if p.scheme != scheme || p.port != port {
+			continue
+		}
+		if p.wildcard && strings.HasSuffix(host, p.host) && len(host) > len(p.host) {
+			return true
+		}
+		if !p.wildcard && p.host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin is the upgrader's CheckOrigin. Requests without an Origin header don't come from
+// browsers, and pages served by us can always connect.
+func (oc *originChecker) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if oc.allows(origin) {
+		return true
+	}
+	log.Printf("Rejected websocket upgrade from origin %q for %s", origin, r.RemoteAddr)
+	metrics.RecordRejectedOrigin()
+	return false
+}
+
+// newUpgrader gives the upgrader for websocket connections, set up by the config for the environment.
+func newUpgrader(c *config.Config, environment string) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: c.Compression.Enabled,
+		CheckOrigin:       newOriginChecker(c.Origins.AllowedIn(environment)).checkOrigin,
+	}
+}
@@ -0,0 +1,51 @@
+package hub
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginChecker(t *testing.T) {
+	oc := newOriginChecker([]string{"https://app.example.com", "https://*.notebooks.dev", "http://localhost:3000"})
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"http://app.example.com", false},
+		{"https://app.example.com:8443", false},
+		{"https://evil.example.com", false},
+		{"https://a.notebooks.dev", true},
+		{"https://a.b.notebooks.dev", true},
+		{"https://notebooks.dev", false},
+		{"https://evilnotebooks.dev", false},
+		{"http://localhost:3000", true},
+		{"http://localhost:3001", false},
+		{"null", false},
+	}
+	for _, test := range tests {
+		if got := oc.allows(test.origin); got != test.want {
+			t.Errorf("allows(%q) = %v but want %v", test.origin, got, test.want)
+		}
+	}
+	if !newOriginChecker([]string{"*"}).allows("https://anywhere.com") {
+		t.Errorf("a checker allowing any origin rejected one")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	oc := newOriginChecker(nil)
+	r := httptest.NewRequest("GET", "http://collab.example.com/", nil)
+	if !oc.checkOrigin(r) {
+		t.Errorf("checkOrigin rejected a request without an Origin header")
+	}
+	r.Header.Set("Origin", "http://collab.example.com")
+	if !oc.checkOrigin(r) {
+		t.Errorf("checkOrigin rejected a request from the same origin")
+	}
+	r.Header.Set("Origin", "https://other.example.com")
+	if oc.checkOrigin(r) {
+		t.Errorf("checkOrigin allowed a request from an origin that isn't allowed")
+	}
+}
@@ -0,0 +1,205 @@
+package hub
+
+import (
+	"collabserver/apikeys"
+	log "collabserver/cloudlog"
+	"collabserver/collabauth"
+	"collabserver/collections"
+	"collabserver/hubcodes"
+	wscodes "collabserver/websocketcodes"
+	"time"
+)
+
+const (
+	// How long the new owner has to accept an ownership transfer.
+	ownershipTransferLifetime = 7 * 24 * time.Hour
+	// The role the old owner is left with once an ownership transfer is accepted.
+	formerOwnerRole = collabauth.Writer
+)
+
+var (
+	errLastOwner = wscodes.NewError(wscodes.StatusLastOwner,
+		"the hub needs an owner; transfer ownership or make someone else an owner first")
+	errNoOwnershipTransfer = wscodes.NewError(wscodes.StatusNoOwnershipTransfer, "no ownership transfer is waiting")
+)
+
+// checkOwnerRemains checks that changing a member's role from current to role leaves the hub with an owner.
+func (h *Hub) checkOwnerRemains(current, role string) error {
+	if current != collabauth.Owner || role == collabauth.Owner {
+		return nil
+	}
+	entries, err := h.db.AllAuthEntries(h.users)
+	if err != nil {
+		return err
+	}
+	owners := 0
+	for _, entry := range entries {
+		if entry.Role == collabauth.Owner {
+			owners++
+		}
+	}
+	if owners <= 1 {
+		return errLastOwner
+	}
+	return nil
+}
+
+// handleTransferOwnership offers the hub's ownership to another member, accepts the offer or
+// cancels it. Only owners can offer, only the member it was offered to can accept, and either can
+// cancel. Once accepted, the new owner takes the old owner's place, who is left a writer.
+func (h *Hub) handleTransferOwnership(message *Message) *Message {
+	userID := message.client.userID
+	var transfer *collections.OwnershipTransfer
+	var err error
+	switch message.OwnershipAction {
+	case ownershipOffer:
+		transfer, err = h.offerOwnership(userID, message.ModifyUserID)
+	case ownershipAccept:
+		transfer, err = h.acceptOwnership(userID)
+	case ownershipCancel:
+		transfer, err = h.cancelOwnershipTransfer(userID)
+	default:
+		err = wscodes.NewError(wscodes.StatusInvalidRequest, "unknown ownership action").
+			WithDetail("ownershipAction", message.OwnershipAction)
+	}
+	if err != nil {
+		return toOriginWithError(message, err)
+	}
+	notice := &Message{
+		Endpoint:          message.Endpoint,
+		HubName:           h.name,
+		OwnershipAction:   message.OwnershipAction,
+		OwnershipTransfer: transfer,
+		Status:            wscodes.StatusSuccess,
+	}
+	// The other side of the transfer is told, so that they can accept it or know it's over.
+	other := transfer.To
+	if userID == transfer.To {
+		other = transfer.From
+	}
+	for client := range h.clients {
+		if client.userID == other {
+			h.sendMessage(client, notice)
+		}
+	}
+	returnMessage := toOriginWithStatus(message, wscodes.StatusOperationCommitted, "")
+	returnMessage.OwnershipAction = message.OwnershipAction
+	returnMessage.OwnershipTransfer = transfer
+	return returnMessage
+}
+
+// offerOwnership offers the hub's ownership to the member with the email, replacing any earlier offer.
+func (h *Hub) offerOwnership(from, email string) (*collections.OwnershipTransfer, error) {
+	role, err := h.auth.UserRole(from)
+	if err != nil || role != collabauth.Owner {
+		return nil, errUnauthorized
+	}
+	userIDs, err := h.db.UserIDsForEmails([]string{email})
+	if err != nil {
+		return nil, err
+	}
+	to, ok := userIDs[email]
+	if !ok {
+		return nil, wscodes.NewError(wscodes.StatusUserNotFound, "email not found").WithDetail("email", email)
+	}
+	toRole, err := h.auth.UserRole(to)
+	if err != nil || toRole == collabauth.NoRole || apikeys.IsServiceAccount(to) {
+		return nil, wscodes.NewError(wscodes.StatusInvalidRequest, "ownership can only be given to members of the hub").
+			WithDetail("email", email)
+	}
+	if toRole == collabauth.Owner {
+		return nil, wscodes.NewError(wscodes.StatusInvalidRequest, "user is already an owner").WithDetail("email", email)
+	}
+	now := time.Now()
+	transfer := &collections.OwnershipTransfer{
+		From:      from,
+		To:        to,
+		Created:   now,
+		ExpiresAt: now.Add(ownershipTransferLifetime),
+	}
+	if err := h.db.UpdateEntry(h.ref, hubcodes.HubOwnershipTransferKey, transfer); err != nil {
+		return nil, err
+	}
+	h.recordAudit(from, hubcodes.AuditOwnershipOffered, to, "", collabauth.Owner)
+	log.Printf("User %s offered the ownership of hub %s to %s", from, h.name, to)
+	return transfer, nil
+}
+
+// acceptOwnership makes the user an owner in place of the owner who offered them the hub.
+func (h *Hub) acceptOwnership(userID string) (*collections.OwnershipTransfer, error) {
+	transfer, err := h.ownershipTransfer()
+	if err != nil {
+		return nil, err
+	}
+	if transfer.To != userID {
+		return nil, errUnauthorized
+	}
+	// The offer lapses if whoever made it is no longer an owner.
+	if role, err := h.auth.UserRole(transfer.From); err != nil || role != collabauth.Owner {
+		h.db.UpdateEntry(h.ref, hubcodes.HubOwnershipTransferKey, nil)
+		return nil, errNoOwnershipTransfer
+	}
+	// The transfer is checked again along with the roles as they are when they change, in case
+	// either changed meanwhile.
+	transfer, toRole, err := h.db.TransferOwnership(h.ref, h.users, collabauth.Owner, formerOwnerRole,
+		func(current *collections.OwnershipTransfer, fromRole, toRole string) error {
+			return checkOwnershipTransfer(current, userID, fromRole, toRole, time.Now())
+		})
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range []struct{ userID, before, role string }{
+		{transfer.To, toRole, collabauth.Owner},
+		{transfer.From, collabauth.Owner, formerOwnerRole},
+	} {
+		h.db.UpdateUsersHubList(change.userID, h.name, change.role)
+		h.recordAudit(userID, hubcodes.AuditMemberRoleChanged, change.userID, change.before, change.role)
+		h.applyRoleChange(change.userID, change.role)
+	}
+	log.Printf("User %s accepted the ownership of hub %s from %s", transfer.To, h.name, transfer.From)
+	return transfer, nil
+}
+
+// checkOwnershipTransfer checks that the transfer can be accepted at the time by userID, given the
+// roles of the users it's from and to.
+func checkOwnershipTransfer(transfer *collections.OwnershipTransfer, userID, fromRole, toRole string, now time.Time) error {
+	switch {
+	case transfer == nil || !now.Before(transfer.ExpiresAt) || fromRole != collabauth.Owner:
+		return errNoOwnershipTransfer
+	case transfer.To != userID:
+		return errUnauthorized
+	case toRole == "" || toRole == collabauth.NoRole:
+		// Members who were removed after the offer was made can't come back as owners.
+		return errUnauthorized
+	}
+	return nil
+}
+
+// cancelOwnershipTransfer calls off the hub's ownership transfer, which only the two users it's
+// between can do.
+func (h *Hub) cancelOwnershipTransfer(userID string) (*collections.OwnershipTransfer, error) {
+	transfer, err := h.ownershipTransfer()
+	if err != nil {
+		return nil, err
+	}
+	if userID != transfer.From && userID != transfer.To {
+		return nil, errUnauthorized
+	}
+	if err := h.db.UpdateEntry(h.ref, hubcodes.HubOwnershipTransferKey, nil); err != nil {
+		return nil, err
+	}
+	h.recordAudit(userID, hubcodes.AuditOwnershipCancelled, transfer.To, "", "")
+	return transfer, nil
+}
+
+// ownershipTransfer gives the hub's ownership transfer, if one is waiting and hasn't expired.
+func (h *Hub) ownershipTransfer() (*collections.OwnershipTransfer, error) {
+	entry := &hubRef{}
+	if err := h.db.EntryForRef(h.ref, entry); err != nil {
+		return nil, err
+	}
+	if entry.OwnershipTransfer == nil || !time.Now().Before(entry.OwnershipTransfer.ExpiresAt) {
+		return nil, errNoOwnershipTransfer
+	}
+	return entry.OwnershipTransfer, nil
+}
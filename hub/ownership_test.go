@@ -0,0 +1,59 @@
+package hub
+
+import (
+	"collabserver/collabauth"
+	"collabserver/collections"
+	wscodes "collabserver/websocketcodes"
+	"testing"
+	"time"
+)
+
+func TestCheckOwnerRemains(t *testing.T) {
+	db := &fakeDatastore{authEntries: []collections.AuthEntry{
+		{UserID: "owner", Role: collabauth.Owner},
+		{UserID: "writer", Role: collabauth.Writer},
+		{UserID: "removed", Role: collabauth.NoRole},
+	}}
+	h := &Hub{db: db}
+	for _, role := range []string{collabauth.Writer, collabauth.NoRole} {
+		if err := h.checkOwnerRemains(collabauth.Owner, role); wscodes.AsError(err).Code != wscodes.StatusLastOwner {
+			t.Errorf("making the only owner a %s gave %v but want %s", role, err, wscodes.StatusLastOwner)
+		}
+	}
+	if err := h.checkOwnerRemains(collabauth.Writer, collabauth.NoRole); err != nil {
+		t.Errorf("removing a writer gave %v", err)
+	}
+	if err := h.checkOwnerRemains(collabauth.Owner, collabauth.Owner); err != nil {
+		t.Errorf("keeping the only owner an owner gave %v", err)
+	}
+
+	db.authEntries = append(db.authEntries, collections.AuthEntry{UserID: "co-owner", Role: collabauth.Owner})
+	if err := h.checkOwnerRemains(collabauth.Owner, collabauth.NoRole); err != nil {
+		t.Errorf("removing one of two owners gave %v", err)
+	}
+}
+
+func TestCheckOwnershipTransfer(t *testing.T) {
+	now := time.Now()
+	transfer := &collections.OwnershipTransfer{From: "owner", To: "writer", ExpiresAt: now.Add(time.Hour)}
+	tests := []struct {
+		name             string
+		transfer         *collections.OwnershipTransfer
+		userID           string
+		fromRole, toRole string
+		want             error
+	}{
+		{"accepted", transfer, "writer", collabauth.Owner, collabauth.Writer, nil},
+		{"none waiting", nil, "writer", "", "", errNoOwnershipTransfer},
+		{"expired", &collections.OwnershipTransfer{From: "owner", To: "writer", ExpiresAt: now}, "writer", collabauth.Owner, collabauth.Writer, errNoOwnershipTransfer},
+		{"offerer no longer an owner", transfer, "writer", collabauth.Writer, collabauth.Writer, errNoOwnershipTransfer},
+		{"someone else", transfer, "viewer", collabauth.Owner, collabauth.Writer, errUnauthorized},
+		{"removed since the offer", transfer, "writer", collabauth.Owner, collabauth.NoRole, errUnauthorized},
+		{"never a member", transfer, "writer", collabauth.Owner, "", errUnauthorized},
+	}
+	for _, test := range tests {
+		if err := checkOwnershipTransfer(test.transfer, test.userID, test.fromRole, test.toRole, now); err != test.want {
+			t.Errorf("%s: checkOwnershipTransfer gave %v but want %v", test.name, err, test.want)
+		}
+	}
+}
@@ -1,20 +1,40 @@
 package hub
 
 import (
+	"collabserver/apikeys"
 	log "collabserver/cloudlog"
 	"collabserver/collabauth"
 	"collabserver/collections"
+	"collabserver/config"
 	"collabserver/hubcodes"
-	"collabserver/remotejob"
+	"collabserver/storage"
 	wscodes "collabserver/websocketcodes"
 	"context"
-	"errors"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/firestore"
 	"google.golang.org/api/iterator"
 )
 
+// serviceAccountAuditActions gives the audit action of each change to a service account.
+var serviceAccountAuditActions = map[string]string{
+	serviceAccountCreate: hubcodes.AuditServiceAccountCreated,
+	serviceAccountRotate: hubcodes.AuditServiceAccountKeyRotated,
+	serviceAccountRevoke: hubcodes.AuditServiceAccountRevoked,
+}
+
 func (h *Hub) processMessage(message *Message) *Message {
+	if reply := checkGuestRequest(message); reply != nil {
+		return reply
+	}
+	if rate, ok := config.Current.RateLimits.Hub[message.Endpoint]; ok {
+		if ok, retryAfter := h.limits.Allow(message.Endpoint, rate.PerSecond, rate.Burst, time.Now()); !ok {
+			return rateLimitedMessage(message, retryAfter)
+		}
+	}
 	switch message.Endpoint {
 	case endpointPassthrough:
 		return message
@@ -28,45 +48,61 @@ func (h *Hub) processMessage(message *Message) *Message {
 		return h.handleFileRename(message)
 	case endpointFileDelete:
 		return h.handleFileDelete(message)
+	case endpointFileSave:
+		return h.handleFileSave(message)
+	case endpointFileCheckpoint:
+		return h.handleFileCheckpoint(message)
 	case endpointListUsers:
 		return h.handleListUser(message)
 	case endpointModifyUser:
 		return h.handleModifyUser(message)
 	case endpointListFiles:
 		return h.handleListFiles(message)
+	case endpointServiceAccounts:
+		return h.handleServiceAccounts(message)
+	case endpointRoles:
+		return h.handleRoles(message)
+	case endpointFileACL:
+		return h.handleFileACL(message)
+	case endpointInvites:
+		return h.handleInvites(message)
+	case endpointTransferOwnership:
+		return h.handleTransferOwnership(message)
+	case endpointListAudit:
+		return h.handleListAudit(message)
+	case endpointPublicLinks:
+		return h.handlePublicLinks(message)
 	case endpointDisconnectFromHub:
 		go h.handBackClient(message.client)
 		return nil
 	default:
 		log.Printf("Message endpoint: " + message.Endpoint + " is not supported")
-		ret := &Message{
-			UID:      message.UID,
-			Endpoint: message.Endpoint,
-			Route:    append([]string{}, routeOrigin),
-			Status:   wscodes.StatusEndpointNotValid,
-		}
-		return ret
+		return toOriginWithError(message, wscodes.NewError(wscodes.StatusEndpointNotValid, "endpoint is not supported").
+			WithDetail("endpoint", message.Endpoint))
 	}
 }
 
 func (h *Hub) handleFileRetrieve(message *Message) *Message {
-	if ok, _ := h.auth.CanCommit(message.client.userID); !ok {
-		return toOriginWithStatus(message, wscodes.StatusEndpointUnauthorized, "")
+	fh, err := h.accessibleFileHead(message.client.userID, message.File, collabauth.FileRead)
+	if err != nil {
+		return toOriginWithError(message, err)
 	}
+	// The snapshot itself isn't cached, so read it fresh; this also picks up snapshot updates
+	// made by the remote service.
 	data := collections.FileInfo{}
-	docRef, err := h.db.EntryForFieldValue(h.files, hubcodes.FileNameKey, message.File, &data)
+	err = h.db.EntryForRef(fh.ref, &data)
 	if err != nil {
-		log.Printf("error from refForFilename: %s", err.Error())
-		return toOriginWithStatus(message, wscodes.StatusFileDoesntExist, err.Error())
+		return toOriginWithError(message, err)
 	}
+	fh.snapshotIndex = int64(data.Snapshot.Index)
 	// A bit of incrementing here because OpsFor File gives ops starting from idx-1, and
 	// the snapshot's index is the index of the latest op it's updated to (i.e. if the latest op is
 	// index 1, and snapshot is caught up then snapshot.Index == 1). Leaving it as is will cause it
 	// to replay the last two ops on top of the current file state.
 	idx := int64(data.Snapshot.Index) + 2
-	ops, _, err := h.db.OpsForFile(h.db.CollectionForID(opsID, docRef), idx)
+	ops, _, err := h.opsSince(fh, idx-1)
 	if err != nil {
-		return toOriginWithStatus(message, wscodes.StatusFailure, err.Error())
+		return toOriginWithError(message, err)
 	}
 
 	returnMessage := toOriginWithStatus(message, wscodes.StatusSuccess, "")
@@ -75,7 +111,7 @@ func (h *Hub) handleFileRetrieve(message *Message) *Message {
 		// File is empty and needs an initial file state
 		// commit message's filestate
 		if message.FileState != "" {
-			err := h.db.UpdateEntry(docRef, "snapshot", collections.FileSnapshot{File: message.FileState})
+			err := h.db.UpdateEntry(fh.ref, "snapshot", collections.FileSnapshot{File: message.FileState})
 			if err != nil {
 				log.Printf("Updating intial file state failed: %#v", err)
 				returnMessage.FileState = data.Snapshot.File
@@ -92,6 +128,9 @@ func (h *Hub) handleFileRetrieve(message *Message) *Message {
 	returnMessage.Operations = ops
 	returnMessage.Index = idx - 2
 	returnMessage.File = message.File
+	if message.UpToDate && len(ops) > 0 {
+		h.requestSnapshotUpdate(fh, message.File, true)
+	}
 
 	return returnMessage
 }
@@ -107,41 +146,37 @@ func (h *Hub) handleFileUpdate(message *Message) *Message {
 	var idx int64
 	var retOps []string
 	var text string
+	var opErr *wscodes.Error
 
-	// Check if the user can update files.
-	if ok, _ := h.auth.CanCommit(message.client.userID); !ok {
-		status = wscodes.StatusEndpointUnauthorized
+	// Find the cached head of the file, if the user can edit it.
+	fh, err := h.accessibleFileHead(message.client.userID, message.File, collabauth.FileEdit)
+	if err != nil {
+		opErr = wscodes.AsError(err)
 	} else {
-		// Next find the document reference for the file.
-		data := collections.FileInfo{}
-		docRef, err := h.db.EntryForFieldValue(h.files, hubcodes.FileNameKey, message.File, &data)
-		if err != nil {
-			log.Printf("error from refForFilename: %s", err.Error())
-			status = wscodes.StatusFileDoesntExist
-			text = err.Error()
-		} else {
-			file := h.db.CollectionForID(opsID, docRef)
-			// Commit the operations since the previous two checks succeeded.
-			status, idx, retOps, text = h.db.CommitOps(
-				file,
-				message.Index,
-				message.Operations,
-				message.client.userID,
-			)
-			
-			// check the latest operation index against data.Index
-			if !data.MarkedForUpdate && status == wscodes.StatusOperationCommitted {
-				latestOpIndex := int(idx) + len(retOps)
-				if latestOpIndex - data.Snapshot.Index > maxOpsBeforeUpdate {
-					// mark it as needing an update; the remote service will read and perform
-					// the necessary transaction atomically (i.e. if this is called multiple times and
-					// one of the runs finishes then all other runs will terminate without any writes).
-					h.db.UpdateEntry(docRef, hubcodes.FileUpdateKey, true)
-					remotejob.FileUpdateRequest(h.name, message.File)
-				}
-			}
-
+		// Commit the operations since the user can edit the file.
+		status, idx, retOps, text = h.commitOps(
+			fh,
+			message.Index,
+			message.Operations,
+			message.client.userID,
+		)
+		if status == wscodes.StatusOperationCommitted {
+			h.requestSnapshotUpdate(fh, message.File, false)
+		} else if status == wscodes.StatusFileReplaced && message.client.protocolVersion() == protocolV1 {
+			// v1 clients don't know the status, nor hear of saves, so they're handed back to the
+			// Connector to connect and retrieve their files again.
+			log.Printf("Disconnecting v1 client of user %s from hub %s, since %s was replaced", message.client.userID, h.name, message.File)
+			defer h.unregisterClient(message.client)
 		}
+		if status != wscodes.StatusOperationCommitted && status != wscodes.StatusOperationTooOld {
+			// Being behind is part of the normal flow of commits, everything else is an error.
+			opErr = wscodes.NewError(status, text)
+		}
+	}
+	if opErr != nil {
+		status = opErr.Code
+		text = opErr.Message
+		ret.Error = opErr
 	}
 
 	ret.Status = status
@@ -157,32 +192,43 @@ func (h *Hub) handleFileUpdate(message *Message) *Message {
 }
 
 func (h *Hub) handleFileRename(message *Message) *Message {
-	if ok, _ := h.auth.CanCommit(message.client.userID); !ok {
-		return toOriginWithStatus(message, wscodes.StatusEndpointUnauthorized, "")
-	}
 	fileEntry := &collections.FileInfo{}
 
 	// Check if the old file name actually exists.
 	docRef, err := h.db.EntryForFieldValue(h.files, hubcodes.FileNameKey, message.File, fileEntry)
 	if err != nil {
-		if err == iterator.Done {
-			return toOriginWithStatus(message, wscodes.StatusFileDoesntExist, "")
-		}
-		return toOriginWithStatus(message, err.Error(), err.Error())
+		return toOriginWithError(message, fileLookupError(message.File, err))
 	}
+	err = h.checkFileAccess(message.client.userID, message.File, fileEntry.ACL, collabauth.FileRename)
+	if err != nil {
+		return toOriginWithError(message, err)
+	}
+	acl := fileEntry.ACL
 
 	// Check if the file we're changing to exists; we don't want it to already exist.
 	_, err = h.db.EntryForFieldValue(h.files, hubcodes.FileNameKey, message.NewFileName, fileEntry)
-	if err != iterator.Done {
-		return toOriginWithStatus(message, wscodes.StatusFileExists, "")
+	if err == nil {
+		return toOriginWithError(message, fileExistsError(message.NewFileName))
+	} else if err != iterator.Done {
+		return toOriginWithError(message, err)
 	}
 
 	// Attempt to rename, returning the error or a success depending on the result.
 	err = h.db.UpdateEntry(docRef, hubcodes.FileNameKey, message.NewFileName)
 	if err != nil {
-		return toOriginWithStatus(message, wscodes.StatusFileCreateFailed, err.Error())
+		return toOriginWithError(message, wscodes.NewError(wscodes.StatusFileRenameFailed, err.Error()))
 	}
 
+	fh, ok := h.fileHeads[message.File]
+	h.forgetFile(message.File)
+	if ok {
+		h.fileHeads[message.NewFileName] = fh
+	} else {
+		h.rememberACL(message.NewFileName, acl)
+	}
+	h.renamePublicLinks(message.File, message.NewFileName)
+	h.recordAudit(message.client.userID, hubcodes.AuditFileRenamed, message.NewFileName, message.File, message.NewFileName)
+
 	returnMessage := toOriginWithStatus(message, wscodes.StatusOperationCommitted, "")
 	returnMessage.File = message.NewFileName
 
@@ -195,8 +241,8 @@ func (h *Hub) refForFilename(fileName string) (*firestore.CollectionRef, error)
 }
 
 func (h *Hub) handleFileCreate(message *Message) *Message {
-	if ok, _ := h.auth.CanCommit(message.client.userID); !ok {
-		return toOriginWithStatus(message, wscodes.StatusEndpointUnauthorized, "")
+	if ok, _ := h.auth.Can(message.client.userID, collabauth.FileCreate); !ok {
+		return toOriginWithError(message, errUnauthorized)
 	}
 
 	// Check if the file exists first, and if it does then return an error so we don't overwrite it.
@@ -204,9 +250,9 @@ func (h *Hub) handleFileCreate(message *Message) *Message {
 	_, err := h.db.EntryForFieldValue(h.files, hubcodes.FileNameKey, message.File, fileEntry)
 	if err != iterator.Done {
 		if err != nil {
-			return toOriginWithStatus(message, err.Error(), err.Error())
+			return toOriginWithError(message, err)
 		}
-		return toOriginWithStatus(message, wscodes.StatusFileExists, "")
+		return toOriginWithError(message, fileExistsError(message.File))
 	}
 	// Proceed with creating the file.
 	fileEntry = &collections.FileInfo{
@@ -215,8 +261,11 @@ func (h *Hub) handleFileCreate(message *Message) *Message {
 	}
 	_, err = h.db.AddEntry(h.files, "", fileEntry)
 	if err != nil {
-		return toOriginWithStatus(message, wscodes.StatusFileCreateFailed, "")
+		return toOriginWithError(message, wscodes.NewError(wscodes.StatusFileCreateFailed, err.Error()))
 	}
+	// A file of the same name may have been deleted before.
+	h.forgetFile(message.File)
+	h.recordAudit(message.client.userID, hubcodes.AuditFileCreated, message.File, "", "")
 	// Return success message.
 	returnMessage := toOriginWithStatus(message, wscodes.StatusOperationCommitted, "")
 	returnMessage.File = message.File
@@ -225,29 +274,136 @@ func (h *Hub) handleFileCreate(message *Message) *Message {
 }
 
 func (h *Hub) handleFileDelete(message *Message) *Message {
-	if ok, _ := h.auth.CanCommit(message.client.userID); !ok {
-		return toOriginWithStatus(message, wscodes.StatusEndpointUnauthorized, "")
-	}
-
 	// Check if the file exists first before trying to delete
 	fileEntry := &collections.FileInfo{}
 	docRef, err := h.db.EntryForFieldValue(h.files, hubcodes.FileNameKey, message.File, fileEntry)
 	if err != nil {
-		if err == iterator.Done {
-			return toOriginWithStatus(message, wscodes.StatusFileDoesntExist, "")
-		}
-		return toOriginWithStatus(message, err.Error(), err.Error())
+		return toOriginWithError(message, fileLookupError(message.File, err))
+	}
+	err = h.checkFileAccess(message.client.userID, message.File, fileEntry.ACL, collabauth.FileDelete)
+	if err != nil {
+		return toOriginWithError(message, err)
 	}
 
 	err = h.db.DeleteDocument(docRef)
 	if err != nil {
-		toOriginWithStatus(message, err.Error(), err.Error())
+		return toOriginWithError(message, wscodes.NewError(wscodes.StatusFileDeleteFailed, err.Error()))
 	}
+	h.forgetFile(message.File)
+	// The deleted file's access list decides who hears that it's gone.
+	h.rememberACL(message.File, fileEntry.ACL)
+	h.recordAudit(message.client.userID, hubcodes.AuditFileDeleted, message.File, "", "")
 	returnMessage := toOriginWithStatus(message, wscodes.StatusOperationCommitted, "")
 
 	return returnMessage
 }
 
+// handleFileSave replaces the file's contents with the message's FileState, which becomes the
+// snapshot as of the file's latest operation. Everyone in the hub is told, so that clients with the
+// file open can retrieve it again.
+func (h *Hub) handleFileSave(message *Message) *Message {
+	fh, err := h.accessibleFileHead(message.client.userID, message.File, collabauth.FileEdit)
+	if err != nil {
+		return toOriginWithError(message, err)
+	}
+	err = h.saveSnapshot(fh, message.FileState, message.client.userID)
+	if err != nil {
+		return toOriginWithError(message, err)
+	}
+	return fileSavedMessage(message, fh)
+}
+
+// handleFileCheckpoint creates, restores or deletes the file's checkpoint. A file has at most one
+// checkpoint, which is a copy of its snapshot at the time it was created.
+func (h *Hub) handleFileCheckpoint(message *Message) *Message {
+	fh, err := h.accessibleFileHead(message.client.userID, message.File, collabauth.FileEdit)
+	if err != nil {
+		return toOriginWithError(message, err)
+	}
+	data := collections.FileInfo{}
+	err = h.db.EntryForRef(fh.ref, &data)
+	if err != nil {
+		return toOriginWithError(message, err)
+	}
+	switch message.CheckpointAction {
+	case checkpointCreate:
+		err = h.db.UpdateEntry(fh.ref, hubcodes.FileCheckpointKey, collections.FileCheckpoint{
+			Snapshot: data.Snapshot,
+			Created:  time.Now(),
+		})
+	case checkpointRestore:
+		if data.Checkpoint == nil {
+			return toOriginWithError(message, wscodes.NewError(wscodes.StatusCheckpointDoesntExist,
+				"file has no checkpoint").WithDetail("file", message.File))
+		}
+		err = h.saveSnapshot(fh, data.Checkpoint.Snapshot.File, message.client.userID)
+		if err != nil {
+			return toOriginWithError(message, err)
+		}
+		h.recordAudit(message.client.userID, hubcodes.AuditFileRestored, message.File, "",
+			data.Checkpoint.Created.Format(time.RFC3339))
+		return fileSavedMessage(message, fh)
+	case checkpointDelete:
+		err = h.db.UpdateEntry(fh.ref, hubcodes.FileCheckpointKey, firestore.Delete)
+	default:
+		return toOriginWithError(message, wscodes.NewError(wscodes.StatusInvalidRequest,
+			"unknown checkpoint action").WithDetail("checkpointAction", message.CheckpointAction))
+	}
+	if err != nil {
+		return toOriginWithError(message, err)
+	}
+	returnMessage := toOriginWithStatus(message, wscodes.StatusOperationCommitted, "")
+	returnMessage.File = message.File
+	return returnMessage
+}
+
+// saveSnapshot makes state the file's snapshot. The save is committed as a marker op after the
+// file's latest operation, so that ops made on the replaced contents are turned away instead of
+// being applied to the new ones.
+func (h *Hub) saveSnapshot(fh *fileHead, state, committerID string) error {
+	err := h.db.AppendOps(fh.ops, fh.head, []string{saveMarkerOp}, committerID)
+	if err == storage.ErrOpIndexTaken {
+		// Someone else committed in the meantime, so save after their ops.
+		if err = h.reload(fh); err == nil {
+			err = h.db.AppendOps(fh.ops, fh.head, []string{saveMarkerOp}, committerID)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fh.append([]string{saveMarkerOp})
+	fh.replacedBefore = fh.head
+	// Kept on the file too, so that ops on the replaced contents are turned away after the hub
+	// closes as well.
+	err = h.db.UpdateEntry(fh.ref, hubcodes.FileReplacedBeforeKey, fh.replacedBefore)
+	if err != nil {
+		return err
+	}
+	index := fh.head - 1
+	err = h.db.UpdateEntry(fh.ref, hubcodes.FileSnapshotKey, collections.FileSnapshot{
+		File:  state,
+		Index: int(index),
+	})
+	if err != nil {
+		return err
+	}
+	fh.snapshotIndex = index
+	return h.db.UpdateEntry(fh.ref, hubcodes.FileModifiedKey, time.Now())
+}
+
+// fileSavedMessage tells everyone in the hub that the file's contents were replaced as of Index.
+func fileSavedMessage(message *Message, fh *fileHead) *Message {
+	return &Message{
+		UID:      message.UID,
+		Endpoint: message.Endpoint,
+		File:     message.File,
+		HubName:  message.HubName,
+		Index:    fh.head - 1,
+		Route:    []string{routeBroadcast},
+		Status:   wscodes.StatusOperationCommitted,
+	}
+}
+
 func (h *Hub) handleModifyUser(message *Message) *Message {
 	var err error
 	switch message.ModifyUserType {
@@ -259,27 +415,334 @@ func (h *Hub) handleModifyUser(message *Message) *Message {
 	case userRemove:
 		err = h.AddUser(message.ModifyUserID, message.client.userID, collabauth.NoRole)
 	}
-	ret := &Message{
+	if err != nil {
+		return toOriginWithError(message, err)
+	}
+	return &Message{
 		UID:      message.UID,
 		Endpoint: message.Endpoint,
 		File:     message.File,
 		HubName:  message.HubName,
+		Route:    []string{routeBroadcast},
+		Status:   wscodes.StatusOperationCommitted,
 	}
+}
 
+// handleServiceAccounts lists, creates, rotates the key of or revokes the hub's service accounts,
+// which only users who can change the hub's users may do.
+func (h *Hub) handleServiceAccounts(message *Message) *Message {
+	if ok, _ := h.auth.Can(message.client.userID, collabauth.MembersChangeRole); !ok {
+		return toOriginWithError(message, errUnauthorized)
+	}
+	if message.ServiceAccountAction == serviceAccountList {
+		accounts, err := h.db.AllServiceAccounts(h.serviceAccounts)
+		if err != nil {
+			return toOriginWithError(message, err)
+		}
+		returnMessage := toOriginWithStatus(message, wscodes.StatusSuccess, "")
+		returnMessage.ServiceAccounts = accounts
+		return returnMessage
+	}
+	if message.ServiceAccount == nil {
+		return toOriginWithError(message, wscodes.NewError(wscodes.StatusInvalidRequest, "service account not given"))
+	}
+	var account *collections.ServiceAccount
+	var err error
+	switch message.ServiceAccountAction {
+	case serviceAccountCreate:
+		account, err = h.createServiceAccount(message.ServiceAccount.Name, message.ServiceAccount.Role, message.client.userID)
+	case serviceAccountRotate:
+		account, err = h.rotateServiceAccountKey(message.ServiceAccount.ID)
+	case serviceAccountRevoke:
+		account, err = h.revokeServiceAccount(message.ServiceAccount.ID)
+	default:
+		err = wscodes.NewError(wscodes.StatusInvalidRequest, "unknown service account action").
+			WithDetail("serviceAccountAction", message.ServiceAccountAction)
+	}
 	if err != nil {
-		ret.Route = append(ret.Route, routeOrigin)
-		ret.Status = wscodes.StatusEndpointUnauthorized
-	} else {
-		ret.Route = append(ret.Route, routeBroadcast)
-		ret.Status = wscodes.StatusOperationCommitted
+		return toOriginWithError(message, err)
 	}
-	return ret
+	h.recordAudit(message.client.userID, serviceAccountAuditActions[message.ServiceAccountAction], account.ID, "", account.Role)
+	returnMessage := toOriginWithStatus(message, wscodes.StatusOperationCommitted, "")
+	returnMessage.ServiceAccount = account
+	return returnMessage
+}
+
+// createServiceAccount adds a service account with the role to the hub, giving it with its key.
+// Service accounts can't have roles with any of the AdminPermissions, so that a leaked key can't be
+// used to take over the hub.
+func (h *Hub) createServiceAccount(name, role, creator string) (*collections.ServiceAccount, error) {
+	permissions, err := h.auth.RolePermissions(role)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range collabauth.AdminPermissions {
+		if role == collabauth.NoRole || collabauth.HasPermission(permissions, p) {
+			return nil, wscodes.NewError(wscodes.StatusInvalidRequest,
+				"service accounts can't have roles that manage the hub").WithDetail("role", role)
+		}
+	}
+	creatorPermissions, err := h.auth.UserPermissions(creator)
+	if err != nil || !collabauth.HasAllPermissions(creatorPermissions, permissions) {
+		return nil, errUnauthorized
+	}
+	id, err := apikeys.NewAccountID()
+	if err != nil {
+		return nil, err
+	}
+	key, hash, err := apikeys.New(h.name, id)
+	if err != nil {
+		return nil, err
+	}
+	account := collections.ServiceAccount{
+		ID:        id,
+		Name:      name,
+		Role:      role,
+		KeyHash:   hash,
+		Created:   time.Now(),
+		CreatedBy: creator,
+	}
+	if _, err := h.db.AddEntry(h.serviceAccounts, id, account); err != nil {
+		return nil, err
+	}
+	userID := apikeys.UserID(h.name, id)
+	_, err = h.db.AddEntry(h.users, "", collections.AuthEntry{
+		UserID: userID,
+		Role:   role,
+		Status: hubcodes.UserOffline,
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.db.UpdateUsersHubList(userID, h.name, role)
+	log.Printf("Created service account %s in hub %s as %s, requested by %s", id, h.name, role, creator)
+	account.Key = key
+	return &account, nil
+}
+
+// rotateServiceAccountKey gives the service account a new key, after which the old one no longer works.
+func (h *Hub) rotateServiceAccountKey(id string) (*collections.ServiceAccount, error) {
+	account, ref, err := h.serviceAccount(id)
+	if err != nil {
+		return nil, err
+	}
+	key, hash, err := apikeys.New(h.name, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.db.UpdateEntry(ref, hubcodes.ServiceAccountKeyHashKey, hash); err != nil {
+		return nil, err
+	}
+	account.Key = key
+	return account, nil
+}
+
+// revokeServiceAccount stops the service account's key from working and takes away its role,
+// disconnecting it from the hub if it's connected. Revoked accounts are kept so that the operations
+// they committed can still be told apart.
+func (h *Hub) revokeServiceAccount(id string) (*collections.ServiceAccount, error) {
+	account, ref, err := h.serviceAccount(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.db.UpdateEntry(ref, hubcodes.ServiceAccountRevokedKey, true); err != nil {
+		return nil, err
+	}
+	account.Revoked = true
+	userID := apikeys.UserID(h.name, id)
+	authRef, err := h.db.EntryForFieldValue(h.users, hubcodes.UserIDKey, userID, nil)
+	if err == nil {
+		err = h.db.UpdateEntry(authRef, collabauth.Role, collabauth.NoRole)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.db.UpdateUsersHubList(userID, h.name, collabauth.NoRole)
+	h.applyRoleChange(userID, collabauth.NoRole)
+	return account, nil
+}
+
+// serviceAccount gives the hub's service account with the ID, which mustn't be revoked.
+func (h *Hub) serviceAccount(id string) (*collections.ServiceAccount, *firestore.DocumentRef, error) {
+	notFound := wscodes.NewError(wscodes.StatusServiceAccountDoesntExist, "service account doesn't exist").
+		WithDetail("id", id)
+	if id == "" {
+		return nil, nil, notFound
+	}
+	exists, ref, err := h.db.DocExists(id, h.serviceAccounts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, notFound
+	}
+	account := &collections.ServiceAccount{}
+	if err := h.db.EntryForRef(ref, account); err != nil {
+		return nil, nil, err
+	}
+	if account.Revoked {
+		return nil, nil, notFound
+	}
+	account.ID = id
+	return account, ref, nil
+}
+
+// handleRoles lists the hub's roles, which every member can do, or defines or deletes one of its
+// custom roles, which needs the RolesManage permission.
+func (h *Hub) handleRoles(message *Message) *Message {
+	if message.RoleAction == roleList {
+		if ok, _ := h.auth.Can(message.client.userID, collabauth.FileRead); !ok {
+			return toOriginWithError(message, errUnauthorized)
+		}
+		roles, err := h.listRoles()
+		if err != nil {
+			return toOriginWithError(message, err)
+		}
+		returnMessage := toOriginWithStatus(message, wscodes.StatusSuccess, "")
+		returnMessage.RoleDefinitions = roles
+		return returnMessage
+	}
+	permissions, err := h.auth.UserPermissions(message.client.userID)
+	if err != nil || !collabauth.HasPermission(permissions, collabauth.RolesManage) {
+		return toOriginWithError(message, errUnauthorized)
+	}
+	if message.RoleDefinition == nil {
+		return toOriginWithError(message, wscodes.NewError(wscodes.StatusInvalidRequest, "role not given"))
+	}
+	var role *collections.RoleDefinition
+	switch message.RoleAction {
+	case roleSet:
+		role, err = h.setRole(*message.RoleDefinition, permissions)
+		if err == nil {
+			h.recordAudit(message.client.userID, hubcodes.AuditRoleDefined, role.Name, "", strings.Join(role.Permissions, ","))
+		}
+	case roleDelete:
+		err = h.deleteRole(message.RoleDefinition.Name)
+		if err == nil {
+			h.recordAudit(message.client.userID, hubcodes.AuditRoleDeleted, message.RoleDefinition.Name, "", "")
+		}
+	default:
+		err = wscodes.NewError(wscodes.StatusInvalidRequest, "unknown role action").
+			WithDetail("roleAction", message.RoleAction)
+	}
+	if err != nil {
+		return toOriginWithError(message, err)
+	}
+	// Everyone is told, since roles they have may have changed.
+	return &Message{
+		UID:            message.UID,
+		Endpoint:       message.Endpoint,
+		HubName:        message.HubName,
+		RoleAction:     message.RoleAction,
+		RoleDefinition: role,
+		Route:          []string{routeBroadcast},
+		Status:         wscodes.StatusOperationCommitted,
+	}
+}
+
+// listRoles gives the built-in roles from least to most permissive, followed by the custom ones.
+func (h *Hub) listRoles() ([]collections.RoleDefinition, error) {
+	roles := []collections.RoleDefinition{}
+	for _, name := range []string{collabauth.Viewer, collabauth.Commenter, collabauth.Writer, collabauth.Owner} {
+		roles = append(roles, collections.RoleDefinition{
+			Name:        name,
+			Permissions: collabauth.BuiltinRolePermissions(name),
+			Builtin:     true,
+		})
+	}
+	custom, err := h.db.AllRoleDefinitions(h.roles)
+	if err != nil {
+		return nil, err
+	}
+	for i := range custom {
+		custom[i].Permissions = collabauth.KnownPermissions(custom[i].Permissions)
+	}
+	return append(roles, custom...), nil
+}
+
+// setRole defines the custom role, or changes the permissions of an existing one. Users can only
+// give roles permissions they have themselves.
+func (h *Hub) setRole(role collections.RoleDefinition, permissions []string) (*collections.RoleDefinition, error) {
+	role, err := collabauth.CheckRoleDefinition(role)
+	if err != nil {
+		return nil, err
+	}
+	if !collabauth.HasAllPermissions(permissions, role.Permissions) {
+		return nil, errUnauthorized
+	}
+	exists, ref, err := h.db.DocExists(role.Name, h.roles)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		_, err = h.db.AddEntry(h.roles, role.Name, role)
+	} else if err = h.db.UpdateEntry(ref, collabauth.Permissions, role.Permissions); err == nil {
+		// The role may be being defined again after having been deleted.
+		err = h.db.UpdateEntry(ref, collabauth.Deleted, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.auth.Forget("")
+	// Connected members with the role now have different permissions.
+	affected := map[string]bool{}
+	for client := range h.clients {
+		if client.getRole() == role.Name {
+			affected[client.userID] = true
+		}
+	}
+	for userID := range affected {
+		h.applyRoleChange(userID, role.Name)
+	}
+	return &role, nil
+}
+
+// deleteRole deletes the custom role, which no one in the hub can have.
+func (h *Hub) deleteRole(name string) error {
+	if _, err := h.auth.RolePermissions(name); err != nil {
+		return err
+	}
+	if collabauth.IsBuiltinRole(name) || name == collabauth.NoRole {
+		return wscodes.NewError(wscodes.StatusInvalidRequest, "built-in roles can't be deleted").WithDetail("role", name)
+	}
+	if ref, _ := h.db.EntryForFieldValue(h.users, collabauth.Role, name, nil); ref != nil {
+		return wscodes.NewError(wscodes.StatusRoleInUse, "role is given to members of the hub").WithDetail("role", name)
+	}
+	// Invites and invitations that could still be used would otherwise give members a role that
+	// doesn't exist.
+	invites, err := h.db.AllInvites(h.invites)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, invite := range invites {
+		// Invites limited to an email domain can still be used by someone at it.
+		if err := checkInvite(&invite, "", now); invite.Role == name && (err == nil || err == errInviteEmailDomain) {
+			return wscodes.NewError(wscodes.StatusRoleInUse, "role is given by invites to the hub").
+				WithDetail("role", name).WithDetail("invite", invite.ID)
+		}
+	}
+	invitations, err := h.db.HubPendingInvitations(h.name)
+	if err != nil {
+		return err
+	}
+	for _, invitation := range invitations {
+		if invitation.Role == name {
+			return wscodes.NewError(wscodes.StatusRoleInUse, "role is given by invitations to the hub").
+				WithDetail("role", name).WithDetail("email", invitation.Email)
+		}
+	}
+	if err := h.db.DeleteDocument(h.roles.Doc(name)); err != nil {
+		return err
+	}
+	h.auth.Forget("")
+	return nil
 }
 
 func (h *Hub) handleListUser(message *Message) *Message {
 	userList, err := h.listUsers(message.client.userID)
 	if err != nil {
-		return toOriginWithStatus(message, wscodes.StatusEndpointUnauthorized, "")
+		return toOriginWithError(message, err)
 	}
 	// TODO(itsazhuhere@): this should really be a different status, because it might be confusing.
 	msg := toOriginWithStatus(message, wscodes.StatusOperationCommitted, "")
@@ -288,60 +751,344 @@ func (h *Hub) handleListUser(message *Message) *Message {
 }
 
 func (h *Hub) listUsers(requester string) ([]collections.UserInfo, error) {
-	if ok, _ := h.auth.CanRead(requester); !ok {
-		return nil, errUnauthorized
+	if h.guestLink(requester) == nil {
+		if ok, _ := h.auth.Can(requester, collabauth.FileRead); !ok {
+			return nil, errUnauthorized
+		}
 	}
 
 	return h.allUsers()
 }
 
+// allUsers gives the hub's members, followed by its guests as anonymous viewers.
 func (h *Hub) allUsers() ([]collections.UserInfo, error) {
-	return h.db.AllUsers(h.users)
+	users, err := h.db.AllUsers(h.users)
+	if err != nil {
+		return nil, err
+	}
+	return append(users, h.guestUsers()...), nil
 }
 
 func (h *Hub) handleListFiles(message *Message) *Message {
 	fileList, err := h.listFiles(message.client.userID)
 	if err != nil {
-		return toOriginWithStatus(message, wscodes.StatusEndpointUnauthorized, "")
+		return toOriginWithError(message, err)
 	}
 	// TODO(itsazhuhere@): this should really be a different status, because it might be confusing.
 	msg := toOriginWithStatus(message, wscodes.StatusOperationCommitted, "")
 	msg.FileList = fileList
+	if h.guestLink(message.client.userID) == nil {
+		msg.Permissions, _ = h.auth.UserPermissions(message.client.userID)
+	}
 	return msg
 }
 
+// listFiles gives the files the requester can read. Only those who can change roles see the
+// files' access lists.
 func (h *Hub) listFiles(requester string) ([]collections.FileInfo, error) {
-	if ok, _ := h.auth.CanRead(requester); !ok {
+	if link := h.guestLink(requester); link != nil {
+		return h.guestFiles(link)
+	}
+	role, err := h.auth.UserRole(requester)
+	if err != nil || role == collabauth.NoRole {
 		return nil, errUnauthorized
 	}
-	return h.db.AllFiles(h.files)
+	hubPermissions, err := h.auth.UserPermissions(requester)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+	files, err := h.db.AllFiles(h.files)
+	if err != nil {
+		return nil, err
+	}
+	// Most files have no access list, so the permissions of each role are only looked up once.
+	rolePermissions := map[string][]string{role: hubPermissions}
+	readable := []collections.FileInfo{}
+	for _, file := range files {
+		fileRole := collabauth.FileRole(role, requester, file.ACL)
+		permissions, ok := rolePermissions[fileRole]
+		if !ok {
+			// Roles that no longer exist give no permissions.
+			permissions, _ = h.auth.RolePermissions(fileRole)
+			rolePermissions[fileRole] = permissions
+		}
+		if !collabauth.HasPermission(permissions, collabauth.FileRead) {
+			continue
+		}
+		file.Editable = collabauth.HasPermission(permissions, collabauth.FileEdit)
+		if !collabauth.HasPermission(hubPermissions, collabauth.MembersChangeRole) {
+			file.ACL = nil
+		}
+		readable = append(readable, file)
+	}
+	return readable, nil
+}
+
+// handleFileACL replaces the access list of a file, which needs the MembersChangeRole permission.
+func (h *Hub) handleFileACL(message *Message) *Message {
+	permissions, err := h.auth.UserPermissions(message.client.userID)
+	if err != nil || !collabauth.HasPermission(permissions, collabauth.MembersChangeRole) {
+		return toOriginWithError(message, errUnauthorized)
+	}
+	for _, entry := range message.FileACL {
+		if (entry.UserID == "") == (entry.HubRole == "") {
+			return toOriginWithError(message, wscodes.NewError(wscodes.StatusInvalidRequest,
+				"access list entries need either a user or a hub role"))
+		}
+		rolePermissions, err := h.auth.RolePermissions(entry.Role)
+		if err != nil {
+			return toOriginWithError(message, err)
+		}
+		// Otherwise users could give themselves more permissions for the file through someone else.
+		if !collabauth.HasAllPermissions(permissions, rolePermissions) {
+			return toOriginWithError(message, errUnauthorized)
+		}
+	}
+	fh, err := h.fileHead(message.File)
+	if err != nil {
+		return toOriginWithError(message, fileLookupError(message.File, err))
+	}
+	acl := message.FileACL
+	if acl == nil {
+		acl = []collections.FileACLEntry{}
+	}
+	if err := h.db.UpdateEntry(fh.ref, hubcodes.FileACLKey, acl); err != nil {
+		return toOriginWithError(message, err)
+	}
+	h.recordAudit(message.client.userID, hubcodes.AuditFileAccessChanged, message.File, aclString(fh.acl), aclString(acl))
+	h.dropFileReaders(message.File, fh.acl, acl)
+	fh.acl = acl
+	returnMessage := toOriginWithStatus(message, wscodes.StatusOperationCommitted, "")
+	returnMessage.File = message.File
+	returnMessage.FileACL = acl
+	return returnMessage
+}
+
+// dropFileReaders tells the connected clients that could read the file with its old access list but
+// can't with the new one that it's gone, and disconnects them, so that they don't keep working on it.
+func (h *Hub) dropFileReaders(fileName string, oldACL, newACL []collections.FileACLEntry) {
+	for client := range h.clients {
+		if !h.canReadWithACL(client, fileName, oldACL) || h.canReadWithACL(client, fileName, newACL) {
+			continue
+		}
+		h.sendMessage(client, &Message{
+			Endpoint: endpointFileDelete,
+			HubName:  h.name,
+			File:     fileName,
+			Route:    []string{client.userID},
+			Status:   wscodes.StatusOperationCommitted,
+		})
+		// sendMessage unregisters clients it can't send to.
+		if _, ok := h.clients[client]; ok {
+			log.Printf("Disconnecting user %s from hub %s, since they can no longer read file %s", client.userID, h.name, fileName)
+			h.unregisterClient(client)
+		}
+	}
+}
+
+// accessibleFileHead gives the cached head of the file if the user has the permission for it.
+func (h *Hub) accessibleFileHead(userID, fileName, permission string) (*fileHead, error) {
+	fh, err := h.fileHead(fileName)
+	if err != nil {
+		log.Printf("error from fileHead: %s", err.Error())
+		return nil, fileLookupError(fileName, err)
+	}
+	if err := h.checkFileAccess(userID, fileName, fh.acl, permission); err != nil {
+		return nil, err
+	}
+	return fh, nil
+}
+
+// checkFileAccess checks that the user has the permission for a file with the access list. Files
+// the user can't read are reported as not existing, so that hidden files stay hidden.
+func (h *Hub) checkFileAccess(userID, fileName string, acl []collections.FileACLEntry, permission string) error {
+	if link := h.guestLink(userID); link != nil {
+		if !h.guestCanRead(link, fileName, acl) {
+			return fileLookupError(fileName, iterator.Done)
+		}
+		if permission != collabauth.FileRead {
+			return errUnauthorized
+		}
+		return nil
+	}
+	role, err := h.auth.UserRole(userID)
+	if err != nil {
+		return errUnauthorized
+	}
+	permissions, err := h.auth.RolePermissions(collabauth.FileRole(role, userID, acl))
+	if err != nil || !collabauth.HasPermission(permissions, collabauth.FileRead) {
+		return fileLookupError(fileName, iterator.Done)
+	}
+	if !collabauth.HasPermission(permissions, permission) {
+		return errUnauthorized
+	}
+	return nil
+}
+
+// canReadFile reports whether the client can read the file, going by the role it had when it
+// connected. Files whose access list can't be read are hidden from everyone.
+func (h *Hub) canReadFile(client *Client, fileName string) bool {
+	acl, err := h.fileACL(fileName)
+	if err != nil {
+		log.Printf("Error reading the access list of file %s in hub %s: %v", fileName, h.name, err)
+		return false
+	}
+	return h.canReadWithACL(client, fileName, acl)
+}
+
+// canReadWithACL reports whether the client can read a file with the access list.
+func (h *Hub) canReadWithACL(client *Client, fileName string, acl []collections.FileACLEntry) bool {
+	if client.guest != nil {
+		return h.guestCanRead(&client.guest.link, fileName, acl)
+	}
+	if len(acl) == 0 {
+		return true
+	}
+	permissions, err := h.auth.RolePermissions(collabauth.FileRole(client.getRole(), client.userID, acl))
+	return err == nil && collabauth.HasPermission(permissions, collabauth.FileRead)
 }
 
 // AddUser adds a user, after first checking if requester is able to add users.
 // Since a hub requires an owner on init, calling this function should mean at least one owner exists.
 func (h *Hub) AddUser(toAdd, requester, role string) error {
 	log.Printf("Adding user %s as %s to hub %s requested by %s", toAdd, role, h.name, requester)
-	ok, _ := h.auth.CanChangeUsers(requester)
-	if !ok {
+	permissions, err := h.auth.UserPermissions(requester)
+	if err != nil || (!collabauth.HasPermission(permissions, collabauth.MembersInvite) &&
+		!collabauth.HasPermission(permissions, collabauth.MembersChangeRole)) {
 		log.Print("User can't change other users")
 		return errUnauthorized
 	}
+	rolePermissions, err := h.auth.RolePermissions(role)
+	if err != nil {
+		return err
+	}
+	// Otherwise users could give themselves more permissions through someone else.
+	if !collabauth.HasAllPermissions(permissions, rolePermissions) {
+		log.Printf("User can't give the role %s, which has permissions they don't", role)
+		return errUnauthorized
+	}
 	userIDs, err := h.db.UserIDsForEmails([]string{toAdd})
 	if err != nil {
 		return err
 	}
-	var userID string
-	if userID, ok = userIDs[toAdd]; !ok {
-		return errors.New("Email not found")
+	userID, ok := userIDs[toAdd]
+	if !ok {
+		return h.setPendingInvitation(toAdd, requester, role, permissions)
 	}
 	log.Printf("Got id from email: %s", userID)
 	authEntry := &collections.AuthEntry{}
 	// Currenly just using this for checking for the existence of docRef.
 	docRef, _ := h.db.EntryForFieldValue(h.users, hubcodes.UserIDKey, userID, authEntry)
+	// Adding someone who isn't a member is inviting them, while anything else is changing their role.
+	needed := collabauth.MembersChangeRole
+	if docRef == nil || authEntry.Role == collabauth.NoRole {
+		needed = collabauth.MembersInvite
+	} else if current, err := h.auth.RolePermissions(authEntry.Role); err == nil &&
+		!collabauth.HasAllPermissions(permissions, current) {
+		log.Printf("User can't change the role of a %s, which has permissions they don't", authEntry.Role)
+		return errUnauthorized
+	}
+	if !collabauth.HasPermission(permissions, needed) {
+		log.Printf("User doesn't have the %s permission", needed)
+		return errUnauthorized
+	}
+	if docRef != nil {
+		if err := h.checkOwnerRemains(authEntry.Role, role); err != nil {
+			return err
+		}
+	}
+	before := collabauth.NoRole
+	if docRef != nil {
+		before = authEntry.Role
+	}
+	if err := setMemberRole(h.db, h.users, h.name, userID, role, docRef); err != nil {
+		return err
+	}
+	h.recordAudit(requester, memberAuditAction(before, role), userID, before, role)
+	h.applyRoleChange(userID, role)
+	return nil
+}
+
+// applyRoleChange brings the hub up to date with the user's role, first forgetting what h.auth
+// remembers of it. The user's connected clients are told of it with a ROLE_CHANGED message.
+// Clients whose role no longer lets them read the hub are handed back to the Connector. The others
+// keep getting broadcasts only about files their new role can read, since those follow the
+// client's role.
+func (h *Hub) applyRoleChange(userID, role string) {
+	h.auth.Forget(userID)
+	permissions, err := h.auth.RolePermissions(role)
+	if err != nil {
+		permissions = []string{}
+	}
+	if apikeys.IsServiceAccount(userID) {
+		permissions = collabauth.WithoutAdminPermissions(permissions)
+	}
+	canRead := collabauth.HasPermission(permissions, collabauth.FileRead)
+	for client := range h.clients {
+		if client.userID != userID {
+			continue
+		}
+		client.setRole(role)
+		h.sendMessage(client, &Message{
+			Endpoint:       endpointRoleChanged,
+			HubName:        h.name,
+			ModifyUserRole: role,
+			Permissions:    permissions,
+			Route:          []string{userID},
+			Status:         wscodes.StatusSuccess,
+		})
+		// sendMessage unregisters clients it can't send to.
+		if _, ok := h.clients[client]; ok && !canRead {
+			log.Printf("Disconnecting user %s from hub %s, since their role %s can't read it", userID, h.name, role)
+			h.unregisterClient(client)
+		}
+	}
+}
+
+// setPendingInvitation invites the email, which no one has signed up with, to the hub with the role
+// once they sign up. A role of collabauth.NoRole takes back the invitation.
+func (h *Hub) setPendingInvitation(email, requester, role string, permissions []string) error {
+	notFound := wscodes.NewError(wscodes.StatusUserNotFound, "email not found").WithDetail("email", email)
+	if role == collabauth.NoRole {
+		deleted, err := h.db.DeletePendingInvitation(email, h.name)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return notFound
+		}
+		h.recordAudit(requester, hubcodes.AuditInvitationRevoked, email, "", "")
+		return nil
+	}
+	if !strings.Contains(email, "@") {
+		return notFound
+	}
+	if !collabauth.HasPermission(permissions, collabauth.MembersInvite) {
+		log.Printf("User doesn't have the %s permission", collabauth.MembersInvite)
+		return errUnauthorized
+	}
+	log.Printf("No user has the email %s yet, so they'll join hub %s once they sign up", email, h.name)
+	err := h.db.SetPendingInvitation(collections.PendingInvitation{
+		Email:     email,
+		Hub:       h.name,
+		Role:      role,
+		InvitedBy: requester,
+		Created:   time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	h.recordAudit(requester, hubcodes.AuditMemberInvited, email, "", role)
+	return nil
+}
+
+// setMemberRole gives the user the role in the hub with the users collection, adding them to it if
+// docRef, their entry in users, is nil. It doesn't check that anyone may do so.
+func setMemberRole(db datastore, users *firestore.CollectionRef, hubName, userID, role string, docRef *firestore.DocumentRef) error {
 	if docRef == nil {
 		// Usually means the user's role hasn't been set for a hub, so we add them to it.
 		var err error
-		docRef, err = h.db.AddEntry(h.users, "", collections.AuthEntry{
+		docRef, err = db.AddEntry(users, "", collections.AuthEntry{
 			UserID: userID,
 			Role:   collabauth.NoRole,
 			Status: hubcodes.UserOffline,
@@ -354,12 +1101,12 @@ func (h *Hub) AddUser(toAdd, requester, role string) error {
 		Path:  collabauth.Role,
 		Value: role,
 	}
-	_, err = docRef.Update(context.Background(), []firestore.Update{update})
+	_, err := docRef.Update(context.Background(), []firestore.Update{update})
 	if err != nil {
 		return err
 	}
 	// Also update their entry in the user to hubs collection
-	h.db.UpdateUsersHubList(userID, h.name, role)
+	db.UpdateUsersHubList(userID, hubName, role)
 
 	return err
 }
@@ -367,7 +1114,7 @@ func (h *Hub) AddUser(toAdd, requester, role string) error {
 // ConnectUser marks a user as actively viewing a hub (so that other users in the hub can see).
 // For now it just checks that a user is able to view a hub.
 func (h *Hub) ConnectUser(userID string) error {
-	ok, docRef := h.auth.CanRead(userID)
+	ok, docRef := h.auth.Can(userID, collabauth.FileRead)
 	if !ok {
 		return errUnauthorized
 	}
@@ -390,6 +1137,8 @@ func (h *Hub) DisconnectUser(userID string) error {
 
 func (h *Hub) hubConnectSuccessMessage(client *Client) *Message {
 	return &Message{
+		UID:      client.connectRequestUID,
+		ReplyTo:  client.connectRequestUID,
 		Status:   wscodes.StatusSuccess,
 		Endpoint: endpointConnectToHub,
 		Route:    append([]string{}, routeOrigin),
@@ -401,9 +1150,52 @@ func (h *Hub) hubConnectSuccessMessage(client *Client) *Message {
 func toOriginWithStatus(message *Message, status string, text string) *Message {
 	return &Message{
 		UID:      message.UID,
+		ReplyTo:  message.UID,
 		Status:   status,
 		Text:     text,
 		Endpoint: message.Endpoint,
 		Route:    append([]string{}, routeOrigin),
 	}
 }
+
+// toOriginWithError gives a reply to the message's sender reporting err. The error's code is also
+// used as the status, for clients that only look at the status.
+func toOriginWithError(message *Message, err error) *Message {
+	e := wscodes.AsError(err)
+	ret := toOriginWithStatus(message, e.Code, e.Message)
+	ret.Error = e
+	return ret
+}
+
+// fileLookupError gives the error to report when looking up a file by name failed.
+func fileLookupError(fileName string, err error) *wscodes.Error {
+	if err == iterator.Done {
+		return wscodes.NewError(wscodes.StatusFileDoesntExist, "file doesn't exist").WithDetail("file", fileName)
+	}
+	return wscodes.AsError(err)
+}
+
+// fileExistsError gives the error to report when a file can't be created because it already exists.
+func fileExistsError(fileName string) *wscodes.Error {
+	return wscodes.NewError(wscodes.StatusFileExists, "file already exists").WithDetail("file", fileName)
+}
+
+func rateLimitedMessage(message *Message, retryAfter time.Duration) *Message {
+	retryAfterMillis := int64(retryAfter / time.Millisecond)
+	ret := toOriginWithError(message, wscodes.NewError(wscodes.StatusRateLimited, "too many requests").
+		WithDetail("retryAfter", strconv.FormatInt(retryAfterMillis, 10)))
+	ret.RetryAfter = retryAfterMillis
+	return ret
+}
+
+// aclString gives the access list as JSON, for the audit log.
+func aclString(acl []collections.FileACLEntry) string {
+	if len(acl) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(acl)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
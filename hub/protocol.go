@@ -0,0 +1,112 @@
+package hub
+
+import (
+	wscodes "collabserver/websocketcodes"
+	"strconv"
+)
+
+const (
+	// protocolV1 is the original protocol, spoken by clients that never send HELLO.
+	protocolV1 = 1
+	// protocolV2 adds the HELLO handshake, optional features, and the status codes added since v1.
+	protocolV2 = 2
+
+	minProtocolVersion = protocolV1
+	maxProtocolVersion = protocolV2
+)
+
+var (
+	// serverFeatures are the optional features that clients can ask for in HELLO.
+	serverFeatures = []string{featureCBOR, featureAcks}
+
+	// protocolAdapters convert outgoing messages to what clients of older protocol versions
+	// understand. Messages from older clients are a subset of newer ones so need no converting.
+	protocolAdapters = map[int]func(*Message) *Message{
+		protocolV1: toProtocolV1,
+		protocolV2: func(message *Message) *Message { return message },
+	}
+
+	// v1Statuses are the statuses that v1 clients know how to handle.
+	v1Statuses = map[string]bool{
+		wscodes.StatusOperationCommitted:   true,
+		wscodes.StatusSuccess:              true,
+		wscodes.StatusFailure:              true,
+		wscodes.StatusOperationCommitError: true,
+		wscodes.StatusOperationTooNew:      true,
+		wscodes.StatusOperationTooOld:      true,
+		wscodes.StatusEndpointNotValid:     true,
+		wscodes.StatusEndpointUnauthorized: true,
+		wscodes.StatusFileDoesntExist:      true,
+		wscodes.StatusFileExists:           true,
+		wscodes.StatusFileCreateFailed:     true,
+		wscodes.StatusNotConnectedToHub:    true,
+	}
+)
+
+// handleHello agrees on a protocol version and feature set with the client, picking the highest
+// version both sides support and the features both sides know of.
+func (c *Client) handleHello(message *Message) *Message {
+	version := message.ProtocolVersion
+	if version > maxProtocolVersion {
+		version = maxProtocolVersion
+	}
+	if version < minProtocolVersion {
+		return toOriginWithError(message, wscodes.Errorf(wscodes.StatusProtocolUnsupported,
+			"supported protocol versions are %d to %d", minProtocolVersion, maxProtocolVersion).
+			WithDetail("minVersion", strconv.Itoa(minProtocolVersion)).
+			WithDetail("maxVersion", strconv.Itoa(maxProtocolVersion)))
+	}
+	features := map[string]bool{}
+	enabled := []string{}
+	for _, requested := range message.Features {
+		if requested == featureCBOR && c.textOnly {
+			continue
+		}
+		for _, supported := range serverFeatures {
+			if requested == supported && !features[requested] {
+				features[requested] = true
+				enabled = append(enabled, requested)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.protocol = version
+	c.features = features
+	c.mu.Unlock()
+
+	ret := toOriginWithStatus(message, wscodes.StatusSuccess, "")
+	ret.ProtocolVersion = version
+	ret.Features = enabled
+	return ret
+}
+
+// adaptToProtocol converts the message to the client's protocol version.
+func (c *Client) adaptToProtocol(message *Message) *Message {
+	c.mu.Lock()
+	version := c.protocol
+	c.mu.Unlock()
+	return protocolAdapters[version](message)
+}
+
+// protocolVersion gives the protocol version agreed on with the client.
+func (c *Client) protocolVersion() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.protocol
+}
+
+// toProtocolV1 replaces statuses that v1 clients don't know with a generic failure, keeping the
+// original status in the text. Messages can be shared between clients, so it works on a copy.
+func toProtocolV1(message *Message) *Message {
+	if message.Status == "" || v1Statuses[message.Status] {
+		return message
+	}
+	adapted := *message
+	adapted.Status = wscodes.StatusFailure
+	adapted.Text = message.Status
+	if message.Text != "" {
+		adapted.Text += ": " + message.Text
+	}
+	return &adapted
+}
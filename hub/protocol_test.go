@@ -0,0 +1,65 @@
+package hub
+
+import (
+	wscodes "collabserver/websocketcodes"
+	"testing"
+)
+
+func TestHandleHello(t *testing.T) {
+	cases := []struct {
+		name        string
+		version     int
+		wantStatus  string
+		wantVersion int
+	}{
+		{
+			name:        "supported version is agreed on",
+			version:     protocolV1,
+			wantStatus:  wscodes.StatusSuccess,
+			wantVersion: protocolV1,
+		},
+		{
+			name:        "newer version is lowered to the server's",
+			version:     maxProtocolVersion + 1,
+			wantStatus:  wscodes.StatusSuccess,
+			wantVersion: maxProtocolVersion,
+		},
+		{
+			name:        "older version is rejected",
+			version:     minProtocolVersion - 1,
+			wantStatus:  wscodes.StatusProtocolUnsupported,
+			wantVersion: protocolV1,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &Client{protocol: protocolV1}
+			reply := client.handleHello(&Message{Endpoint: endpointHello, ProtocolVersion: tc.version})
+			if reply.Status != tc.wantStatus {
+				t.Errorf("handleHello gave status %s but want %s", reply.Status, tc.wantStatus)
+			}
+			if client.protocol != tc.wantVersion {
+				t.Errorf("client has protocol version %d after HELLO but want %d", client.protocol, tc.wantVersion)
+			}
+		})
+	}
+}
+
+func TestToProtocolV1(t *testing.T) {
+	original := &Message{Status: wscodes.StatusRateLimited, Text: "too many requests"}
+	adapted := toProtocolV1(original)
+	if adapted.Status != wscodes.StatusFailure {
+		t.Errorf("toProtocolV1 gave status %s but want %s", adapted.Status, wscodes.StatusFailure)
+	}
+	if want := wscodes.StatusRateLimited + ": too many requests"; adapted.Text != want {
+		t.Errorf("toProtocolV1 gave text %q but want %q", adapted.Text, want)
+	}
+	if original.Status != wscodes.StatusRateLimited {
+		t.Error("toProtocolV1 changed the original message")
+	}
+
+	known := &Message{Status: wscodes.StatusOperationTooOld}
+	if toProtocolV1(known) != known {
+		t.Error("toProtocolV1 changed a message v1 clients understand")
+	}
+}
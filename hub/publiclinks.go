@@ -0,0 +1,332 @@
+package hub
+
+import (
+	"collabserver/apikeys"
+	log "collabserver/cloudlog"
+	"collabserver/collabauth"
+	"collabserver/collections"
+	"collabserver/hubcodes"
+	wscodes "collabserver/websocketcodes"
+	"net/http"
+	"time"
+)
+
+// Public links let people without an account read a hub, or one of its files, as guests. Guests
+// get a user ID of their own for each connection, never have an entry in the hub's authorization
+// collection, and can only use the endpoints in guestEndpoints.
+
+const (
+	// The role guests have in the hub, as far as access lists and rate limits are concerned.
+	// They can still only ever read files, whatever an access list gives the role.
+	guestRole = collabauth.Viewer
+	// Guests' user IDs start with this, which neither users' nor service accounts' do.
+	guestIDPrefix = "guest:"
+
+	publicLinkIDBytes = 8
+	guestIDBytes      = 8
+)
+
+var (
+	errPublicLinkInvalid = wscodes.NewError(wscodes.StatusPublicLinkInvalid, "public link is invalid")
+
+	// guestEndpoints are the endpoints guests can use once in a hub, none of which change anything.
+	guestEndpoints = map[string]bool{
+		endpointFileRetrieve:      true,
+		endpointListFiles:         true,
+		endpointListUsers:         true,
+		endpointDisconnectFromHub: true,
+	}
+)
+
+// guestPass is what a guest connected with: a public link and the hub it's for.
+type guestPass struct {
+	hubName string
+	link    collections.PublicLink
+}
+
+// handlePublicLinks lists, creates or revokes the hub's public links, which needs the MembersInvite
+// permission.
+func (h *Hub) handlePublicLinks(message *Message) *Message {
+	userID := message.client.userID
+	if ok, _ := h.auth.Can(userID, collabauth.MembersInvite); !ok {
+		return toOriginWithError(message, errUnauthorized)
+	}
+	if message.PublicLinkAction == publicLinkList {
+		links, err := h.db.AllPublicLinks(h.publicLinks)
+		if err != nil {
+			return toOriginWithError(message, err)
+		}
+		returnMessage := toOriginWithStatus(message, wscodes.StatusSuccess, "")
+		returnMessage.PublicLinks = links
+		return returnMessage
+	}
+	if message.PublicLink == nil {
+		return toOriginWithError(message, wscodes.NewError(wscodes.StatusInvalidRequest, "public link not given"))
+	}
+	var link *collections.PublicLink
+	var err error
+	action := hubcodes.AuditPublicLinkCreated
+	switch message.PublicLinkAction {
+	case publicLinkCreate:
+		link, err = h.createPublicLink(message.PublicLink.File, userID)
+	case publicLinkRevoke:
+		link, err = h.revokePublicLink(message.PublicLink.ID)
+		action = hubcodes.AuditPublicLinkRevoked
+	default:
+		err = wscodes.NewError(wscodes.StatusInvalidRequest, "unknown public link action").
+			WithDetail("publicLinkAction", message.PublicLinkAction)
+	}
+	if err != nil {
+		return toOriginWithError(message, err)
+	}
+	recordAudit(h.db, h.ref, collections.AuditEntry{
+		Actor:   userID,
+		Action:  action,
+		Target:  link.File,
+		Details: map[string]string{"publicLink": link.ID},
+	})
+	returnMessage := toOriginWithStatus(message, wscodes.StatusOperationCommitted, "")
+	returnMessage.PublicLink = link
+	return returnMessage
+}
+
+// createPublicLink adds a public link to the file, or to the whole hub if fileName is "", giving it
+// along with its token. The creator must be able to read the file.
+func (h *Hub) createPublicLink(fileName, creator string) (*collections.PublicLink, error) {
+	if fileName != "" {
+		if _, err := h.accessibleFileHead(creator, fileName, collabauth.FileRead); err != nil {
+			return nil, err
+		}
+	}
+	id, err := apikeys.RandomHex(publicLinkIDBytes)
+	if err != nil {
+		return nil, err
+	}
+	// Public link tokens are made like invite tokens, and name the hub the same way.
+	token, hash, err := newHubToken(h.name, id)
+	if err != nil {
+		return nil, err
+	}
+	link := collections.PublicLink{
+		ID:        id,
+		File:      fileName,
+		TokenHash: hash,
+		Created:   time.Now(),
+		CreatedBy: creator,
+	}
+	if _, err := h.db.AddEntry(h.publicLinks, id, link); err != nil {
+		return nil, err
+	}
+	log.Printf("Created public link %s to hub %s for %q, requested by %s", id, h.name, fileName, creator)
+	link.Token = token
+	return &link, nil
+}
+
+// revokePublicLink stops the public link from working, disconnecting the guests who came in with it.
+func (h *Hub) revokePublicLink(id string) (*collections.PublicLink, error) {
+	notFound := wscodes.NewError(wscodes.StatusPublicLinkDoesntExist, "public link doesn't exist").WithDetail("id", id)
+	if id == "" {
+		return nil, notFound
+	}
+	exists, ref, err := h.db.DocExists(id, h.publicLinks)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, notFound
+	}
+	link := &collections.PublicLink{}
+	if err := h.db.EntryForRef(ref, link); err != nil {
+		return nil, err
+	}
+	if err := h.db.UpdateEntry(ref, hubcodes.PublicLinkRevokedKey, true); err != nil {
+		return nil, err
+	}
+	link.ID = id
+	link.Revoked = true
+	for client := range h.clients {
+		if client.guest != nil && client.guest.link.ID == id {
+			h.unregisterClient(client)
+		}
+	}
+	return link, nil
+}
+
+// renamePublicLinks keeps the public links to a file working once it's renamed, along with the
+// connections of the guests who came in with them.
+func (h *Hub) renamePublicLinks(fileName, newFileName string) {
+	links, err := h.db.AllPublicLinks(h.publicLinks)
+	if err != nil {
+		log.Printf("Error getting the public links of hub %s to rename %s: %v", h.name, fileName, err)
+		return
+	}
+	for _, link := range links {
+		if link.File != fileName {
+			continue
+		}
+		if err := h.db.UpdateEntry(h.publicLinks.Doc(link.ID), hubcodes.PublicLinkFileKey, newFileName); err != nil {
+			log.Printf("Error renaming the file of public link %s of hub %s: %v", link.ID, h.name, err)
+		}
+	}
+	h.guestsMu.Lock()
+	defer h.guestsMu.Unlock()
+	for _, link := range h.guests {
+		if link.File == fileName {
+			link.File = newFileName
+		}
+	}
+}
+
+// admitGuest lets the guest into the hub if their public link is for it and still works.
+func (h *Hub) admitGuest(client *Client) error {
+	link := &client.guest.link
+	if client.guest.hubName != h.name {
+		return errUnauthorized
+	}
+	// The link may have been revoked or its file renamed since the guest connected.
+	current := collections.PublicLink{}
+	if err := h.db.EntryForRef(h.publicLinks.Doc(link.ID), &current); err != nil || current.Revoked {
+		return errPublicLinkInvalid
+	}
+	link.File = current.File
+	client.setRole(guestRole)
+	h.guestsMu.Lock()
+	defer h.guestsMu.Unlock()
+	h.guests[client.userID] = link
+	return nil
+}
+
+func (h *Hub) removeGuest(userID string) {
+	h.guestsMu.Lock()
+	defer h.guestsMu.Unlock()
+	delete(h.guests, userID)
+}
+
+// guestLink gives the public link of the guest in the hub with the user ID, or nil if the user
+// isn't a guest.
+func (h *Hub) guestLink(userID string) *collections.PublicLink {
+	h.guestsMu.Lock()
+	defer h.guestsMu.Unlock()
+	return h.guests[userID]
+}
+
+// guestUsers gives the hub's guests as anonymous viewers, to be listed along with its members.
+func (h *Hub) guestUsers() []collections.UserInfo {
+	h.guestsMu.Lock()
+	defer h.guestsMu.Unlock()
+	users := []collections.UserInfo{}
+	for range h.guests {
+		users = append(users, collections.UserInfo{
+			Role:      guestRole,
+			Status:    hubcodes.UserOnline,
+			Anonymous: true,
+		})
+	}
+	return users
+}
+
+// guestCanRead reports whether a guest with the link can read a file with the access list. Links
+// to a file only show that file, and links to the hub show the files its viewers can read.
+func (h *Hub) guestCanRead(link *collections.PublicLink, fileName string, acl []collections.FileACLEntry) bool {
+	if link.File != "" {
+		return link.File == fileName
+	}
+	permissions, err := h.auth.RolePermissions(collabauth.FileRole(guestRole, "", acl))
+	return err == nil && collabauth.HasPermission(permissions, collabauth.FileRead)
+}
+
+// guestFiles gives the files a guest with the link can read, without their access lists.
+func (h *Hub) guestFiles(link *collections.PublicLink) ([]collections.FileInfo, error) {
+	files, err := h.db.AllFiles(h.files)
+	if err != nil {
+		return nil, err
+	}
+	readable := []collections.FileInfo{}
+	for _, file := range files {
+		if h.guestCanRead(link, file.Name, file.ACL) {
+			file.ACL = nil
+			readable = append(readable, file)
+		}
+	}
+	return readable, nil
+}
+
+// checkGuestRequest turns away a guest's request if it's for anything but reading the hub, giving
+// the reply if so. Requests from members are left alone.
+func checkGuestRequest(message *Message) *Message {
+	if message.client == nil || message.client.guest == nil {
+		return nil
+	}
+	if !guestEndpoints[message.Endpoint] {
+		return toOriginWithError(message, errUnauthorized)
+	}
+	// Retrieving an empty file would otherwise let the guest give it its first state.
+	message.FileState = ""
+	return nil
+}
+
+// guestCanAsk reports whether a guest that isn't in a hub yet can make the request: guests can
+// only list and connect to the hub of their public link.
+func guestCanAsk(pass *guestPass, message *Message) bool {
+	switch message.Endpoint {
+	case endpointListHub:
+		return true
+	case endpointConnectToHub:
+		return message.HubName == pass.hubName
+	}
+	return false
+}
+
+// guestPass checks the public link token, giving the pass of a guest who connects with it.
+func (hc *Connector) guestPass(token string) (*guestPass, error) {
+	hubName, linkID, secret, err := parseHubToken(token)
+	if err != nil {
+		return nil, errPublicLinkInvalid
+	}
+	exists, hubRef, err := hc.db.DocExists(hubName, hc.db.CollectionForID(hubsID, nil))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errPublicLinkInvalid
+	}
+	link := collections.PublicLink{}
+	if err := hc.db.EntryForRef(hubRef.Collection(publicLinksID).Doc(linkID), &link); err != nil {
+		return nil, errPublicLinkInvalid
+	}
+	if link.Revoked || !apikeys.Matches(secret, link.TokenHash) {
+		return nil, errPublicLinkInvalid
+	}
+	link.ID = linkID
+	return &guestPass{hubName: hubName, link: link}, nil
+}
+
+// newGuestID gives a user ID for a new guest.
+func newGuestID() (string, error) {
+	id, err := apikeys.RandomHex(guestIDBytes)
+	if err != nil {
+		return "", err
+	}
+	return guestIDPrefix + id, nil
+}
+
+// ServeGuestWs handles the websocket connection of a guest with the public link token, who can then
+// connect to the link's hub and read it without signing in.
+func (hc *Connector) ServeGuestWs(token string, w http.ResponseWriter, r *http.Request, response http.Header) {
+	pass, err := hc.guestPass(token)
+	if err != nil {
+		http.Error(w, wscodes.AsError(err).Message, http.StatusForbidden)
+		return
+	}
+	guestID, err := newGuestID()
+	if err != nil {
+		log.Printf("Error making a guest ID: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	client := startClient(guestID, pass, w, r, response)
+	if client == nil {
+		return
+	}
+	go hc.respondUntilHandoff(client)
+}
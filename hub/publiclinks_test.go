@@ -0,0 +1,108 @@
+package hub
+
+import (
+	"collabserver/collabauth"
+	"collabserver/collections"
+	wscodes "collabserver/websocketcodes"
+	"testing"
+)
+
+func TestCheckGuestRequest(t *testing.T) {
+	guest := &Client{userID: "guest:1", guest: &guestPass{hubName: "HUB"}}
+	member := &Client{userID: "member"}
+
+	for _, endpoint := range []string{endpointFileUpdate, endpointFileSave, endpointFileCreate, endpointFileRename,
+		endpointFileDelete, endpointModifyUser, endpointPassthrough, endpointPublicLinks, endpointInvites} {
+		reply := checkGuestRequest(&Message{Endpoint: endpoint, client: guest})
+		if reply == nil || reply.Error == nil || reply.Error.Code != wscodes.StatusEndpointUnauthorized {
+			t.Errorf("a guest's %s request gave %+v but want %s", endpoint, reply, wscodes.StatusEndpointUnauthorized)
+		}
+		if reply := checkGuestRequest(&Message{Endpoint: endpoint, client: member}); reply != nil {
+			t.Errorf("a member's %s request was turned away with %+v", endpoint, reply)
+		}
+	}
+
+	retrieve := &Message{Endpoint: endpointFileRetrieve, FileState: "{}", client: guest}
+	if reply := checkGuestRequest(retrieve); reply != nil {
+		t.Errorf("a guest's %s request was turned away with %+v", endpointFileRetrieve, reply)
+	}
+	if retrieve.FileState != "" {
+		t.Error("a guest's file retrieval kept the state it would give an empty file")
+	}
+
+	pass := guest.guest
+	if !guestCanAsk(pass, &Message{Endpoint: endpointConnectToHub, HubName: "HUB"}) {
+		t.Error("a guest can't connect to the hub of their public link")
+	}
+	if guestCanAsk(pass, &Message{Endpoint: endpointConnectToHub, HubName: "OTHER"}) {
+		t.Error("a guest can connect to a hub other than the one of their public link")
+	}
+	if guestCanAsk(pass, &Message{Endpoint: endpointHubCreate}) {
+		t.Error("a guest can create a hub")
+	}
+}
+
+func TestGuestsReadWhatTheirLinkShows(t *testing.T) {
+	acl := []collections.FileACLEntry{{HubRole: collabauth.Viewer, Role: collabauth.NoRole}}
+	fileGuest := &Client{userID: "guest:file", guest: &guestPass{
+		link: collections.PublicLink{ID: "file", File: "notes.ipynb"},
+	}, send: make(chan *Message, 2)}
+	hubGuest := &Client{userID: "guest:hub", guest: &guestPass{
+		link: collections.PublicLink{ID: "hub"},
+	}, send: make(chan *Message, 2)}
+	h := &Hub{
+		db:        &fakeDatastore{},
+		auth:      &fakeAuthenticator{},
+		clients:   map[*Client]bool{fileGuest: true, hubGuest: true},
+		fileHeads: map[string]*fileHead{"answers.ipynb": {acl: acl}},
+		guests: map[string]*collections.PublicLink{
+			fileGuest.userID: &fileGuest.guest.link,
+			hubGuest.userID:  &hubGuest.guest.link,
+		},
+	}
+
+	if err := h.checkFileAccess(fileGuest.userID, "notes.ipynb", nil, collabauth.FileRead); err != nil {
+		t.Errorf("a guest can't read the file of their link: %v", err)
+	}
+	if err := h.checkFileAccess(fileGuest.userID, "notes.ipynb", nil, collabauth.FileEdit); err != errUnauthorized {
+		t.Errorf("a guest editing the file of their link gave %v but want %v", err, errUnauthorized)
+	}
+	if err := h.checkFileAccess(fileGuest.userID, "other.ipynb", nil, collabauth.FileRead); wscodes.AsError(err).Code != wscodes.StatusFileDoesntExist {
+		t.Errorf("a guest with a link to one file reading another gave %v but want %s", err, wscodes.StatusFileDoesntExist)
+	}
+	if err := h.checkFileAccess(hubGuest.userID, "other.ipynb", nil, collabauth.FileRead); err != nil {
+		t.Errorf("a guest with a link to the hub can't read its files: %v", err)
+	}
+	if err := h.checkFileAccess(hubGuest.userID, "answers.ipynb", acl, collabauth.FileRead); wscodes.AsError(err).Code != wscodes.StatusFileDoesntExist {
+		t.Errorf("a guest reading a file hidden from viewers gave %v but want %s", err, wscodes.StatusFileDoesntExist)
+	}
+
+	h.renamePublicLinks("notes.ipynb", "renamed.ipynb")
+	if err := h.checkFileAccess(fileGuest.userID, "renamed.ipynb", nil, collabauth.FileRead); err != nil {
+		t.Errorf("a guest can't read the file of their link once it's renamed: %v", err)
+	}
+
+	h.handleSendMessage(&Message{File: "answers.ipynb", Route: []string{routeBroadcast}}, nil)
+	h.handleSendMessage(&Message{Endpoint: endpointModifyUser, Route: []string{routeBroadcast}}, nil)
+	if len(hubGuest.send) != 0 || len(fileGuest.send) != 0 {
+		t.Error("a guest got a broadcast about a file they can't read or about the hub's members")
+	}
+	h.handleSendMessage(&Message{File: "renamed.ipynb", Route: []string{routeBroadcast}}, nil)
+	h.handleSendMessage(&Message{Endpoint: endpointListUsers, Route: []string{routeBroadcast}}, nil)
+	if len(fileGuest.send) != 2 {
+		t.Errorf("a guest got %d of the updates to their file and the hub's users but want 2", len(fileGuest.send))
+	}
+
+	users, err := h.allUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("the hub listed %d users but want its 2 guests", len(users))
+	}
+	for _, user := range users {
+		if !user.Anonymous || user.Role != collabauth.Viewer || user.Email != "" {
+			t.Errorf("a guest was listed as %+v but want an anonymous %s", user, collabauth.Viewer)
+		}
+	}
+}
@@ -0,0 +1,537 @@
+package hub
+
+import (
+	"collabserver/collabauth"
+	"collabserver/collections"
+	"collabserver/ratelimit"
+	wscodes "collabserver/websocketcodes"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How long a session waits on the hub for each step before giving up.
+	sessionTimeout = 30 * time.Second
+	// How long to wait for a file's snapshot to catch up with its operations, and how often to check.
+	snapshotWait     = 10 * time.Second
+	snapshotInterval = 250 * time.Millisecond
+)
+
+var (
+	errSessionTimeout = wscodes.NewError(wscodes.StatusTimeout, "timed out waiting for the hub")
+
+	// Used for generating UIDs of session requests.
+	sessionRequestCount int64
+)
+
+// FileContents is a file's latest snapshot along with the operations committed after it.
+type FileContents struct {
+	// State is the file's snapshot as a JSON parsable string.
+	State string `json:"state"`
+	// Index is the index of the latest operation applied to State.
+	Index int64 `json:"index"`
+	// Operations are the operations committed after the snapshot, in order.
+	Operations []string `json:"operations"`
+}
+
+// session is a client without a connection that makes requests to a hub on behalf of a user. It goes
+// through the hub just like a websocket client, so requests get the same authorization checks and
+// their effects are broadcast to the hub's other clients.
+type session struct {
+	client *Client
+	// The hub sends the client back through this chan when the session is over.
+	returned chan *Client
+}
+
+// openSession connects a new session for userID to the hub, which must already exist.
+func (hc *Connector) openSession(userID, hubName string) (*session, error) {
+	exists, _, err := hc.db.DocExists(hubName, hc.db.CollectionForID(hubsID, nil))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errHubNotFound.WithDetail("hub", hubName)
+	}
+	return hc.connectSession(hubName, NewClient(userID, nil))
+}
+
+// openGuestSession connects a new session for a guest with the public link token to the link's hub.
+func (hc *Connector) openGuestSession(token string) (*session, error) {
+	pass, err := hc.guestPass(token)
+	if err != nil {
+		return nil, err
+	}
+	guestID, err := newGuestID()
+	if err != nil {
+		return nil, err
+	}
+	client := NewClient(guestID, nil)
+	client.guest = pass
+	return hc.connectSession(pass.hubName, client)
+}
+
+// connectSession registers the session client with the hub, opening the hub if it isn't open.
+func (hc *Connector) connectSession(hubName string, client *Client) (*session, error) {
+	client.session = true
+	key := client.userID
+	if client.guest != nil {
+		key = "link/" + client.guest.link.ID
+	}
+	client.limits = hc.sessionLimiter(key)
+	s := &session{
+		client:   client,
+		returned: make(chan *Client, 1),
+	}
+	if err := hc.connectClient(hubName, s.client, s.returned, &Message{}); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-s.client.send:
+		// The hub's connect message, which reports why if the session wasn't let in.
+		if reply.Error != nil {
+			return nil, reply.Error
+		}
+		return s, nil
+	case <-s.returned:
+		// The hub hands back clients it doesn't let in.
+		return nil, errUnauthorized
+	case <-time.After(sessionTimeout):
+		return nil, errSessionTimeout
+	}
+}
+
+// sessionLimiter gives the rate limits shared by the sessions of key.
+func (hc *Connector) sessionLimiter(key string) *ratelimit.Limiter {
+	hc.sessionLimitsMu.Lock()
+	defer hc.sessionLimitsMu.Unlock()
+	limits, ok := hc.sessionLimits[key]
+	if !ok {
+		limits = ratelimit.NewLimiter()
+		hc.sessionLimits[key] = limits
+	}
+	return limits
+}
+
+// call sends the request to the hub and waits for the reply to it, skipping any broadcasts. Replies
+// reporting a failure, including going over the rate limits, are returned as an error.
+func (s *session) call(request *Message) (*Message, error) {
+	if reply := checkMessageLimits(request); reply != nil {
+		return nil, reply.Error
+	}
+	if reply := s.client.rateLimited(request); reply != nil {
+		return nil, reply.Error
+	}
+	return s.send(request)
+}
+
+// send is call without the limits, for repeating a request that was let through.
+func (s *session) send(request *Message) (*Message, error) {
+	request.UID = "session-" + strconv.FormatInt(atomic.AddInt64(&sessionRequestCount, 1), 10)
+	request.client = s.client
+	err := s.client.clientToBackend(request)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.After(sessionTimeout)
+	for {
+		select {
+		case reply := <-s.client.send:
+			if reply.ReplyTo != request.UID {
+				continue
+			}
+			if reply.Error != nil {
+				return nil, reply.Error
+			}
+			if reply.Status != wscodes.StatusSuccess && reply.Status != wscodes.StatusOperationCommitted {
+				return nil, wscodes.NewError(reply.Status, reply.Text)
+			}
+			return reply, nil
+		case <-timeout:
+			return nil, errSessionTimeout
+		}
+	}
+}
+
+// close takes the session's client out of the hub. The hub stays open for a while after its last
+// client leaves, so a session right after another doesn't open it again.
+func (s *session) close() {
+	err := s.client.clientToBackend(&Message{Endpoint: endpointDisconnectFromHub, client: s.client})
+	if err != nil {
+		return
+	}
+	select {
+	case <-s.returned:
+	case <-time.After(sessionTimeout):
+	}
+}
+
+// callHub makes a single request to the hub as userID.
+func (hc *Connector) callHub(userID, hubName string, request *Message) (*Message, error) {
+	s, err := hc.openSession(userID, hubName)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	request.HubName = hubName
+	return s.call(request)
+}
+
+// callHubAsGuest makes a single request to the hub of the public link token as a guest.
+func (hc *Connector) callHubAsGuest(token string, request *Message) (*Message, error) {
+	s, err := hc.openGuestSession(token)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	request.HubName = s.client.guest.hubName
+	return s.call(request)
+}
+
+// CreateHub makes a new hub owned by userID and gives its name.
+func (hc *Connector) CreateHub(userID string) (string, error) {
+	// The hub closes by itself once it's been left without clients for a while.
+	hub, err := hc.createHub(userID)
+	if err != nil {
+		return "", err
+	}
+	return hub.name, nil
+}
+
+// ListFiles gives the files of the hub.
+func (hc *Connector) ListFiles(userID, hubName string) ([]collections.FileInfo, error) {
+	files, _, err := hc.ListFilesWithPermissions(userID, hubName)
+	return files, err
+}
+
+// ListFilesWithPermissions gives the files of the hub along with the permissions of the user's
+// role in it.
+func (hc *Connector) ListFilesWithPermissions(userID, hubName string) ([]collections.FileInfo, []string, error) {
+	reply, err := hc.callHub(userID, hubName, &Message{Endpoint: endpointListFiles})
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply.FileList, reply.Permissions, nil
+}
+
+// CreateFile adds an empty file to the hub.
+func (hc *Connector) CreateFile(userID, hubName, fileName string) error {
+	_, err := hc.callHub(userID, hubName, &Message{Endpoint: endpointFileCreate, File: fileName})
+	return err
+}
+
+// RenameFile renames a file of the hub.
+func (hc *Connector) RenameFile(userID, hubName, fileName, newFileName string) error {
+	_, err := hc.callHub(userID, hubName, &Message{
+		Endpoint:    endpointFileRename,
+		File:        fileName,
+		NewFileName: newFileName,
+	})
+	return err
+}
+
+// DeleteFile deletes a file of the hub.
+func (hc *Connector) DeleteFile(userID, hubName, fileName string) error {
+	_, err := hc.callHub(userID, hubName, &Message{Endpoint: endpointFileDelete, File: fileName})
+	return err
+}
+
+// RetrieveFile gives the contents of a file of the hub.
+func (hc *Connector) RetrieveFile(userID, hubName, fileName string) (*FileContents, error) {
+	reply, err := hc.callHub(userID, hubName, &Message{Endpoint: endpointFileRetrieve, File: fileName})
+	if err != nil {
+		return nil, err
+	}
+	return &FileContents{
+		State:      reply.FileState,
+		Index:      reply.Index,
+		Operations: reply.Operations,
+	}, nil
+}
+
+// ListPublicFiles gives the files a guest with the public link token can read.
+func (hc *Connector) ListPublicFiles(token string) ([]collections.FileInfo, error) {
+	reply, err := hc.callHubAsGuest(token, &Message{Endpoint: endpointListFiles})
+	if err != nil {
+		return nil, err
+	}
+	return reply.FileList, nil
+}
+
+// RetrievePublicFile gives the contents of a file to a guest with the public link token.
+func (hc *Connector) RetrievePublicFile(token, fileName string) (*FileContents, error) {
+	reply, err := hc.callHubAsGuest(token, &Message{Endpoint: endpointFileRetrieve, File: fileName})
+	if err != nil {
+		return nil, err
+	}
+	return &FileContents{
+		State:      reply.FileState,
+		Index:      reply.Index,
+		Operations: reply.Operations,
+	}, nil
+}
+
+// RetrieveCurrentFile gives the current contents of a file of the hub, for callers that can't apply
+// operations to a snapshot themselves. The snapshot is brought up to date with the file's
+// operations first, failing with StatusSnapshotBehind if that doesn't happen within snapshotWait.
+func (hc *Connector) RetrieveCurrentFile(userID, hubName, fileName string) (string, error) {
+	s, err := hc.openSession(userID, hubName)
+	if err != nil {
+		return "", err
+	}
+	defer s.close()
+	deadline := time.Now().Add(snapshotWait)
+	// Only the first try counts against the rate limits; the rest wait on the hub.
+	call := s.call
+	for {
+		reply, err := call(&Message{
+			Endpoint: endpointFileRetrieve,
+			HubName:  hubName,
+			File:     fileName,
+			UpToDate: true,
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(reply.Operations) == 0 {
+			return reply.FileState, nil
+		}
+		if time.Now().After(deadline) {
+			return "", wscodes.NewError(wscodes.StatusSnapshotBehind, "file's snapshot is behind its operations").
+				WithDetail("file", fileName)
+		}
+		call = s.send
+		time.Sleep(snapshotInterval)
+	}
+}
+
+// SaveFile replaces the contents of a file of the hub with state.
+func (hc *Connector) SaveFile(userID, hubName, fileName, state string) error {
+	_, err := hc.callHub(userID, hubName, &Message{
+		Endpoint:  endpointFileSave,
+		File:      fileName,
+		FileState: state,
+	})
+	return err
+}
+
+// SetFileACL replaces the access list of a file of the hub, which overrides the hub roles of the
+// users it matches for that file.
+func (hc *Connector) SetFileACL(userID, hubName, fileName string, acl []collections.FileACLEntry) ([]collections.FileACLEntry, error) {
+	reply, err := hc.callHub(userID, hubName, &Message{
+		Endpoint: endpointFileACL,
+		File:     fileName,
+		FileACL:  acl,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.FileACL, nil
+}
+
+// CreateCheckpoint saves a copy of the file's snapshot, replacing its previous checkpoint.
+func (hc *Connector) CreateCheckpoint(userID, hubName, fileName string) error {
+	return hc.fileCheckpoint(userID, hubName, fileName, checkpointCreate)
+}
+
+// RestoreCheckpoint replaces the contents of the file with its checkpoint.
+func (hc *Connector) RestoreCheckpoint(userID, hubName, fileName string) error {
+	return hc.fileCheckpoint(userID, hubName, fileName, checkpointRestore)
+}
+
+// DeleteCheckpoint deletes the file's checkpoint.
+func (hc *Connector) DeleteCheckpoint(userID, hubName, fileName string) error {
+	return hc.fileCheckpoint(userID, hubName, fileName, checkpointDelete)
+}
+
+func (hc *Connector) fileCheckpoint(userID, hubName, fileName, action string) error {
+	_, err := hc.callHub(userID, hubName, &Message{
+		Endpoint:         endpointFileCheckpoint,
+		File:             fileName,
+		CheckpointAction: action,
+	})
+	return err
+}
+
+// ListUsers gives the members of the hub.
+func (hc *Connector) ListUsers(userID, hubName string) ([]collections.UserInfo, error) {
+	reply, err := hc.callHub(userID, hubName, &Message{Endpoint: endpointListUsers})
+	if err != nil {
+		return nil, err
+	}
+	return reply.UserList, nil
+}
+
+// SetUserRole gives the user with the email the role in the hub, adding them if they aren't a
+// member. A role of collabauth.NoRole removes them.
+func (hc *Connector) SetUserRole(userID, hubName, email, role string) error {
+	request := &Message{
+		Endpoint:       endpointModifyUser,
+		ModifyUserType: userModify,
+		ModifyUserID:   email,
+		ModifyUserRole: role,
+	}
+	if role == collabauth.NoRole {
+		request.ModifyUserType = userRemove
+	}
+	_, err := hc.callHub(userID, hubName, request)
+	return err
+}
+
+// ListServiceAccounts gives the service accounts of the hub, including revoked ones.
+func (hc *Connector) ListServiceAccounts(userID, hubName string) ([]collections.ServiceAccount, error) {
+	reply, err := hc.callHub(userID, hubName, &Message{
+		Endpoint:             endpointServiceAccounts,
+		ServiceAccountAction: serviceAccountList,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.ServiceAccounts, nil
+}
+
+// CreateServiceAccount adds a service account with the role to the hub. The account is given
+// along with its API key, which can't be retrieved again.
+func (hc *Connector) CreateServiceAccount(userID, hubName, name, role string) (*collections.ServiceAccount, error) {
+	return hc.serviceAccountAction(userID, hubName, serviceAccountCreate, &collections.ServiceAccount{
+		Name: name,
+		Role: role,
+	})
+}
+
+// RotateServiceAccountKey gives the service account a new API key, replacing its old one.
+func (hc *Connector) RotateServiceAccountKey(userID, hubName, accountID string) (*collections.ServiceAccount, error) {
+	return hc.serviceAccountAction(userID, hubName, serviceAccountRotate, &collections.ServiceAccount{ID: accountID})
+}
+
+// RevokeServiceAccount stops the service account's API key from working and takes away its role.
+func (hc *Connector) RevokeServiceAccount(userID, hubName, accountID string) error {
+	_, err := hc.serviceAccountAction(userID, hubName, serviceAccountRevoke, &collections.ServiceAccount{ID: accountID})
+	return err
+}
+
+func (hc *Connector) serviceAccountAction(userID, hubName, action string, account *collections.ServiceAccount) (*collections.ServiceAccount, error) {
+	reply, err := hc.callHub(userID, hubName, &Message{
+		Endpoint:             endpointServiceAccounts,
+		ServiceAccountAction: action,
+		ServiceAccount:       account,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.ServiceAccount, nil
+}
+
+// ListRoles gives the built-in roles and the custom roles of the hub.
+func (hc *Connector) ListRoles(userID, hubName string) ([]collections.RoleDefinition, error) {
+	reply, err := hc.callHub(userID, hubName, &Message{Endpoint: endpointRoles, RoleAction: roleList})
+	if err != nil {
+		return nil, err
+	}
+	return reply.RoleDefinitions, nil
+}
+
+// SetRole defines a custom role of the hub with the permissions, replacing its permissions if it
+// already exists.
+func (hc *Connector) SetRole(userID, hubName, role string, permissions []string) (*collections.RoleDefinition, error) {
+	reply, err := hc.callHub(userID, hubName, &Message{
+		Endpoint:       endpointRoles,
+		RoleAction:     roleSet,
+		RoleDefinition: &collections.RoleDefinition{Name: role, Permissions: permissions},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.RoleDefinition, nil
+}
+
+// DeleteRole deletes a custom role of the hub, which no member can have.
+func (hc *Connector) DeleteRole(userID, hubName, role string) error {
+	_, err := hc.callHub(userID, hubName, &Message{
+		Endpoint:       endpointRoles,
+		RoleAction:     roleDelete,
+		RoleDefinition: &collections.RoleDefinition{Name: role},
+	})
+	return err
+}
+
+// ListInvites gives the invites of the hub, including revoked and expired ones.
+func (hc *Connector) ListInvites(userID, hubName string) ([]collections.Invite, error) {
+	reply, err := hc.callHub(userID, hubName, &Message{Endpoint: endpointInvites, InviteAction: inviteList})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Invites, nil
+}
+
+// CreateInvite adds an invite like the one given to the hub. The invite is given along with its
+// token, which can't be retrieved again.
+func (hc *Connector) CreateInvite(userID, hubName string, invite collections.Invite) (*collections.Invite, error) {
+	return hc.inviteAction(userID, hubName, inviteCreate, &invite)
+}
+
+// RevokeInvite stops the invite from letting anyone else join the hub.
+func (hc *Connector) RevokeInvite(userID, hubName, inviteID string) error {
+	_, err := hc.inviteAction(userID, hubName, inviteRevoke, &collections.Invite{ID: inviteID})
+	return err
+}
+
+func (hc *Connector) inviteAction(userID, hubName, action string, invite *collections.Invite) (*collections.Invite, error) {
+	reply, err := hc.callHub(userID, hubName, &Message{
+		Endpoint:     endpointInvites,
+		InviteAction: action,
+		Invite:       invite,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Invite, nil
+}
+
+// TransferOwnership offers the hub's ownership to the member with the email, who has to accept it.
+func (hc *Connector) TransferOwnership(userID, hubName, email string) (*collections.OwnershipTransfer, error) {
+	return hc.ownershipAction(userID, hubName, ownershipOffer, email)
+}
+
+// AcceptOwnership makes the user an owner of the hub in place of the owner who offered it to them.
+func (hc *Connector) AcceptOwnership(userID, hubName string) (*collections.OwnershipTransfer, error) {
+	return hc.ownershipAction(userID, hubName, ownershipAccept, "")
+}
+
+// CancelOwnershipTransfer calls off the hub's ownership transfer.
+func (hc *Connector) CancelOwnershipTransfer(userID, hubName string) error {
+	_, err := hc.ownershipAction(userID, hubName, ownershipCancel, "")
+	return err
+}
+
+func (hc *Connector) ownershipAction(userID, hubName, action, email string) (*collections.OwnershipTransfer, error) {
+	reply, err := hc.callHub(userID, hubName, &Message{
+		Endpoint:        endpointTransferOwnership,
+		OwnershipAction: action,
+		ModifyUserID:    email,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.OwnershipTransfer, nil
+}
+
+// AuditPage is a page of a hub's audit log.
+type AuditPage struct {
+	Entries []collections.AuditEntry `json:"entries"`
+	// NextPageToken gives the next page when passed as the query's PageToken, or is "" on the last page.
+	NextPageToken string `json:"nextPageToken,omitempty"`
+}
+
+// ListAudit gives a page of the hub's audit entries that match the query, newest first.
+func (hc *Connector) ListAudit(userID, hubName string, query collections.AuditQuery) (*AuditPage, error) {
+	reply, err := hc.callHub(userID, hubName, &Message{Endpoint: endpointListAudit, AuditQuery: &query})
+	if err != nil {
+		return nil, err
+	}
+	entries := reply.AuditEntries
+	if entries == nil {
+		entries = []collections.AuditEntry{}
+	}
+	return &AuditPage{Entries: entries, NextPageToken: reply.NextPageToken}, nil
+}
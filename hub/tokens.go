@@ -0,0 +1,47 @@
+package hub
+
+import (
+	"collabserver/apikeys"
+	"errors"
+	"strings"
+)
+
+// Invites and public links are both found by tokens that name the hub and the invite or link, and
+// end with a secret whose hash is stored with it, like API keys do.
+
+const (
+	tokenSecretBytes = 24
+)
+
+var (
+	errTokenMalformed = errors.New("token is not well-formed")
+)
+
+// newHubToken gives a new token for the invite or public link with the ID in the hub, along with the
+// hash of its secret to store.
+func newHubToken(hubName, id string) (token, hash string, err error) {
+	secret, err := apikeys.RandomHex(tokenSecretBytes)
+	if err != nil {
+		return "", "", err
+	}
+	return hubName + "." + id + "." + secret, apikeys.Hash(secret), nil
+}
+
+// parseHubToken splits the token into the hub and the ID of the invite or public link it belongs to,
+// and its secret. IDs and secrets never have dots, while hub names might.
+func parseHubToken(token string) (hubName, id, secret string, err error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", "", "", errTokenMalformed
+	}
+	rest, secret := token[:i], token[i+1:]
+	i = strings.LastIndex(rest, ".")
+	if i < 0 {
+		return "", "", "", errTokenMalformed
+	}
+	hubName, id = rest[:i], rest[i+1:]
+	if hubName == "" || id == "" || secret == "" || strings.Contains(hubName, "/") {
+		return "", "", "", errTokenMalformed
+	}
+	return hubName, id, secret, nil
+}
@@ -0,0 +1,28 @@
+package hub
+
+import (
+	"collabserver/apikeys"
+	"testing"
+)
+
+func TestHubTokens(t *testing.T) {
+	token, hash, err := newHubToken("my.hub", "abc123")
+	if err != nil {
+		t.Fatalf("newHubToken gave error: %v", err)
+	}
+	hubName, id, secret, err := parseHubToken(token)
+	if err != nil {
+		t.Fatalf("parseHubToken(%q) gave error: %v", token, err)
+	}
+	if hubName != "my.hub" || id != "abc123" {
+		t.Errorf("parseHubToken(%q) gave hub %q and ID %q but want my.hub and abc123", token, hubName, id)
+	}
+	if !apikeys.Matches(secret, hash) {
+		t.Error("the token's secret doesn't match the hash to store")
+	}
+	for _, malformed := range []string{"", "hub", "hub.id", ".id.secret", "hub..secret", "hub.id.", "a/b.id.secret"} {
+		if _, _, _, err := parseHubToken(malformed); err == nil {
+			t.Errorf("parseHubToken(%q) gave no error", malformed)
+		}
+	}
+}
@@ -22,4 +22,70 @@ const (
 
 	// The key for the flag that indicates that a file needs updating to the latest state.
 	FileUpdateKey = "snapshotNeedsUpdate"
+
+	// FileSnapshotKey gives the file's latest snapshot.
+	FileSnapshotKey = "snapshot"
+
+	// FileModifiedKey gives the time the file's contents were last saved as a whole.
+	FileModifiedKey = "lastModified"
+
+	// FileReplacedBeforeKey gives the index after the file's latest save marker.
+	FileReplacedBeforeKey = "replacedBefore"
+
+	// FileCheckpointKey gives the file's checkpoint.
+	FileCheckpointKey = "checkpoint"
+
+	// FileACLKey gives the file's access list, which overrides hub roles for the file.
+	FileACLKey = "acl"
+
+	// ServiceAccountKeyHashKey gives the hash of a service account's API key.
+	ServiceAccountKeyHashKey = "keyHash"
+
+	// ServiceAccountRevokedKey gives whether a service account's API key has been revoked.
+	ServiceAccountRevokedKey = "revoked"
+
+	// InviteRevokedKey gives whether an invite has been revoked.
+	InviteRevokedKey = "revoked"
+
+	// PublicLinkFileKey gives the only file a public link shows, if it doesn't show the whole hub.
+	PublicLinkFileKey = "file"
+
+	// PublicLinkRevokedKey gives whether a public link has been revoked.
+	PublicLinkRevokedKey = "revoked"
+
+	// HubOwnershipTransferKey gives the hub's ownership transfer waiting to be accepted, if any.
+	HubOwnershipTransferKey = "ownershipTransfer"
+)
+
+// The actions recorded in hubs' audit logs.
+const (
+	AuditHubCreated   = "HUB_CREATED"
+	AuditHubConnected = "HUB_CONNECTED"
+
+	AuditMemberAdded       = "MEMBER_ADDED"
+	AuditMemberRoleChanged = "MEMBER_ROLE_CHANGED"
+	AuditMemberRemoved     = "MEMBER_REMOVED"
+	// AuditMemberInvited is for emails that no one has signed up with, who join once they do.
+	AuditMemberInvited      = "MEMBER_INVITED"
+	AuditInvitationRevoked  = "INVITATION_REVOKED"
+	AuditInviteCreated      = "INVITE_CREATED"
+	AuditInviteRevoked      = "INVITE_REVOKED"
+	AuditOwnershipOffered   = "OWNERSHIP_OFFERED"
+	AuditOwnershipCancelled = "OWNERSHIP_TRANSFER_CANCELLED"
+
+	AuditPublicLinkCreated = "PUBLIC_LINK_CREATED"
+	AuditPublicLinkRevoked = "PUBLIC_LINK_REVOKED"
+
+	AuditServiceAccountCreated    = "SERVICE_ACCOUNT_CREATED"
+	AuditServiceAccountKeyRotated = "SERVICE_ACCOUNT_KEY_ROTATED"
+	AuditServiceAccountRevoked    = "SERVICE_ACCOUNT_REVOKED"
+
+	AuditRoleDefined = "ROLE_DEFINED"
+	AuditRoleDeleted = "ROLE_DELETED"
+
+	AuditFileCreated       = "FILE_CREATED"
+	AuditFileRenamed       = "FILE_RENAMED"
+	AuditFileDeleted       = "FILE_DELETED"
+	AuditFileRestored      = "FILE_RESTORED"
+	AuditFileAccessChanged = "FILE_ACCESS_CHANGED"
 )
@@ -0,0 +1,98 @@
+// Package metrics keeps counters about the server's operation. They are published through expvar,
+// so they can be read as JSON from the /debug/vars endpoint of the internal debug listener.
+package metrics
+
+import (
+	"expvar"
+	"net"
+	"sync/atomic"
+)
+
+var (
+	// Websocket holds counters about websocket connections and the frames sent over them.
+	Websocket = expvar.NewMap("websocket")
+)
+
+const (
+	compressedFrames       = "compressedFrames"
+	compressedPayloadBytes = "compressedPayloadBytes"
+	compressedWireBytes    = "compressedWireBytes"
+	uncompressedFrames     = "uncompressedFrames"
+	uncompressedBytes      = "uncompressedBytes"
+	rejectedOrigins        = "rejectedOrigins"
+)
+
+func init() {
+	// The ratio of bytes sent on the wire to payload bytes for compressed frames; lower is better.
+	Websocket.Set("compressionRatio", expvar.Func(func() interface{} {
+		payload := counter(compressedPayloadBytes)
+		if payload == 0 {
+			return 0.0
+		}
+		return float64(counter(compressedWireBytes)) / float64(payload)
+	}))
+}
+
+func counter(name string) int64 {
+	if v, ok := Websocket.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// RecordFrame records a frame sent to a client, with the size of its payload and the number of
+// bytes it took on the wire.
+func RecordFrame(payloadBytes, wireBytes int64, compressed bool) {
+	if compressed {
+		Websocket.Add(compressedFrames, 1)
+		Websocket.Add(compressedPayloadBytes, payloadBytes)
+		Websocket.Add(compressedWireBytes, wireBytes)
+		return
+	}
+	Websocket.Add(uncompressedFrames, 1)
+	Websocket.Add(uncompressedBytes, payloadBytes)
+}
+
+// RecordRejectedOrigin records a websocket upgrade that was refused because of its origin.
+func RecordRejectedOrigin() {
+	Websocket.Add(rejectedOrigins, 1)
+}
+
+// CountingListener wraps the listener so that the connections it accepts count the bytes written
+// to them; see BytesWritten.
+func CountingListener(listener net.Listener) net.Listener {
+	return &countingListener{listener}
+}
+
+// BytesWritten gives the number of bytes written to a connection accepted by a CountingListener.
+// It reports false if the connection didn't come from one.
+func BytesWritten(conn net.Conn) (int64, bool) {
+	cc, ok := conn.(*countingConn)
+	if !ok {
+		return 0, false
+	}
+	return atomic.LoadInt64(&cc.written), true
+}
+
+type countingListener struct {
+	net.Listener
+}
+
+func (cl *countingListener) Accept() (net.Conn, error) {
+	conn, err := cl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (cc *countingConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	atomic.AddInt64(&cc.written, int64(n))
+	return n, err
+}
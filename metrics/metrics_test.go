@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestBytesWritten(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go ioutil.ReadAll(client)
+
+	conn := &countingConn{Conn: server}
+	conn.Write([]byte("hello"))
+	conn.Write([]byte("world!"))
+	if written, ok := BytesWritten(conn); !ok || written != 11 {
+		t.Errorf("BytesWritten gave %d, %t but want 11, true", written, ok)
+	}
+	if _, ok := BytesWritten(server); ok {
+		t.Error("BytesWritten counted a connection that isn't from a CountingListener")
+	}
+}
+
+func TestCompressionRatio(t *testing.T) {
+	RecordFrame(1000, 250, true)
+	RecordFrame(10, 12, false)
+	ratio := Websocket.Get("compressionRatio").(interface{ Value() interface{} }).Value()
+	if ratio != 0.25 {
+		t.Errorf("compression ratio is %v but want 0.25", ratio)
+	}
+}
@@ -0,0 +1,99 @@
+// Package ratelimit provides token buckets for limiting how often clients can make requests.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket: each request takes a token, and tokens refill at a fixed rate up to
+// a maximum burst size.
+type Bucket struct {
+	perSecond float64
+	burst     float64
+	tokens    float64
+	last      time.Time
+}
+
+// NewBucket gives a full bucket that refills perSecond tokens a second and holds at most burst tokens.
+// A bucket with a zero perSecond never limits.
+func NewBucket(perSecond float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{
+		perSecond: perSecond,
+		burst:     float64(burst),
+		tokens:    float64(burst),
+	}
+}
+
+// Allow takes a token from the bucket if there is one. If there isn't, it gives how long until
+// there will be.
+func (b *Bucket) Allow(now time.Time) (bool, time.Duration) {
+	if b.perSecond <= 0 {
+		return true, 0
+	}
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.perSecond)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / b.perSecond
+	return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+// Limiter keeps a bucket per key (e.g. per endpoint). It is safe for concurrent use.
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+}
+
+// NewLimiter gives a Limiter with no buckets.
+func NewLimiter() *Limiter {
+	return &Limiter{buckets: map[string]*Bucket{}}
+}
+
+// Allow takes a token from the key's bucket, see Bucket.Allow. The bucket is created with the given
+// rate and burst the first time the key is used.
+func (l *Limiter) Allow(key string, perSecond float64, burst int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = NewBucket(perSecond, burst)
+		l.buckets[key] = bucket
+	}
+	return bucket.Allow(now)
+}
+
+// Strikes counts violations within a sliding window of time.
+type Strikes struct {
+	mu     sync.Mutex
+	window time.Duration
+	times  []time.Time
+}
+
+// NewStrikes gives a Strikes that forgets violations older than window.
+func NewStrikes(window time.Duration) *Strikes {
+	return &Strikes{window: window}
+}
+
+// Add records a violation at now and gives the number of violations within the window.
+func (s *Strikes) Add(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := now.Add(-s.window)
+	kept := s.times[:0]
+	for _, t := range s.times {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	s.times = append(kept, now)
+	return len(s.times)
+}
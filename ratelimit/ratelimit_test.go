@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	start := time.Unix(0, 0)
+	bucket := NewBucket(2, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := bucket.Allow(start); !ok {
+			t.Fatalf("bucket rejected request %d within its burst", i)
+		}
+	}
+	ok, wait := bucket.Allow(start)
+	if ok {
+		t.Fatal("bucket allowed a request past its burst")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("bucket gave retry after %v but want %v", wait, 500*time.Millisecond)
+	}
+	if ok, _ := bucket.Allow(start.Add(wait)); !ok {
+		t.Error("bucket rejected a request after waiting the retry time")
+	}
+	if ok, _ := bucket.Allow(start.Add(time.Hour)); !ok {
+		t.Error("bucket rejected a request after refilling")
+	}
+}
+
+func TestUnlimitedBucket(t *testing.T) {
+	bucket := NewBucket(0, 0)
+	for i := 0; i < 100; i++ {
+		if ok, _ := bucket.Allow(time.Unix(0, 0)); !ok {
+			t.Fatal("bucket without a rate rejected a request")
+		}
+	}
+}
+
+func TestLimiterKeepsBucketsApart(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewLimiter()
+	if ok, _ := limiter.Allow("a", 1, 1, now); !ok {
+		t.Fatal("limiter rejected the first request for a")
+	}
+	if ok, _ := limiter.Allow("b", 1, 1, now); !ok {
+		t.Error("limiter rejected b after a used its bucket")
+	}
+	if ok, _ := limiter.Allow("a", 1, 1, now); ok {
+		t.Error("limiter allowed a past its burst")
+	}
+}
+
+func TestStrikes(t *testing.T) {
+	start := time.Unix(0, 0)
+	strikes := NewStrikes(time.Minute)
+	strikes.Add(start)
+	strikes.Add(start.Add(30 * time.Second))
+	if n := strikes.Add(start.Add(80 * time.Second)); n != 2 {
+		t.Errorf("strikes counted %d violations in the window but want 2", n)
+	}
+}
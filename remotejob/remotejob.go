@@ -4,6 +4,7 @@ package remotejob
 import (
 	"context"
 	"encoding/json"
+	"sync"
 
 	log "collabserver/cloudlog"
 
@@ -67,11 +68,39 @@ func FileUpdateRequest(hub, fileName string) {
 	requests.add(result)
 }
 
-// TODO (itsazhuhere@): implement a pool to ensure messages are being successfully sent/
-// make sure not too many are being sent at once.
+// Wait blocks until the latest requests have been published, giving the first error. Short lived
+// programs call it before exiting, since requests are published in the background.
+func Wait(ctx context.Context) error {
+	if requests == nil {
+		return nil
+	}
+	var firstErr error
+	for _, result := range requests.latest() {
+		if _, err := result.Get(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// TODO (itsazhuhere@): make sure not too many are being sent at once.
 type requestPool struct {
+	mu sync.Mutex
+	// The results of the latest maxRequests requests.
+	results []*pubsub.PublishResult
 }
 
 func (rp *requestPool) add(result *pubsub.PublishResult) {
-	// do nothing for now.
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	rp.results = append(rp.results, result)
+	if extra := len(rp.results) - maxRequests; extra > 0 {
+		rp.results = append([]*pubsub.PublishResult{}, rp.results[extra:]...)
+	}
+}
+
+func (rp *requestPool) latest() []*pubsub.PublishResult {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return append([]*pubsub.PublishResult{}, rp.results...)
 }
@@ -1,33 +1,86 @@
 package main
 
 import (
+	"encoding/json"
+	"expvar"
+	"net"
 	"net/http"
 	"strings"
 
+	"collabserver/api"
+	"collabserver/apikeys"
 	log "collabserver/cloudlog"
+	"collabserver/config"
 	"collabserver/hub"
+	"collabserver/metrics"
 	"collabserver/storage"
+	"collabserver/tokens"
 
 	"github.com/gorilla/mux"
 )
 
 const (
 	authHeader = "Sec-WebSocket-Protocol"
+	// The header holding the bearer token of HTTP API requests.
+	apiAuthHeader = "Authorization"
+	bearerPrefix  = "Bearer "
+	// Jupyter clients send their token with this prefix instead.
+	tokenPrefix = "token "
+	// Browsers can't set headers on event streams, so they pass a stream ticket from
+	// eventTicketHandler as a query parameter instead.
+	ticketParam = "ticket"
 )
 
-var hubConnector *hub.Connector
+var (
+	hubConnector *hub.Connector
+	// Checks the ID tokens and API keys users authenticate with.
+	verifier tokens.Verifier
+)
 
 func main() {
 	defer storage.Close()
+	idTokens, err := tokens.FromConfig(config.Current.Auth, storage.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hubConnector = hub.NewConnector()
+	// Service accounts send their API keys in place of ID tokens.
+	verifier = apikeys.NewVerifier(hubConnector.ServiceAccount, idTokens)
+
 	router := mux.NewRouter()
 	router.HandleFunc("/", wsHandler)
+	router.HandleFunc("/events", eventsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/events/ticket", eventTicketHandler).Methods(http.MethodPost)
+	router.HandleFunc("/events/{connection}", eventPostHandler).Methods(http.MethodPost)
+	api.Register(router.PathPrefix("/api/v1").Subrouter(), hubConnector, userIDFromRequest)
+	// Jupyter clients use /jupyter/{hub}/ as the base URL of their server.
+	api.RegisterContents(router.PathPrefix("/jupyter/{hub}").Subrouter(), hubConnector, userIDFromRequest)
 	//router.PathPrefix("/").Handler(http.FileServer(http.Dir("./web/out/")))
 
-	hubConnector = hub.NewConnector()
+	go serveDebug(config.Current.Debug.Address)
 
 	addr := ":8089"
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.Println("Starting server at: http://" + addr)
-	log.Fatal(http.ListenAndServe(addr, router))
+	// Connections are wrapped so that bytes sent on the wire can be compared against payload
+	// sizes for compression metrics.
+	log.Fatal(http.Serve(metrics.CountingListener(listener), router))
+}
+
+// serveDebug serves the expvar metrics on the internal debug address, if there is one.
+func serveDebug(addr string) {
+	if addr == "" {
+		return
+	}
+	debugMux := http.NewServeMux()
+	debugMux.Handle("/debug/vars", expvar.Handler())
+	log.Println("Serving debug vars at: http://" + addr)
+	if err := http.ListenAndServe(addr, debugMux); err != nil {
+		log.Printf("Debug listener at %s stopped: %v", addr, err)
+	}
 }
 
 // wsHandler handles incoming Websocket connections.
@@ -35,30 +88,100 @@ func main() {
 // In javascript/typescript, this is fulfilled by the second parameter of the Websocket
 // constructor: (i.e. new WebSocket(url, header)).
 func wsHandler(w http.ResponseWriter, r *http.Request) {
+	protocol := r.Header.Get(authHeader)
+	// Generate the "response", which is just the same header that was given in the request.
+	response := http.Header{}
+	response.Add(authHeader, protocol)
+	// Guests connect with a public link token instead of signing in.
+	if strings.HasPrefix(protocol, publicLinkPrefix) {
+		hubConnector.ServeGuestWs(strings.TrimPrefix(protocol, publicLinkPrefix), w, r, response)
+		return
+	}
 	// Check for user ID.
-	userID := userIDFromHeader(r.Header.Get(authHeader))
+	userID := userIDFromHeader(protocol)
 	if userID == "" {
 		log.Println("User token not provided")
 		return
 	}
 	log.Printf("Connecting user with idToken %s", userID)
-	protocol := r.Header.Get(authHeader)
-	// Generate the "response", which is just the same header that was given in the request.
-	response := http.Header{}
-	response.Add(authHeader, protocol)
 	hubConnector.ServeWs(userID, w, r, response)
 }
 
-const optionalPrefix = "Bearer|"
+// eventsHandler opens an event stream, the fallback for clients that can't use websockets.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromRequest(r)
+	if userID == "" && r.URL.Query().Get(ticketParam) != "" {
+		userID = hubConnector.RedeemStreamTicket(r.URL.Query().Get(ticketParam))
+	}
+	if userID == "" {
+		http.Error(w, "user token or stream ticket not provided", http.StatusUnauthorized)
+		return
+	}
+	hubConnector.ServeEvents(userID, w, r)
+}
+
+type eventTicket struct {
+	Ticket string `json:"ticket"`
+}
+
+// eventTicketHandler gives a short-lived ticket that opens a single event stream, so that the
+// credentials of browsers, which can't set headers on event streams, needn't go in its URL.
+func eventTicketHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		http.Error(w, "user token not provided", http.StatusUnauthorized)
+		return
+	}
+	ticket, err := hubConnector.IssueStreamTicket(userID)
+	if err != nil {
+		log.Printf("Error issuing stream ticket: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(eventTicket{Ticket: ticket})
+}
+
+// eventPostHandler takes a message sent over an event stream.
+func eventPostHandler(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromRequest(r)
+	if userID == "" {
+		http.Error(w, "user token not provided", http.StatusUnauthorized)
+		return
+	}
+	hubConnector.ServeEventPost(userID, mux.Vars(r)["connection"], w, r)
+}
+
+const (
+	optionalPrefix = "Bearer|"
+	// Guests send their public link token in the protocol header with this prefix.
+	publicLinkPrefix = "PublicLink|"
+)
 
 // userIDFromHeader checks the protocol header of the Websocket connection and decodes
 // it if it exists.
 func userIDFromHeader(header string) string {
 	token := strings.TrimPrefix(header, optionalPrefix)
-	userID, err := storage.DB.VerifyIDToken(token)
+	userID, err := verifier.VerifyIDToken(token)
 	if err != nil {
+		// API keys are secrets that stay valid until revoked, so they mustn't end up in the logs.
+		if apikeys.IsKey(token) {
+			token = "(API key)"
+		}
 		log.Printf("Could not verify token %s:  %+v", token, err)
 		return ""
 	}
 	return userID
 }
+
+// userIDFromRequest verifies the bearer token in the Authorization header of an HTTP API request.
+func userIDFromRequest(r *http.Request) string {
+	header := r.Header.Get(apiAuthHeader)
+	for _, prefix := range []string{bearerPrefix, tokenPrefix} {
+		if strings.HasPrefix(header, prefix) {
+			return userIDFromHeader(strings.TrimPrefix(header, prefix))
+		}
+	}
+	return ""
+}
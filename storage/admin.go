@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"collabserver/collections"
+	"context"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// The functions here are for administration tools, which work on the datastore directly and so
+// skip the hubs' authorization checks.
+
+const hubsCollectionName = "hubs"
+
+// FileEntry is a file Document along with its contents.
+type FileEntry struct {
+	Ref  *firestore.DocumentRef
+	Info collections.FileInfo
+}
+
+// HubNames gives the names of every hub.
+func (cs *collabStorage) HubNames() ([]string, error) {
+	docs, err := cs.allDocs(cs.client.Collection(hubsCollectionName))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, doc := range docs {
+		names = append(names, doc.Ref.ID)
+	}
+	return names, nil
+}
+
+// AllFileEntries gives the files in the collection, including the ones marked as deleted.
+func (cs *collabStorage) AllFileEntries(collection *firestore.CollectionRef) ([]FileEntry, error) {
+	docs, err := cs.allDocs(collection)
+	if err != nil {
+		return nil, err
+	}
+	entries := []FileEntry{}
+	for _, doc := range docs {
+		entry := FileEntry{Ref: doc.Ref}
+		if err := doc.DataTo(&entry.Info); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// AllOps gives every operation in the collection in index order, with who committed them.
+func (cs *collabStorage) AllOps(opsCollection *firestore.CollectionRef) ([]OperationEntry, error) {
+	docs, err := opsCollection.OrderBy("index", firestore.Asc).Documents(context.Background()).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	ops := []OperationEntry{}
+	for _, doc := range docs {
+		op := OperationEntry{}
+		if err := doc.DataTo(&op); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// DeleteRecursively removes the Document and every Document under it for good, unlike
+// DeleteDocument, which only marks it as deleted.
+func (cs *collabStorage) DeleteRecursively(docRef *firestore.DocumentRef) error {
+	ctx := context.Background()
+	subcollections := docRef.Collections(ctx)
+	for {
+		collection, err := subcollections.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		docs, err := collection.DocumentRefs(ctx).GetAll()
+		if err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			if err := cs.DeleteRecursively(doc); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := docRef.Delete(ctx)
+	return err
+}
+
+// RestoreDocument undoes DeleteDocument.
+func (cs *collabStorage) RestoreDocument(docRef *firestore.DocumentRef) error {
+	return cs.UpdateEntry(docRef, deletedField, false)
+}
@@ -5,7 +5,9 @@ import (
 	"collabserver/collections"
 	wscodes "collabserver/websocketcodes"
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 
 	"cloud.google.com/go/firestore"
 	firebase "firebase.google.com/go"
@@ -20,6 +22,11 @@ const (
 	operationCollectionName = "operations"
 	authCollectionName      = "authorization"
 	usersCollectionName     = "usersToHubs"
+	// Invitations for emails no one has signed up with yet.
+	pendingInvitationsCollectionName = "pendingInvitations"
+
+	// Firestore rejects batched writes with more than this many operations.
+	maxBatchWrites = 500
 
 	// Indices are in base 10 (used for converting int to string)
 	intBase = 10
@@ -29,11 +36,25 @@ const (
 	userIDField   = "userID"
 	roleField     = "role"
 	hubPath       = "hub"
+	emailField    = "email"
+
+	// The fields of audit entries that can be filtered on.
+	auditTimeField   = "time"
+	auditActorField  = "actor"
+	auditActionField = "action"
+	auditTargetField = "target"
+	// inviteUsesField counts the times an invite was used.
+	inviteUsesField = "uses"
+
+	ownershipTransferField = "ownershipTransfer"
 )
 
 var (
 	// DB represents a Firestore database, and contains functions for interacting with that database.
 	DB *collabStorage
+
+	// ErrOpIndexTaken is given when ops are appended at an index that another op already has.
+	ErrOpIndexTaken = errors.New("operation index is already taken")
 )
 
 func init() {
@@ -65,6 +86,8 @@ type collabStorage struct {
 	auth   *auth.Client
 	users  *firestore.CollectionRef
 	client *firestore.Client
+
+	pendingInvitations *firestore.CollectionRef
 }
 
 func (cs *collabStorage) init() {
@@ -84,6 +107,7 @@ func (cs *collabStorage) init() {
 	}
 
 	cs.users = cs.client.Collection(usersCollectionName)
+	cs.pendingInvitations = cs.client.Collection(pendingInvitationsCollectionName)
 }
 
 func (cs *collabStorage) CollectionForID(collectionID string, docRef *firestore.DocumentRef) *firestore.CollectionRef {
@@ -142,6 +166,15 @@ func (cs *collabStorage) EntryForFieldValue(collection *firestore.CollectionRef,
 	return doc.Ref, err
 }
 
+// EntryForRef reads the document at docRef into the provided struct pointer.
+func (cs *collabStorage) EntryForRef(docRef *firestore.DocumentRef, dataTo interface{}) error {
+	snapshot, err := docRef.Get(context.Background())
+	if err != nil {
+		return err
+	}
+	return snapshot.DataTo(dataTo)
+}
+
 func (cs *collabStorage) CollectionIsEmpty(collection *firestore.CollectionRef) bool {
 	allDocs, _ := collection.Documents(context.Background()).GetAll()
 	return len(allDocs) == 0
@@ -151,53 +184,42 @@ func (cs *collabStorage) TopLevelCollection(collection string) *firestore.Collec
 	return cs.client.Collection(collection)
 }
 
-// CommitOps checks that the OT operations can be committed then pushes them to the collection.
-func (cs *collabStorage) CommitOps(opsCollection *firestore.CollectionRef, idx int64, ops []string, committerID string) (string, int64, []string, string) {
-	retOps, start, err := cs.OpsForFile(opsCollection, idx)
-	if err != nil {
-		return wscodes.StatusOperationCommitError, idx, []string{}, err.Error()
+// AppendOps writes ops to the collection with the first op at index idx, provided nothing is at idx
+// or after it yet. The check and the writes are done in a transaction, so ops committed at the same
+// index by another server, or by a hub whose cached head is out of date, give ErrOpIndexTaken
+// rather than duplicate indexes.
+func (cs *collabStorage) AppendOps(opsCollection *firestore.CollectionRef, idx int64, ops []string, committerID string) error {
+	if len(ops) > maxBatchWrites {
+		err := fmt.Errorf("length of operations: %d in message is larger than %d", len(ops), maxBatchWrites)
+		log.Println(err)
+		return err
 	}
-	if idx < 0 {
-		if start == -1 {
-			start = 0
+	return cs.client.RunTransaction(context.Background(), func(ctx context.Context, tx *firestore.Transaction) error {
+		taken, err := tx.Documents(opsCollection.Where("index", ">=", idx).Limit(1)).GetAll()
+		if err != nil {
+			return err
 		}
-		return wscodes.StatusOperationTooOld, start, retOps, ""
-	} else if start == idx-1 && (len(retOps) == 1 || idx == 0) {
-		if len(ops) > 500 {
-			msg := fmt.Sprintf("length of operations: %d in message is larger than 500", len(ops))
-			log.Println(msg)
-			return wscodes.StatusOperationCommitError, idx, []string{}, msg
+		if len(taken) > 0 {
+			return ErrOpIndexTaken
 		}
-		batch := cs.client.Batch()
 		for i, op := range ops {
-			index := idx + int64(i)
 			operationEntry := &OperationEntry{
-				Index:  index,
+				Index:  idx + int64(i),
 				Op:     op,
 				UserID: committerID,
 			}
 			// Generates a Doc with a random ID; we already access indices by Where queries so
 			// there's no need to have a predictable ID (and reads are faster when they're random).
-			docRef := opsCollection.NewDoc()
-			batch.Create(docRef, *operationEntry)
+			if err := tx.Create(opsCollection.NewDoc(), *operationEntry); err != nil {
+				return err
+			}
 		}
-		_, err := batch.Commit(context.Background())
-		if err != nil {
-			return wscodes.StatusOperationCommitError, idx, []string{}, err.Error()
-		}
-		return wscodes.StatusOperationCommitted, idx, ops, ""
-	} else if start == -1 {
-		log.Printf("operation index: %d larger than upper bound", idx)
-		return wscodes.StatusOperationTooNew, idx, []string{}, ""
-	} else if start > idx {
-		log.Printf("operation index: %d smaller than lower bound: %d", idx, start)
-		return wscodes.StatusOperationTooOld, start, retOps, ""
-	} else {
-		return wscodes.StatusOperationTooOld, idx, retOps[idx-start:], ""
-	}
+		return nil
+	})
 }
 
-// OpsForFile gives the operations starting from index idx.
+// OpsForFile gives the operations starting from index idx, or from after the latest save if it's
+// later, along with the index of the first one given.
 func (cs *collabStorage) OpsForFile(opsCollection *firestore.CollectionRef, idx int64) ([]string, int64, error) {
 	iter := opsCollection.
 		Where("index", ">=", idx-1).
@@ -233,6 +255,13 @@ func (cs *collabStorage) OpsForFile(opsCollection *firestore.CollectionRef, idx
 		}
 		retOps = append(retOps, data.Op)
 	}
+	// A save commits an empty op after the ops on the contents it replaced, which can't be applied
+	// to the saved contents, so neither they nor the marker are given.
+	for i := len(retOps) - 1; i >= 0; i-- {
+		if retOps[i] == "" {
+			return retOps[i+1:], start + int64(i) + 1, nil
+		}
+	}
 	return retOps, start, nil
 }
 
@@ -331,6 +360,18 @@ func (cs *collabStorage) UserEmails(userIDs []string) (map[string]string, error)
 	return emails, nil
 }
 
+// VerifiedEmail gives the email of the user, or "" if they haven't verified that it's theirs.
+func (cs *collabStorage) VerifiedEmail(userID string) (string, error) {
+	userRecord, err := cs.auth.GetUser(context.Background(), userID)
+	if err != nil {
+		return "", err
+	}
+	if !userRecord.EmailVerified {
+		return "", nil
+	}
+	return userRecord.Email, nil
+}
+
 func (cs *collabStorage) UserIDsForEmails(emails []string) (map[string]string, error) {
 	ids := map[string]string{}
 	for _, email := range emails {
@@ -425,3 +466,314 @@ func (cs *collabStorage) UpdateUsersHubList(userID, hubName, role string) error
 
 	return cs.UpdateEntry(docRef, roleField, role)
 }
+
+// AllAuthEntries gives the role entries in the authorization collection of a hub.
+func (cs *collabStorage) AllAuthEntries(collection *firestore.CollectionRef) ([]collections.AuthEntry, error) {
+	docs, err := cs.allDocs(collection)
+	if err != nil {
+		return nil, err
+	}
+	entries := []collections.AuthEntry{}
+	for _, doc := range docs {
+		entry := collections.AuthEntry{}
+		if err := doc.DataTo(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// AllServiceAccounts gives the service accounts in the collection, including revoked ones.
+func (cs *collabStorage) AllServiceAccounts(collection *firestore.CollectionRef) ([]collections.ServiceAccount, error) {
+	docs, err := cs.allDocs(collection)
+	if err != nil {
+		return nil, err
+	}
+	accounts := []collections.ServiceAccount{}
+	for _, doc := range docs {
+		account := collections.ServiceAccount{}
+		if err := doc.DataTo(&account); err != nil {
+			return nil, err
+		}
+		account.ID = doc.Ref.ID
+		accounts = append(accounts, account)
+	}
+	return accounts, nil
+}
+
+// AllRoleDefinitions gives the custom roles defined in the collection, leaving out deleted ones.
+func (cs *collabStorage) AllRoleDefinitions(collection *firestore.CollectionRef) ([]collections.RoleDefinition, error) {
+	docs, err := cs.allDocs(collection)
+	if err != nil {
+		return nil, err
+	}
+	roles := []collections.RoleDefinition{}
+	for _, doc := range docs {
+		role := collections.RoleDefinition{}
+		if err := doc.DataTo(&role); err != nil {
+			return nil, err
+		}
+		if role.Deleted {
+			continue
+		}
+		role.Name = doc.Ref.ID
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// AllInvites gives the invites in the collection, including revoked and expired ones.
+func (cs *collabStorage) AllInvites(collection *firestore.CollectionRef) ([]collections.Invite, error) {
+	docs, err := cs.allDocs(collection)
+	if err != nil {
+		return nil, err
+	}
+	invites := []collections.Invite{}
+	for _, doc := range docs {
+		invite := collections.Invite{}
+		if err := doc.DataTo(&invite); err != nil {
+			return nil, err
+		}
+		invite.ID = doc.Ref.ID
+		invites = append(invites, invite)
+	}
+	return invites, nil
+}
+
+// AllPublicLinks gives the public links in the collection, including revoked ones.
+func (cs *collabStorage) AllPublicLinks(collection *firestore.CollectionRef) ([]collections.PublicLink, error) {
+	docs, err := cs.allDocs(collection)
+	if err != nil {
+		return nil, err
+	}
+	links := []collections.PublicLink{}
+	for _, doc := range docs {
+		link := collections.PublicLink{}
+		if err := doc.DataTo(&link); err != nil {
+			return nil, err
+		}
+		link.ID = doc.Ref.ID
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// RedeemInvite uses up one use of the invite at docRef if check accepts it, giving the invite. The
+// check and the use are done in a transaction, so an invite can't be used more times than it allows.
+func (cs *collabStorage) RedeemInvite(docRef *firestore.DocumentRef, check func(invite *collections.Invite) error) (*collections.Invite, error) {
+	invite := &collections.Invite{}
+	err := cs.client.RunTransaction(context.Background(), func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(docRef)
+		if err != nil {
+			return err
+		}
+		// The transaction may be retried, so start from a fresh invite each time.
+		*invite = collections.Invite{}
+		if err := snapshot.DataTo(invite); err != nil {
+			return err
+		}
+		if err := check(invite); err != nil {
+			return err
+		}
+		invite.Uses++
+		return tx.Update(docRef, []firestore.Update{{Path: inviteUsesField, Value: invite.Uses}})
+	})
+	if err != nil {
+		return nil, err
+	}
+	invite.ID = docRef.ID
+	return invite, nil
+}
+
+// TransferOwnership carries out the ownership transfer of the hub at hubRef, whose members are in
+// users, if check accepts it along with the current roles of the users it's from and to, which are
+// "" for users who aren't in users. The user it's to is given ownerRole and the one it's from
+// formerRole, and the transfer is cleared. The check and the changes are done in a transaction, so
+// the hub is never left with both users or neither as owners. It gives the transfer and the role
+// the new owner had before.
+func (cs *collabStorage) TransferOwnership(hubRef *firestore.DocumentRef, users *firestore.CollectionRef, ownerRole, formerRole string,
+	check func(transfer *collections.OwnershipTransfer, fromRole, toRole string) error) (*collections.OwnershipTransfer, string, error) {
+	var transfer *collections.OwnershipTransfer
+	var toRole string
+	err := cs.client.RunTransaction(context.Background(), func(ctx context.Context, tx *firestore.Transaction) error {
+		snapshot, err := tx.Get(hubRef)
+		if err != nil {
+			return err
+		}
+		hub := struct {
+			OwnershipTransfer *collections.OwnershipTransfer `firestore:"ownershipTransfer,omitempty"`
+		}{}
+		if err := snapshot.DataTo(&hub); err != nil {
+			return err
+		}
+		transfer = hub.OwnershipTransfer
+		if transfer == nil {
+			return check(nil, "", "")
+		}
+		fromRef, fromRole, err := memberInTransaction(tx, users, transfer.From)
+		if err != nil {
+			return err
+		}
+		toRef, role, err := memberInTransaction(tx, users, transfer.To)
+		if err != nil {
+			return err
+		}
+		toRole = role
+		if err := check(transfer, fromRole, toRole); err != nil {
+			return err
+		}
+		if err := tx.Update(toRef, []firestore.Update{{Path: roleField, Value: ownerRole}}); err != nil {
+			return err
+		}
+		if err := tx.Update(fromRef, []firestore.Update{{Path: roleField, Value: formerRole}}); err != nil {
+			return err
+		}
+		return tx.Update(hubRef, []firestore.Update{{Path: ownershipTransferField, Value: nil}})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return transfer, toRole, nil
+}
+
+// memberInTransaction gives the entry of the user in users and their role, or a nil entry and "" if
+// they don't have one.
+func memberInTransaction(tx *firestore.Transaction, users *firestore.CollectionRef, userID string) (*firestore.DocumentRef, string, error) {
+	docs, err := tx.Documents(users.Where(userIDField, "==", userID).Limit(1)).GetAll()
+	if err != nil || len(docs) == 0 {
+		return nil, "", err
+	}
+	entry := collections.AuthEntry{}
+	if err := docs[0].DataTo(&entry); err != nil {
+		return nil, "", err
+	}
+	return docs[0].Ref, entry.Role, nil
+}
+
+// SetPendingInvitation stores the invitation, replacing any earlier one of the email to the same hub.
+func (cs *collabStorage) SetPendingInvitation(invitation collections.PendingInvitation) error {
+	invitation.Email = strings.ToLower(invitation.Email)
+	docRef, err := cs.pendingInvitation(invitation.Email, invitation.Hub)
+	if err != nil {
+		return err
+	}
+	if docRef == nil {
+		_, err = cs.AddEntry(cs.pendingInvitations, "", invitation)
+		return err
+	}
+	_, err = docRef.Set(context.Background(), invitation)
+	return err
+}
+
+// DeletePendingInvitation removes the invitation of the email to the hub, reporting whether there was one.
+func (cs *collabStorage) DeletePendingInvitation(email, hubName string) (bool, error) {
+	docRef, err := cs.pendingInvitation(strings.ToLower(email), hubName)
+	if err != nil || docRef == nil {
+		return false, err
+	}
+	_, err = docRef.Delete(context.Background())
+	return err == nil, err
+}
+
+// PendingInvitations gives the invitations waiting for a user with the email to sign up.
+func (cs *collabStorage) PendingInvitations(email string) ([]collections.PendingInvitation, error) {
+	return cs.pendingInvitationsWhere(emailField, strings.ToLower(email))
+}
+
+// HubPendingInvitations gives the invitations to the hub waiting for their users to sign up.
+func (cs *collabStorage) HubPendingInvitations(hubName string) ([]collections.PendingInvitation, error) {
+	return cs.pendingInvitationsWhere(hubPath, hubName)
+}
+
+// pendingInvitationsWhere gives the pending invitations whose field at path has the value.
+func (cs *collabStorage) pendingInvitationsWhere(path, value string) ([]collections.PendingInvitation, error) {
+	docs, err := cs.pendingInvitations.Query.
+		Where(path, "==", value).
+		Documents(context.Background()).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	invitations := []collections.PendingInvitation{}
+	for _, doc := range docs {
+		invitation := collections.PendingInvitation{}
+		if err := doc.DataTo(&invitation); err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+	return invitations, nil
+}
+
+// pendingInvitation gives the invitation of the email to the hub, or nil if there isn't one.
+func (cs *collabStorage) pendingInvitation(email, hubName string) (*firestore.DocumentRef, error) {
+	doc, err := cs.pendingInvitations.Query.
+		Where(emailField, "==", email).
+		Where(hubPath, "==", hubName).
+		Documents(context.Background()).Next()
+	if err == iterator.Done {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc.Ref, nil
+}
+
+// AuditEntries gives the page of the audit entries in the collection that match the query, newest
+// first, along with the token of the next page or "" if there isn't one. Filtering on several
+// fields at once needs composite indexes on the collection.
+func (cs *collabStorage) AuditEntries(collection *firestore.CollectionRef, query collections.AuditQuery) ([]collections.AuditEntry, string, error) {
+	q := collection.OrderBy(auditTimeField, firestore.Desc)
+	for field, value := range map[string]string{
+		auditActorField:  query.Actor,
+		auditActionField: query.Action,
+		auditTargetField: query.Target,
+	} {
+		if value != "" {
+			q = q.Where(field, "==", value)
+		}
+	}
+	if !query.Since.IsZero() {
+		q = q.Where(auditTimeField, ">=", query.Since)
+	}
+	if !query.Until.IsZero() {
+		q = q.Where(auditTimeField, "<", query.Until)
+	}
+	if query.PageToken != "" {
+		unknownToken := wscodes.NewError(wscodes.StatusInvalidRequest, "unknown page token").
+			WithDetail("pageToken", query.PageToken)
+		// Page tokens are the IDs of entries, which never have slashes.
+		if strings.Contains(query.PageToken, "/") {
+			return nil, "", unknownToken
+		}
+		last, err := collection.Doc(query.PageToken).Get(context.Background())
+		if status.Code(err) == codes.NotFound {
+			return nil, "", unknownToken
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.StartAfter(last)
+	}
+	// One more than asked for tells whether there's another page.
+	docs, err := q.Limit(query.Limit + 1).Documents(context.Background()).GetAll()
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(docs) > query.Limit {
+		docs = docs[:query.Limit]
+		next = docs[len(docs)-1].Ref.ID
+	}
+	entries := []collections.AuditEntry{}
+	for _, doc := range docs {
+		entry := collections.AuditEntry{}
+		if err := doc.DataTo(&entry); err != nil {
+			return nil, "", err
+		}
+		entry.ID = doc.Ref.ID
+		entries = append(entries, entry)
+	}
+	return entries, next, nil
+}
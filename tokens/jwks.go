@@ -0,0 +1,261 @@
+package tokens
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "collabserver/cloudlog"
+)
+
+const (
+	// A key set from a URL isn't fetched again for an unknown key more often than this, so that
+	// tokens with made up key IDs can't make us hammer the identity provider.
+	minRefetchInterval = time.Minute
+
+	fetchTimeout = 10 * time.Second
+)
+
+var (
+	errUnknownKey = errors.New("token is signed with an unknown key")
+)
+
+// jwk is a JSON Web Key; only the fields of RSA and P-256 EC public keys are read.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keySet holds the public keys of a JSON Web Key Set read from a file or URL.
+type keySet struct {
+	source  string
+	refresh time.Duration
+
+	// Guards the fields below it.
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	// Closed when the fetch under way is done, or nil if there's none.
+	refreshing chan struct{}
+}
+
+// newKeySet reads the key set at source, which is a file path or an http(s) URL.
+func newKeySet(source string, refresh time.Duration) (*keySet, error) {
+	ks := &keySet{source: source, refresh: refresh}
+	keys, err := ks.load()
+	if err != nil {
+		return nil, fmt.Errorf("loading JWKS from %s: %v", source, err)
+	}
+	ks.keys = keys
+	ks.fetched = time.Now()
+	return ks, nil
+}
+
+func (ks *keySet) isURL() bool {
+	return strings.HasPrefix(ks.source, "http://") || strings.HasPrefix(ks.source, "https://")
+}
+
+// key gives the key with the ID, fetching the key set again if it's from a URL and it's stale or
+// doesn't have the key. The fetch happens outside the lock: known keys are given from the stale set
+// in the meantime, and only callers after an unknown key wait for it.
+func (ks *keySet) key(kid string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	key, ok := ks.find(kid)
+	since := time.Since(ks.fetched)
+	var refreshed chan struct{}
+	if ks.isURL() && ((!ok && since > minRefetchInterval) || since > ks.refresh) {
+		refreshed = ks.startRefresh()
+	}
+	ks.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if refreshed == nil {
+		return nil, errUnknownKey
+	}
+	<-refreshed
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if key, ok := ks.find(kid); ok {
+		return key, nil
+	}
+	return nil, errUnknownKey
+}
+
+// startRefresh fetches the key set again in the background unless a fetch is already under way, giving
+// a chan that's closed once it's done. ks.mu must be held.
+func (ks *keySet) startRefresh() chan struct{} {
+	if ks.refreshing != nil {
+		return ks.refreshing
+	}
+	done := make(chan struct{})
+	ks.refreshing = done
+	go func() {
+		keys, err := ks.load()
+		ks.mu.Lock()
+		if err != nil {
+			// Keep using the keys we have; the identity provider may be briefly unavailable.
+			log.Printf("Error fetching JWKS from %s: %v", ks.source, err)
+		} else {
+			ks.keys = keys
+			ks.fetched = time.Now()
+		}
+		ks.refreshing = nil
+		ks.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// find gives the key with the ID. Tokens without a key ID can only be checked against a set with
+// a single key.
+func (ks *keySet) find(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+func (ks *keySet) checkSignature(header jwtHeader, signed, signature []byte) error {
+	if header.Alg != algRS256 && header.Alg != algES256 {
+		return errUnsupportedAlg
+	}
+	key, err := ks.key(header.Kid)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(signed)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != algRS256 || rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) != nil {
+			return errBadSignature
+		}
+	case *ecdsa.PublicKey:
+		// ES256 signatures are the two 32 byte integers r and s one after the other.
+		if header.Alg != algES256 || len(signature) != 64 {
+			return errBadSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, hash[:], r, s) {
+			return errBadSignature
+		}
+	default:
+		return errUnsupportedAlg
+	}
+	return nil
+}
+
+// load reads and parses the key set, skipping keys that aren't RSA or P-256 signing keys.
+func (ks *keySet) load() (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if ks.isURL() {
+		data, err = fetch(ks.source)
+	} else {
+		data, err = ioutil.ReadFile(ks.source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("key set has no usable keys")
+	}
+	return keys, nil
+}
+
+func fetch(url string) ([]byte, error) {
+	client := http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("EC point isn't on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
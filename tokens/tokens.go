@@ -0,0 +1,169 @@
+// Package tokens verifies the ID tokens that clients authenticate with. Tokens can be Firebase ID
+// tokens, or JWTs from another identity provider, checked against its JSON Web Key Set or a shared
+// secret; which one is set by the auth section of the config.
+package tokens
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"collabserver/config"
+)
+
+const (
+	algRS256 = "RS256"
+	algES256 = "ES256"
+	algHS256 = "HS256"
+
+	// Allowed difference between our clock and the token issuer's.
+	clockSkew = time.Minute
+)
+
+var (
+	errMalformed        = errors.New("token is not a well-formed JWT")
+	errBadSignature     = errors.New("token signature is invalid")
+	errExpired          = errors.New("token has expired")
+	errNotYetValid      = errors.New("token is not valid yet")
+	errWrongIssuer      = errors.New("token has the wrong issuer")
+	errWrongAudience    = errors.New("token has the wrong audience")
+	errMissingUserID    = errors.New("token doesn't name a user")
+	errUnsupportedAlg   = errors.New("token is signed with an unsupported algorithm")
+	errUnknownVerifier  = errors.New("unknown token verifier")
+	errMissingExpiresAt = errors.New("token has no expiry")
+)
+
+// Verifier checks an ID token, giving the ID of the user it belongs to.
+type Verifier interface {
+	VerifyIDToken(idToken string) (string, error)
+}
+
+// FromConfig gives the verifier that the auth config asks for. Firebase ID tokens are verified by
+// firebase, which is usually storage.DB.
+func FromConfig(auth config.Auth, firebase Verifier) (Verifier, error) {
+	switch auth.Verifier {
+	case config.VerifierFirebase:
+		return firebase, nil
+	case config.VerifierJWKS:
+		keys, err := newKeySet(auth.JWKS, time.Duration(auth.JWKSRefreshSeconds)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return &jwtVerifier{auth: auth, checkSignature: keys.checkSignature}, nil
+	case config.VerifierHMAC:
+		secret := []byte(auth.HMACSecret)
+		return &jwtVerifier{auth: auth, checkSignature: func(header jwtHeader, signed, signature []byte) error {
+			if header.Alg != algHS256 {
+				return errUnsupportedAlg
+			}
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(signed)
+			if !hmac.Equal(mac.Sum(nil), signature) {
+				return errBadSignature
+			}
+			return nil
+		}}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnknownVerifier, auth.Verifier)
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtVerifier verifies JWTs, checking their signatures with checkSignature and their claims
+// against the auth config.
+type jwtVerifier struct {
+	auth config.Auth
+	// checkSignature checks the signature of the signed part of the token, which is its encoded
+	// header and payload.
+	checkSignature func(header jwtHeader, signed, signature []byte) error
+}
+
+func (v *jwtVerifier) VerifyIDToken(idToken string) (string, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", errMalformed
+	}
+	header := jwtHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errMalformed
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := v.checkSignature(header, signed, signature); err != nil {
+		return "", err
+	}
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return "", err
+	}
+	userID, _ := claims[v.auth.UserIDClaim].(string)
+	if userID == "" {
+		return "", errMissingUserID
+	}
+	return userID, nil
+}
+
+// checkClaims checks that the token is currently valid and was meant for us.
+func (v *jwtVerifier) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errMissingExpiresAt
+	}
+	if now.Add(-clockSkew).After(time.Unix(int64(exp), 0)) {
+		return errExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return errNotYetValid
+	}
+	if v.auth.Issuer != "" && claims["iss"] != v.auth.Issuer {
+		return errWrongIssuer
+	}
+	if v.auth.Audience != "" && !hasAudience(claims["aud"], v.auth.Audience) {
+		return errWrongAudience
+	}
+	return nil
+}
+
+// hasAudience reports whether the aud claim, which is a string or a list of them, includes audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errMalformed
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(v); err != nil {
+		return errMalformed
+	}
+	return nil
+}
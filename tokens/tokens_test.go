@@ -0,0 +1,237 @@
+package tokens
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"collabserver/config"
+)
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// makeToken gives a JWT with the claims, signed by sign.
+func makeToken(t *testing.T, alg, kid string, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	signed := encodeSegment(t, map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encodeSegment(t, claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "user1",
+		"iss": "https://sso.example.com",
+		"aud": []string{"collab"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func hmacAuth() config.Auth {
+	auth := config.Default().Auth
+	auth.Verifier = config.VerifierHMAC
+	auth.HMACSecret = "secret"
+	auth.Issuer = "https://sso.example.com"
+	auth.Audience = "collab"
+	return auth
+}
+
+func signHMAC(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func TestHMACVerifier(t *testing.T) {
+	verifier, err := FromConfig(hmacAuth(), nil)
+	if err != nil {
+		t.Fatalf("FromConfig failed: %v", err)
+	}
+	userID, err := verifier.VerifyIDToken(makeToken(t, algHS256, "", validClaims(), signHMAC("secret")))
+	if err != nil || userID != "user1" {
+		t.Errorf("VerifyIDToken of a valid token gave %q, %v", userID, err)
+	}
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	wrongAudience := validClaims()
+	wrongAudience["aud"] = "other"
+	noExpiry := validClaims()
+	delete(noExpiry, "exp")
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"wrong secret", makeToken(t, algHS256, "", validClaims(), signHMAC("guess")), errBadSignature},
+		{"expired", makeToken(t, algHS256, "", expired, signHMAC("secret")), errExpired},
+		{"wrong audience", makeToken(t, algHS256, "", wrongAudience, signHMAC("secret")), errWrongAudience},
+		{"no expiry", makeToken(t, algHS256, "", noExpiry, signHMAC("secret")), errMissingExpiresAt},
+		{"unsigned", makeToken(t, "none", "", validClaims(), func([]byte) []byte { return nil }), errUnsupportedAlg},
+		{"not a JWT", "abc", errMalformed},
+	}
+	for _, test := range tests {
+		if _, err := verifier.VerifyIDToken(test.token); err != test.want {
+			t.Errorf("VerifyIDToken of a token with %s gave error %v but want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func writeJWKS(t *testing.T, rsaKey *rsa.PublicKey, ecKey *ecdsa.PublicKey) []byte {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	data, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestJWKSVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(path, writeJWKS(t, &rsaKey.PublicKey, &ecKey.PublicKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	signRSA := func(signed []byte) []byte {
+		hash := sha256.Sum256(signed)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	signEC := func(signed []byte) []byte {
+		hash := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// r and s are padded to 32 bytes each.
+		sig := make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+		return sig
+	}
+
+	auth := config.Default().Auth
+	auth.Verifier = config.VerifierJWKS
+	auth.JWKS = path
+	verifier, err := FromConfig(auth, nil)
+	if err != nil {
+		t.Fatalf("FromConfig failed: %v", err)
+	}
+	if userID, err := verifier.VerifyIDToken(makeToken(t, algRS256, "rsa1", validClaims(), signRSA)); err != nil || userID != "user1" {
+		t.Errorf("VerifyIDToken of an RS256 token gave %q, %v", userID, err)
+	}
+	if userID, err := verifier.VerifyIDToken(makeToken(t, algES256, "ec1", validClaims(), signEC)); err != nil || userID != "user1" {
+		t.Errorf("VerifyIDToken of an ES256 token gave %q, %v", userID, err)
+	}
+	if _, err := verifier.VerifyIDToken(makeToken(t, algRS256, "ec1", validClaims(), signRSA)); err != errBadSignature {
+		t.Errorf("VerifyIDToken of a token naming the wrong key gave %v but want %v", err, errBadSignature)
+	}
+	if _, err := verifier.VerifyIDToken(makeToken(t, algRS256, "rsa2", validClaims(), signRSA)); err != errUnknownKey {
+		t.Errorf("VerifyIDToken of a token naming an unknown key gave %v but want %v", err, errUnknownKey)
+	}
+	// A shared secret token mustn't be accepted by a public key verifier.
+	if _, err := verifier.VerifyIDToken(makeToken(t, algHS256, "rsa1", validClaims(), signHMAC("secret"))); err != errUnsupportedAlg {
+		t.Errorf("VerifyIDToken of an HS256 token gave %v but want %v", err, errUnsupportedAlg)
+	}
+
+	// The same key set served from a URL.
+	jwks, _ := ioutil.ReadFile(path)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer server.Close()
+	auth.JWKS = server.URL
+	verifier, err = FromConfig(auth, nil)
+	if err != nil {
+		t.Fatalf("FromConfig with a JWKS URL failed: %v", err)
+	}
+	if userID, err := verifier.VerifyIDToken(makeToken(t, algES256, "ec1", validClaims(), signEC)); err != nil || userID != "user1" {
+		t.Errorf("VerifyIDToken against a JWKS URL gave %q, %v", userID, err)
+	}
+}
+
+func TestJWKSRefreshDoesntHoldUpKnownKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := writeJWKS(t, &rsaKey.PublicKey, &ecKey.PublicKey)
+	var fetches int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every fetch after the first hangs until released.
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			<-release
+		}
+		w.Write(jwks)
+	}))
+	defer server.Close()
+	ks, err := newKeySet(server.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.fetched = time.Now().Add(-2 * time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if _, err := ks.key("rsa1"); err != nil {
+			t.Errorf("key from a stale set gave %v", err)
+		}
+	}
+	unknown := make(chan error)
+	go func() {
+		_, err := ks.key("rsa2")
+		unknown <- err
+	}()
+	close(release)
+	if err := <-unknown; err != errUnknownKey {
+		t.Errorf("unknown key gave %v but want %v", err, errUnknownKey)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("key set was fetched %d times but want 2", n)
+	}
+}
@@ -0,0 +1,69 @@
+package websocketcodes
+
+import (
+	"errors"
+	"fmt"
+)
+
+// retryableStatuses are the failure statuses where sending the same request again later can succeed.
+var retryableStatuses = map[string]bool{
+	StatusFailure:              true,
+	StatusOperationCommitError: true,
+	StatusOperationTooNew:      true,
+	StatusRateLimited:          true,
+	StatusDatastoreError:       true,
+	StatusTimeout:              true,
+}
+
+// Error is a failure reported to clients. Code is one of the Status constants and is stable, so
+// clients can act on it; Message is for people and can change.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Retryable is true if sending the same request again later can succeed.
+	Retryable bool `json:"retryable"`
+	// Details gives extra machine-readable context, such as the name of the missing file.
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// NewError gives an Error with the code and message, retryable if the code usually is.
+func NewError(code, message string) *Error {
+	return &Error{
+		Code:      code,
+		Message:   message,
+		Retryable: retryableStatuses[code],
+	}
+}
+
+// Errorf gives an Error with the code and a formatted message.
+func Errorf(code, format string, a ...interface{}) *Error {
+	return NewError(code, fmt.Sprintf(format, a...))
+}
+
+// AsError gives err as an Error. Errors that aren't already one are treated as datastore errors,
+// since that is where untyped errors come from.
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return NewError(StatusDatastoreError, err.Error())
+}
+
+// WithDetail gives a copy of the error with the detail added.
+func (e *Error) WithDetail(key, value string) *Error {
+	copied := *e
+	copied.Details = make(map[string]string, len(e.Details)+1)
+	for k, v := range e.Details {
+		copied.Details[k] = v
+	}
+	copied.Details[key] = value
+	return &copied
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
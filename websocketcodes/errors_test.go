@@ -0,0 +1,30 @@
+package websocketcodes
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAsError(t *testing.T) {
+	typed := NewError(StatusFileDoesntExist, "file doesn't exist")
+	if got := AsError(fmt.Errorf("wrapped: %w", typed)); got != typed {
+		t.Errorf("AsError gave %v but want the wrapped error %v", got, typed)
+	}
+
+	got := AsError(errors.New("deadline exceeded"))
+	if got.Code != StatusDatastoreError || !got.Retryable {
+		t.Errorf("AsError gave %+v for an untyped error but want a retryable %s", got, StatusDatastoreError)
+	}
+}
+
+func TestWithDetail(t *testing.T) {
+	base := NewError(StatusFileExists, "file already exists")
+	detailed := base.WithDetail("file", "a.ipynb").WithDetail("hub", "ABCDEF")
+	if base.Details != nil {
+		t.Errorf("WithDetail changed the original error's details to %v", base.Details)
+	}
+	if detailed.Details["file"] != "a.ipynb" || detailed.Details["hub"] != "ABCDEF" {
+		t.Errorf("WithDetail gave details %v but want both file and hub", detailed.Details)
+	}
+}
@@ -37,4 +37,85 @@ const (
 
 	// StatusNotConnectedToHub is given when the user attempts to perform a hub action while not connected to a hub.
 	StatusNotConnectedToHub = "NOT_CONNECTED_TO_HUB"
+
+	// StatusRateLimited is given when the user is sending messages faster than allowed; the message's
+	// RetryAfter gives how long to wait before sending again.
+	StatusRateLimited = "RATE_LIMITED"
+
+	// StatusMessageTooLarge is given when a message is larger than the maximum message size; the
+	// client should split it into smaller messages.
+	StatusMessageTooLarge = "MESSAGE_TOO_LARGE"
+
+	// StatusTooManyOperations is given when a message has more operations than allowed in one message.
+	StatusTooManyOperations = "TOO_MANY_OPERATIONS"
+
+	// StatusOperationTooLarge is given when a single operation in a message is larger than allowed.
+	StatusOperationTooLarge = "OPERATION_TOO_LARGE"
+
+	// StatusFileStateTooLarge is given when a message's file state is larger than allowed.
+	StatusFileStateTooLarge = "FILE_STATE_TOO_LARGE"
+
+	// StatusProtocolUnsupported is given when a client asks for a protocol version the server doesn't support.
+	StatusProtocolUnsupported = "PROTOCOL_UNSUPPORTED"
+
+	// StatusUserNotFound is given when a user being added or modified can't be found.
+	StatusUserNotFound = "USER_NOT_FOUND"
+
+	// StatusDatastoreError is given when reading from or writing to the datastore failed.
+	StatusDatastoreError = "DATASTORE_ERROR"
+
+	// StatusFileRenameFailed is given when renaming a file failed.
+	StatusFileRenameFailed = "RENAME_FILE_FAILED"
+
+	// StatusFileDeleteFailed is given when deleting a file failed.
+	StatusFileDeleteFailed = "DELETE_FILE_FAILED"
+
+	// StatusHubDoesntExist is given when the user tries to access a hub that doesn't exist.
+	StatusHubDoesntExist = "HUB_DOESNT_EXIST"
+
+	// StatusTimeout is given when the server gave up waiting on a hub to handle the request.
+	StatusTimeout = "TIMEOUT"
+
+	// StatusInvalidRequest is given when the request is missing fields or can't be parsed.
+	StatusInvalidRequest = "INVALID_REQUEST"
+
+	// StatusCheckpointDoesntExist is given when restoring a file that has no checkpoint.
+	StatusCheckpointDoesntExist = "CHECKPOINT_DOESNT_EXIST"
+
+	// StatusServiceAccountDoesntExist is given when changing a service account the hub doesn't have.
+	StatusServiceAccountDoesntExist = "SERVICE_ACCOUNT_DOESNT_EXIST"
+
+	// StatusRoleDoesntExist is given when using a role that is neither built in nor defined by the hub.
+	StatusRoleDoesntExist = "ROLE_DOESNT_EXIST"
+
+	// StatusRoleInUse is given when deleting a custom role that members of the hub still have.
+	StatusRoleInUse = "ROLE_IN_USE"
+
+	// StatusInviteInvalid is given when joining a hub with an invite that doesn't exist, is revoked,
+	// has expired, is used up or is for users with emails at another domain.
+	StatusInviteInvalid = "INVITE_INVALID"
+
+	// StatusInviteDoesntExist is given when changing an invite the hub doesn't have.
+	StatusInviteDoesntExist = "INVITE_DOESNT_EXIST"
+
+	// StatusPublicLinkInvalid is given when connecting with a public link that doesn't exist or is revoked.
+	StatusPublicLinkInvalid = "PUBLIC_LINK_INVALID"
+
+	// StatusPublicLinkDoesntExist is given when revoking a public link the hub doesn't have.
+	StatusPublicLinkDoesntExist = "PUBLIC_LINK_DOESNT_EXIST"
+
+	// StatusLastOwner is given when a change would leave the hub without an owner.
+	StatusLastOwner = "LAST_OWNER"
+
+	// StatusNoOwnershipTransfer is given when accepting or cancelling an ownership transfer that
+	// wasn't offered, or has expired.
+	StatusNoOwnershipTransfer = "NO_OWNERSHIP_TRANSFER"
+
+	// StatusFileReplaced is given for operations made on a file's contents from before they were
+	// replaced by a save, which the client has to retrieve again.
+	StatusFileReplaced = "FILE_REPLACED"
+
+	// StatusSnapshotBehind is given when a file's snapshot couldn't be brought up to date with its
+	// operations in time, so its current contents can't be given.
+	StatusSnapshotBehind = "SNAPSHOT_BEHIND"
 )